@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
+)
+
+const (
+	cgroupMountPoint = "/sys/fs/cgroup"
+	cgroupNamePrefix = "koj-"
+	// cgroup v2 でrunner自身を移動させる葉のcgroup
+	cgroupRunnerLeaf = cgroupNamePrefix + "runner"
+)
+
+var (
+	errCgroupStatNotFound = errors.New("cgroup stat not found")
+	errSelfCgroupNotFound = errors.New("writable cgroup of the runner is not found")
+)
+
+// テストケース1つ分のcgroup
+type cgroup interface {
+	addProcess(pid int) error
+	cpuTime() (time.Duration, error)
+	peakMemory() (int64, error)
+	oomKilled() (bool, error)
+	remove() error
+}
+
+type cgroupRoot interface {
+	newCgroup(name string, memoryLimit int64) (cgroup, error)
+	// 次にコンテナでexecできるように、loadCgroupRootでの変更を元に戻す
+	release() error
+}
+
+// v2が使えればv2、だめならv1を使う。どちらも使えなければエラーを返す。
+func loadCgroupRoot() (cgroupRoot, error) {
+	if _, err := os.Stat(filepath.Join(cgroupMountPoint, "cgroup.controllers")); err == nil {
+		return loadCgroupV2Root()
+	}
+	return loadCgroupV1Root()
+}
+
+type cgroupV2Root struct {
+	dir string
+}
+
+func loadCgroupV2Root() (cgroupRoot, error) {
+	dir, err := findSelfCgroupV2Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	// プロセスがいるcgroupではsubtree_controlを設定できないので、
+	// runner自身と、コンテナを使い回しているときのPID 1などを葉に移す
+	leaf := filepath.Join(dir, cgroupRunnerLeaf)
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	if err := moveCgroupProcs(dir, leaf); err != nil {
+		return nil, err
+	}
+	if err := writeCgroupFile(dir, "cgroup.subtree_control", "+memory +pids"); err != nil {
+		return nil, err
+	}
+
+	return cgroupV2Root{dir}, nil
+}
+
+func (r cgroupV2Root) release() error {
+	if err := writeCgroupFile(r.dir, "cgroup.subtree_control", "-memory -pids"); err != nil {
+		return err
+	}
+	return moveCgroupProcs(filepath.Join(r.dir, cgroupRunnerLeaf), r.dir)
+}
+
+// runnerがいるcgroupのディレクトリを探す。
+// Dockerではサンドボックスのcgroupを/sys/fs/cgroupにマウントしているので、
+// /proc/self/cgroupのパスがマウントした場所と対応しないことがある
+func findSelfCgroupV2Dir() (string, error) {
+	self, err := getSelfCgroupPath("")
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cgroupMountPoint, self)
+	if cgroupHasProcess(dir, os.Getpid()) {
+		return dir, nil
+	}
+
+	found := ""
+	filepath.Walk(cgroupMountPoint, func(p string, info os.FileInfo, err error) error {
+		// 見つかったら残りは見ない
+		if err != nil || found != "" {
+			return filepath.SkipDir
+		}
+		if info.IsDir() && cgroupHasProcess(p, os.Getpid()) {
+			found = p
+		}
+		return nil
+	})
+	if found == "" {
+		return "", errSelfCgroupNotFound
+	}
+	return found, nil
+}
+
+func cgroupHasProcess(dir string, pid int) bool {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return false
+	}
+	p := strconv.Itoa(pid)
+	for _, f := range strings.Fields(string(b)) {
+		if f == p {
+			return true
+		}
+	}
+	return false
+}
+
+// srcにいるプロセスをすべてdstに移す。途中で終了したプロセスは無視する
+func moveCgroupProcs(src, dst string) error {
+	b, err := ioutil.ReadFile(filepath.Join(src, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+
+	for _, pid := range strings.Fields(string(b)) {
+		if err := writeCgroupFile(dst, "cgroup.procs", pid); err != nil {
+			if _, statErr := os.Stat("/proc/" + pid); os.IsNotExist(statErr) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (r cgroupV2Root) newCgroup(name string, memoryLimit int64) (cgroup, error) {
+	dir := filepath.Join(r.dir, cgroupNamePrefix+name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	cg := cgroupV2{dir}
+
+	if err := writeCgroupFile(dir, "memory.max", strconv.FormatInt(memoryLimit, 10)); err != nil {
+		cg.remove()
+		return nil, err
+	}
+	// swapが無効な環境ではファイル自体がない
+	_ = writeCgroupFile(dir, "memory.swap.max", "0")
+
+	// 並列に実行しているほかのテストケースのプロセス数の枠を使い切らないようにする
+	if err := writeCgroupFile(dir, "pids.max", strconv.Itoa(workers.CasePidsLimit)); err != nil {
+		cg.remove()
+		return nil, err
+	}
+
+	return cg, nil
+}
+
+type cgroupV2 struct {
+	dir string
+}
+
+func (c cgroupV2) addProcess(pid int) error {
+	return writeCgroupFile(c.dir, "cgroup.procs", strconv.Itoa(pid))
+}
+
+func (c cgroupV2) cpuTime() (time.Duration, error) {
+	usec, err := readCgroupKeyedValue(c.dir, "cpu.stat", "usage_usec")
+	return time.Duration(usec) * time.Microsecond, err
+}
+
+func (c cgroupV2) peakMemory() (int64, error) {
+	// memory.peakはLinux 5.19から
+	return readCgroupInt(c.dir, "memory.peak")
+}
+
+func (c cgroupV2) oomKilled() (bool, error) {
+	n, err := readCgroupKeyedValue(c.dir, "memory.events", "oom_kill")
+	return 0 < n, err
+}
+
+func (c cgroupV2) remove() error {
+	return os.Remove(c.dir)
+}
+
+type cgroupV1Root struct {
+	memoryDir  string
+	cpuacctDir string
+}
+
+func loadCgroupV1Root() (cgroupRoot, error) {
+	memory, err := getSelfCgroupPath("memory")
+	if err != nil {
+		return nil, err
+	}
+	cpuacct, err := getSelfCgroupPath("cpuacct")
+	if err != nil {
+		return nil, err
+	}
+
+	r := cgroupV1Root{
+		memoryDir:  filepath.Join(cgroupMountPoint, "memory", memory),
+		cpuacctDir: filepath.Join(cgroupMountPoint, "cpuacct", cpuacct),
+	}
+	// コンテナの中では自分のcgroupがマウントポイントの直下に見えることがある
+	if _, err := os.Stat(r.memoryDir); err != nil {
+		r.memoryDir = filepath.Join(cgroupMountPoint, "memory")
+	}
+	if _, err := os.Stat(r.cpuacctDir); err != nil {
+		r.cpuacctDir = filepath.Join(cgroupMountPoint, "cpuacct")
+	}
+	return r, nil
+}
+
+func (r cgroupV1Root) newCgroup(name string, memoryLimit int64) (cgroup, error) {
+	cg := cgroupV1{
+		memoryDir:  filepath.Join(r.memoryDir, cgroupNamePrefix+name),
+		cpuacctDir: filepath.Join(r.cpuacctDir, cgroupNamePrefix+name),
+	}
+	if err := os.Mkdir(cg.memoryDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(cg.cpuacctDir, 0755); err != nil {
+		cg.remove()
+		return nil, err
+	}
+
+	limit := strconv.FormatInt(memoryLimit, 10)
+	if err := writeCgroupFile(cg.memoryDir, "memory.limit_in_bytes", limit); err != nil {
+		cg.remove()
+		return nil, err
+	}
+	// swapのアカウンティングが無効な環境ではファイル自体がない
+	_ = writeCgroupFile(cg.memoryDir, "memory.memsw.limit_in_bytes", limit)
+
+	return cg, nil
+}
+
+func (r cgroupV1Root) release() error {
+	return nil
+}
+
+type cgroupV1 struct {
+	memoryDir  string
+	cpuacctDir string
+}
+
+func (c cgroupV1) addProcess(pid int) error {
+	p := strconv.Itoa(pid)
+	if err := writeCgroupFile(c.memoryDir, "cgroup.procs", p); err != nil {
+		return err
+	}
+	return writeCgroupFile(c.cpuacctDir, "cgroup.procs", p)
+}
+
+func (c cgroupV1) cpuTime() (time.Duration, error) {
+	ns, err := readCgroupInt(c.cpuacctDir, "cpuacct.usage")
+	return time.Duration(ns), err
+}
+
+func (c cgroupV1) peakMemory() (int64, error) {
+	return readCgroupInt(c.memoryDir, "memory.max_usage_in_bytes")
+}
+
+func (c cgroupV1) oomKilled() (bool, error) {
+	// oom_killはLinux 4.13から
+	n, err := readCgroupKeyedValue(c.memoryDir, "memory.oom_control", "oom_kill")
+	if err == nil {
+		return 0 < n, nil
+	}
+
+	n, err = readCgroupInt(c.memoryDir, "memory.failcnt")
+	return 0 < n, err
+}
+
+func (c cgroupV1) remove() error {
+	cpuErr := os.Remove(c.cpuacctDir)
+	if err := os.Remove(c.memoryDir); err != nil {
+		return err
+	}
+	return cpuErr
+}
+
+// /proc/self/cgroup から自分が所属しているcgroupのパスを探す。
+// controllerが空文字列のときはv2のものを返す。
+func getSelfCgroupPath(controller string) (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(s.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if controller == "" && fields[0] == "0" && fields[1] == "" {
+			return fields[2], nil
+		}
+		for _, c := range strings.Split(fields[1], ",") {
+			if controller != "" && c == controller {
+				return fields[2], nil
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+
+	return "", errCgroupStatNotFound
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+func readCgroupInt(dir, name string) (int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// "key value"形式の行が並んでいるファイルからkeyの値を読む
+func readCgroupKeyedValue(dir, name, key string) (int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, l := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) != 2 || fields[0] != key {
+			continue
+		}
+		return strconv.ParseInt(fields[1], 10, 64)
+	}
+
+	return 0, errCgroupStatNotFound
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
+)
+
+// チェッカーの結果を書き込むディレクトリとrunnerのログは、nobodyから見えないようにする
+func setupChecker() error {
+	cred, err := getNobodyCredential()
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{outputDir, statusDir} {
+		if err := os.Chmod(p, 0700); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(dataDir+"err", 0600); err != nil {
+		return err
+	}
+	return grantReadAccess(int(cred.Gid), checkerReadableDirs)
+}
+
+// チェッカーが読むディレクトリ
+var checkerReadableDirs = []string{inputDir, answerDir, submissionDir, checkerDir}
+
+// nobodyで動かすチェッカーやインタラクタが、テストケースと提出の出力を読めるようにする。
+// 所有者はrootのままグループをnobodyのグループにして、書き込みはできないようにする。
+// 結果を書き込むstatusとoutputには入れないようにしておくこと
+func grantReadAccess(gid int, dirs []string) error {
+	if err := chownReadable(dataDir, gid, true); err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		err := filepath.Walk(d, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return chownReadable(p, gid, info.IsDir() || info.Mode()&0111 != 0)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ディレクトリと実行ファイルは0550、それ以外は0440にする
+func chownReadable(p string, gid int, executable bool) error {
+	if err := os.Lchown(p, 0, gid); err != nil {
+		return err
+	}
+	mode := os.FileMode(0440)
+	if executable {
+		mode = 0550
+	}
+	return os.Chmod(p, mode)
+}
+
+// チェッカーのコマンドのプレースホルダーを、このテストケースのファイルの絶対パスに置き換える。
+// チェッカーは ./judge_data/checker/ をカレントディレクトリとして起動される。
+func (e Executor) checkerCommand() ([]string, error) {
+	name := e.Input.Name()
+	paths := map[string]string{
+		workers.CheckerInputPlaceholder:  filepath.Join(inputDir, name),
+		workers.CheckerAnswerPlaceholder: filepath.Join(answerDir, name),
+		workers.CheckerOutputPlaceholder: filepath.Join(submissionDir, name),
+	}
+
+	res := make([]string, len(e.Cmd))
+	for i, arg := range e.Cmd {
+		p, ok := paths[arg]
+		if !ok {
+			res[i] = arg
+			continue
+		}
+
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = abs
+	}
+
+	return res, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// 固定しないときのCPUの番号
+const cpuUnpinned = -1
+
+// カーネルのcpu_set_tと同じく1024個のCPUまで扱う
+type cpuSet [16]uint64
+
+// このスレッドが実行できるCPUの一覧を返す。
+// コンテナのcpusetで割り当てられたCPUの数だけテストケースを同時に実行する
+func getAllowedCPUs() ([]int, error) {
+	var set cpuSet
+	_, _, e := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, unsafe.Sizeof(set), uintptr(unsafe.Pointer(&set)))
+	if e != 0 {
+		return nil, e
+	}
+
+	cpus := make([]int, 0)
+	for i := 0; i < len(set)*64; i++ {
+		if set[i/64]&(1<<uint(i%64)) != 0 {
+			cpus = append(cpus, i)
+		}
+	}
+	return cpus, nil
+}
+
+// このスレッドをcpusのCPUだけで実行させる。execした後のプロセスにも引き継がれる
+func setAffinity(cpus []int) error {
+	var set cpuSet
+	for _, c := range cpus {
+		if c < 0 || len(set)*64 <= c {
+			continue
+		}
+		set[c/64] |= 1 << uint(c%64)
+	}
+
+	_, _, e := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(set), uintptr(unsafe.Pointer(&set)))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// "0,2,3" のようなカンマ区切りのCPUの一覧を読む。空文字列のときは空の一覧を返す
+func parseCPUList(s string) ([]int, error) {
+	cpus := make([]int, 0)
+	if s == "" {
+		return cpus, nil
+	}
+
+	for _, f := range strings.Split(s, ",") {
+		c, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, err
+		}
+		cpus = append(cpus, c)
+	}
+	return cpus, nil
+}
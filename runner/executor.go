@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -20,38 +23,75 @@ var (
 	errNotSupportedOS      = errors.New("the os is not supported")
 )
 
+const cpuTimeCheckInterval = 10 * time.Millisecond
+
 type outputWriteResult struct {
 	n   int64
 	err error
 }
 
+type execUsage struct {
+	cpuTime   time.Duration
+	wallTime  time.Duration
+	memory    int64
+	oomKilled bool
+}
+
+// テストケースごとに実行するプログラムの種類
+type execRole int
+
+const (
+	// 提出されたプログラムを、入力を標準入力につないで実行する
+	roleSubmission execRole = iota
+	// 提出されたプログラムを、別のサンドボックスで動くインタラクタとパイプでつないで実行する
+	roleInteraction
+	// 提出の出力を判定するチェッカー
+	roleChecker
+	// 提出されたプログラムと標準入出力を交差させてつなぐインタラクタ
+	roleInteractor
+)
+
 type Executor struct {
-	TimeLimit   time.Duration
-	MemoryLimit int64
-	Input       os.FileInfo
-	Cmd         []string
+	TimeLimit      time.Duration
+	WallTimeLimit  time.Duration
+	MemoryLimit    int64
+	SeccompProfile string
+	Cgroups        cgroupRoot
+	Input          os.FileInfo
+	Cmd            []string
+	Role           execRole
+	// プログラムを固定するCPU。cpuUnpinnedのときは固定しない
+	CPU int
 }
 
-func NewExecutor(timeLimit time.Duration, memoryLimit int64, input os.FileInfo, cmd []string) Executor {
+func NewExecutor(timeLimit, wallTimeLimit time.Duration, memoryLimit int64, seccompProfile string, cgroups cgroupRoot, input os.FileInfo, cmd []string, role execRole, cpu int) Executor {
 	return Executor{
 		timeLimit,
+		wallTimeLimit,
 		memoryLimit,
+		seccompProfile,
+		cgroups,
 		input,
 		cmd,
+		role,
+		cpu,
 	}
 }
 
 func (e Executor) ExecMonitored() error {
-	in, err := os.Open(inputDir + e.Input.Name())
-	if err != nil {
-		return err
-	}
-	defer in.Close()
 	out, err := os.Create(outputDir + e.Input.Name())
 	if err != nil {
 		return err
 	}
 	defer out.Close()
+	// インタラクタは結果をファイルに書き込むので、標準出力は保存しない
+	var dst io.Writer = out
+	if e.Role == roleInteractor {
+		if err := prepareInteractorResult(out); err != nil {
+			return err
+		}
+		dst = ioutil.Discard
+	}
 	pr, pw := io.Pipe()
 	defer pr.Close()
 
@@ -59,7 +99,7 @@ func (e Executor) ExecMonitored() error {
 
 	go func() {
 		defer pw.Close()
-		n, err := io.CopyN(out, pr, outputLimit)
+		n, err := io.CopyN(dst, pr, outputLimit)
 		if err == io.EOF {
 			err = nil
 		}
@@ -70,12 +110,67 @@ func (e Executor) ExecMonitored() error {
 		ch <- outputWriteResult{n, err}
 	}()
 
-	cmd := []string{"/usr/bin/sudo", "-u", "nobody", "--"}
-	cmd = append(cmd, e.Cmd...)
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cred, err := getNobodyCredential()
+	if err != nil {
+		return err
+	}
+
+	// 子プロセスをcgroupに入れ終わるまでexecを待たせるためのパイプ
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer syncR.Close()
+	defer syncW.Close()
+
+	// seccompのフィルタを適用するために、nobodyで自分自身を起動してからexecしてもらう
+	cmd := []string{self, restrictedExecArg, e.SeccompProfile, strconv.Itoa(e.CPU)}
+	args, err := e.command()
+	if err != nil {
+		return err
+	}
+	cmd = append(cmd, args...)
 	c := exec.Command(cmd[0], cmd[1:]...)
-	c.Stdin = in
-	c.Stdout = pw
-	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.ExtraFiles = []*os.File{syncR}
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    true,
+		Credential: cred,
+	}
+	// チェッカーとインタラクタもnobodyで動かす。読むファイルはgrantReadAccessでグループから読めるようにしてある
+	switch e.Role {
+	case roleChecker:
+		c.Dir, err = filepath.Abs(checkerDir)
+	case roleInteractor:
+		c.Dir, err = filepath.Abs(interactorDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	// 相手がEOFを受け取れるように、パイプは子プロセスを起動したらすぐに閉じる
+	var pipes []*os.File
+	if e.Role == roleInteraction || e.Role == roleInteractor {
+		stdin, stdout, err := openInteractionPipes(e.Input.Name(), e.Role == roleInteractor)
+		if err != nil {
+			return err
+		}
+		pipes = []*os.File{stdin, stdout}
+		defer closeFiles(pipes)
+		c.Stdin = stdin
+		c.Stdout = stdout
+	} else {
+		in, err := os.Open(inputDir + e.Input.Name())
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		c.Stdin = in
+		c.Stdout = pw
+	}
 
 	stderrCh := make(chan string, 1)
 	epr, err := c.StderrPipe()
@@ -91,9 +186,9 @@ func (e Executor) ExecMonitored() error {
 		for err == nil {
 			var n int
 			n, err = epr.Read(buf)
-			if stderrLimit < b.Len() {
-				// discard
-				continue
+			// 上限を超えた分は読み捨てる
+			if rest := stderrLimit - b.Len(); rest < n {
+				n = rest
 			}
 			_, _ = b.WriteString(string(buf[:n]))
 		}
@@ -103,40 +198,71 @@ func (e Executor) ExecMonitored() error {
 
 	wait := make(chan error, 1)
 
+	cg, err := e.Cgroups.newCgroup(e.Input.Name(), e.MemoryLimit)
+	if err != nil {
+		return err
+	}
+	defer cg.remove()
+
 	start := time.Now()
+	if err := c.Start(); err != nil {
+		return err
+	}
+	syncR.Close()
+	closeFiles(pipes)
+
+	if err := cg.addProcess(c.Process.Pid); err != nil {
+		killProcessGroup(c.Process)
+		return err
+	}
+	if err := setOOMScoreAdj(c.Process, 1000); err != nil {
+		killProcessGroup(c.Process)
+		return err
+	}
+
+	// cgroupの設定が終わったので、ユーザーのプログラムを起動させる
+	syncW.Close()
+
 	go func() {
-		err := c.Start()
-		if err != nil {
-			wait <- err
-			return
-		}
-		err = setOOMScoreAdj(c.Process, 1000)
-		if err != nil {
-			wait <- err
-			return
-		}
 		wait <- c.Wait()
 	}()
 
+	wallTimer := time.NewTimer(e.WallTimeLimit + time.Millisecond)
+	defer wallTimer.Stop()
+	ticker := time.NewTicker(cpuTimeCheckInterval)
+	defer ticker.Stop()
+
 	done := false
-	select {
-	case err = <-wait:
-		done = true
-	case <-time.After(e.TimeLimit + time.Millisecond):
+	timedOut := false
+monitor:
+	for {
+		select {
+		case err = <-wait:
+			done = true
+			break monitor
+		case <-wallTimer.C:
+			timedOut = true
+			break monitor
+		case <-ticker.C:
+			t, err := cg.cpuTime()
+			if err == nil && e.TimeLimit < t {
+				timedOut = true
+				break monitor
+			}
+		}
 	}
 
-	dur := time.Now().Sub(start)
 	pw.Close()
 
-	if err := killProcessGroup(c.Process); err != nil {
-		if i := strings.Index(err.Error(), "no such process"); i == -1 {
-			log.Fatal(err)
-		}
+	// 自分で終了していたときはESRCHになる
+	if err := killProcessGroup(c.Process); err != nil && err != syscall.ESRCH {
+		return err
 	}
 
 	if !done {
 		err = <-wait
 	}
+	wallTime := time.Now().Sub(start)
 
 	stderr := <-stderrCh
 
@@ -152,17 +278,53 @@ func (e Executor) ExecMonitored() error {
 		return writeRes.err
 	}
 
-	return e.saveExecResult(c, writeRes, stderr, dur)
+	usage, err := measureUsage(c, cg, wallTime)
+	if err != nil {
+		return err
+	}
+
+	if e.Role == roleInteractor {
+		if err := limitInteractorResult(out); err != nil {
+			return err
+		}
+	}
+
+	return e.saveExecResult(c, writeRes, stderr, usage, timedOut)
+}
+
+// 実行するコマンド。チェッカーとインタラクタには、このテストケースのファイルのパスを渡す
+func (e Executor) command() ([]string, error) {
+	switch e.Role {
+	case roleChecker:
+		return e.checkerCommand()
+	case roleInteractor:
+		return e.interactorCommand()
+	}
+	return e.Cmd, nil
 }
 
-func (e Executor) saveExecResult(cmd *exec.Cmd, writeRes outputWriteResult, stderr string, duration time.Duration) error {
-	usage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage)
+func measureUsage(cmd *exec.Cmd, cg cgroup, wallTime time.Duration) (execUsage, error) {
+	rusage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage)
 	if !ok {
-		return errNotSupportedOS
+		return execUsage{}, errNotSupportedOS
 	}
 
-	// なんかGNU Time(1.7)と同じ値を出力してるっぽいので、4で割っとく
-	memory := usage.Maxrss * 1024 / 4
+	res := execUsage{wallTime: wallTime}
+	var err error
+	if res.cpuTime, err = cg.cpuTime(); err != nil {
+		return res, err
+	}
+	if res.oomKilled, err = cg.oomKilled(); err != nil {
+		return res, err
+	}
+	// memory.peakがない古いカーネルでは、制限はcgroupにかかっているので表示する値だけrusageを使う
+	if res.memory, err = cg.peakMemory(); err != nil {
+		res.memory = rusage.Maxrss * 1024
+	}
+	return res, nil
+}
+
+func (e Executor) saveExecResult(cmd *exec.Cmd, writeRes outputWriteResult, stderr string, usage execUsage, timedOut bool) error {
 	wst, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
 	if !ok {
 		return errNotSupportedOS
@@ -171,9 +333,11 @@ func (e Executor) saveExecResult(cmd *exec.Cmd, writeRes outputWriteResult, stde
 
 	status := workers.StatusFinished
 	switch {
-	case e.MemoryLimit < memory || exitStatus == 137:
+	case wst.Signaled() && wst.Signal() == syscall.SIGSYS:
+		status = workers.StatusRestrictedFunction
+	case usage.oomKilled || e.MemoryLimit < usage.memory:
 		status = workers.StatusMemoryLimitExceeded
-	case e.TimeLimit < duration:
+	case timedOut || e.TimeLimit < usage.cpuTime || e.WallTimeLimit < usage.wallTime:
 		status = workers.StatusTimeLimitExceeded
 	case writeRes.err == errOutputLimitExceeded:
 		status = workers.StatusOutputLimitExceeded
@@ -183,8 +347,9 @@ func (e Executor) saveExecResult(cmd *exec.Cmd, writeRes outputWriteResult, stde
 
 	res := workers.ExecResult{
 		Status:      status,
-		ExecTime:    duration,
-		MemoryUsage: memory,
+		ExecTime:    usage.cpuTime,
+		WallTime:    usage.wallTime,
+		MemoryUsage: usage.memory,
 		ExitStatus:  exitStatus,
 		Stderr:      stderr,
 	}
@@ -198,6 +363,27 @@ func (e Executor) saveExecResult(cmd *exec.Cmd, writeRes outputWriteResult, stde
 	return en.Encode(res)
 }
 
+func getNobodyCredential() (*syscall.Credential, error) {
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syscall.Credential{
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Groups: []uint32{},
+	}, nil
+}
+
 func killProcessGroup(process *os.Process) error {
 	pgid, err := syscall.Getpgid(process.Pid)
 	if err != nil {
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
+)
+
+// インタラクタが結果に書き込める長さ
+const interactorResultLimit = 1024
+
+// インタラクタが読むディレクトリ
+var interactorReadableDirs = []string{inputDir, answerDir, interactorDir}
+
+// インタラクタはチェッカーと同じくnobodyで動かす。
+// 結果はoutputのテストケースごとのファイルに書き込ませるので、outputにはnobodyのグループで入れるようにする
+func setupInteractor() error {
+	cred, err := getNobodyCredential()
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(statusDir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(dataDir+"err", 0600); err != nil {
+		return err
+	}
+	if err := os.Lchown(outputDir, 0, int(cred.Gid)); err != nil {
+		return err
+	}
+	if err := os.Chmod(outputDir, 0710); err != nil {
+		return err
+	}
+	return grantReadAccess(int(cred.Gid), interactorReadableDirs)
+}
+
+// インタラクタが結果を書き込むファイルを、nobodyだけが書き込めるようにする
+func prepareInteractorResult(f *os.File) error {
+	cred, err := getNobodyCredential()
+	if err != nil {
+		return err
+	}
+	if err := f.Chown(int(cred.Uid), int(cred.Gid)); err != nil {
+		return err
+	}
+	return f.Chmod(0600)
+}
+
+// 結果が長すぎるときは、インタラクタが終了してから切り詰める
+func limitInteractorResult(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() <= interactorResultLimit {
+		return nil
+	}
+	return f.Truncate(interactorResultLimit)
+}
+
+// インタラクタは ./judge_data/interactor/ をカレントディレクトリとして
+// `cmd... 入力 想定解 結果` のように起動される。
+func (e Executor) interactorCommand() ([]string, error) {
+	name := e.Input.Name()
+	res := make([]string, 0, len(e.Cmd)+3)
+	res = append(res, e.Cmd...)
+	for _, p := range []string{inputDir, answerDir, outputDir} {
+		abs, err := filepath.Abs(filepath.Join(p, name))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, abs)
+	}
+	return res, nil
+}
+
+// 提出されたプログラムとインタラクタをつなぐ名前付きパイプを開いて、標準入力と標準出力にするファイルを返す。
+// 名前付きパイプは相手が開くまで待つので、どちらのrunnerでも.in、.outの順に開く
+func openInteractionPipes(name string, interactor bool) (stdin *os.File, stdout *os.File, err error) {
+	base := filepath.Join(interactionDir, name)
+	inFlag, outFlag := os.O_RDONLY, os.O_WRONLY
+	if interactor {
+		inFlag, outFlag = os.O_WRONLY, os.O_RDONLY
+	}
+
+	in, err := openPipe(base+workers.InteractionInputExt, inFlag)
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := openPipe(base+workers.InteractionOutputExt, outFlag)
+	if err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+
+	if interactor {
+		return out, in, nil
+	}
+	return in, out, nil
+}
+
+// サーバーが作った名前付きパイプ以外は開かない
+func openPipe(name string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(name, flag|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EINVAL}
+	}
+	return f, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
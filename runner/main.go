@@ -1,24 +1,49 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
 	"github.com/labstack/gommon/log"
 )
 
 const (
-	dataDir     = "./judge_data/"
-	inputDir    = dataDir + "input/"
-	outputDir   = dataDir + "output/"
-	statusDir   = dataDir + "status/"
-	outputLimit = 10 * 1024 * 1024
-	stderrLimit = 256
+	dataDir        = "./judge_data/"
+	inputDir       = dataDir + "input/"
+	outputDir      = dataDir + "output/"
+	statusDir      = dataDir + "status/"
+	answerDir      = dataDir + "answer/"
+	interactorDir  = dataDir + "interactor/"
+	checkerDir     = dataDir + "checker/"
+	submissionDir  = dataDir + "submission/"
+	interactionDir = workers.InteractionDir + "/"
+	outputLimit    = 10 * 1024 * 1024
+	stderrLimit    = workers.CaseStderrLimit
+	// これに続けてインタラクタのコマンドを渡すと、テストケースごとにインタラクタを実行する
+	interactorArg = "--interactor"
+	// これに続けて提出されたプログラムのコマンドを渡すと、標準入出力をインタラクタとのパイプにつなぐ
+	interactionArg = "--interaction"
+	// これに続けてチェッカーのコマンドを渡すと、テストケースごとに提出の出力を判定する
+	checkerArg = "--checker"
 )
 
+var errInvalidArgs = errors.New("invalid arg(s)")
+
 func main() {
+	if 1 < len(os.Args) && os.Args[1] == restrictedExecArg {
+		execRestricted(os.Args[2:])
+		return
+	}
+	if 1 < len(os.Args) && os.Args[1] == sandboxArg {
+		execSandbox(os.Args[2:])
+		return
+	}
+
 	defer func() {
 		if err := recover(); err != nil {
 			log.Error(err)
@@ -32,47 +57,125 @@ func main() {
 	defer f.Close()
 	log.SetOutput(f)
 
-	if len(os.Args) < 4 {
-		log.Fatal("invalid arg(s)")
+	// cgroupを片付けてから終了するように、エラーはrunから返してもらう
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	if len(os.Args) < 6 {
+		return errInvalidArgs
 	}
 
-	err = loadSeccompContext()
-	if err != nil {
-		log.Fatal(err)
+	profile := os.Args[4]
+	if _, err := getSeccompProfile(profile); err != nil {
+		return err
 	}
 
 	tl, err := getTimeLimit()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	wl, err := getWallTimeLimit()
+	if err != nil {
+		return err
 	}
 
 	ml, err := getMemoryLimitByte()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	cmd := os.Args[5:]
+	role := roleSubmission
+	switch cmd[0] {
+	case checkerArg:
+		role = roleChecker
+	case interactorArg:
+		role = roleInteractor
+	case interactionArg:
+		role = roleInteraction
+	}
+	if role != roleSubmission {
+		if len(cmd) < 2 {
+			return errInvalidArgs
+		}
+		cmd = cmd[1:]
+	}
+
+	// CPU時間とメモリを制限できないまま実行しないように、cgroupが使えなければジャッジごと失敗させる
+	cgroups, err := loadCgroupRoot()
+	if err != nil {
+		return err
 	}
+	defer cgroups.release()
 
 	inputs, err := ioutil.ReadDir(inputDir)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	os.RemoveAll(outputDir)
-	err = os.Mkdir(outputDir, 0777)
-	if err != nil {
-		log.Fatal(err)
+	if err := os.Mkdir(outputDir, 0777); err != nil {
+		return err
 	}
 
 	os.RemoveAll(statusDir)
-	err = os.Mkdir(statusDir, 0777)
-	if err != nil {
-		log.Fatal(err)
+	if err := os.Mkdir(statusDir, 0777); err != nil {
+		return err
+	}
+
+	switch role {
+	case roleChecker:
+		if err := setupChecker(); err != nil {
+			return err
+		}
+	case roleInteractor:
+		if err := setupInteractor(); err != nil {
+			return err
+		}
 	}
 
+	// コンテナに割り当てられたCPUごとに1つずつ、テストケースを並列に実行する
+	cpus, err := getAllowedCPUs()
+	if err != nil || len(cpus) == 0 {
+		cpus = []int{cpuUnpinned}
+	}
+	free := make(chan int, len(cpus))
+	for _, c := range cpus {
+		free <- c
+	}
+
+	// 失敗したテストケースがあれば、残りは実行せずに実行中のものが終わるのを待つ
+	errs := make(chan error, len(inputs))
+	var wg sync.WaitGroup
 	for _, i := range inputs {
-		e := NewExecutor(tl, ml, i, os.Args[3:])
-		if err := e.ExecMonitored(); err != nil {
-			log.Fatal(err)
+		cpu := <-free
+		if len(errs) != 0 {
+			break
 		}
+		wg.Add(1)
+		go func(i os.FileInfo, cpu int) {
+			defer wg.Done()
+			defer func() {
+				free <- cpu
+			}()
+
+			e := NewExecutor(tl, wl, ml, profile, cgroups, i, cmd, role, cpu)
+			if err := e.ExecMonitored(); err != nil {
+				errs <- err
+			}
+		}(i, cpu)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
 	}
 }
 
@@ -81,6 +184,11 @@ func getTimeLimit() (time.Duration, error) {
 	return time.Duration(t), err
 }
 
+func getWallTimeLimit() (time.Duration, error) {
+	t, err := strconv.ParseInt(os.Args[2], 10, 64)
+	return time.Duration(t), err
+}
+
 func getMemoryLimitByte() (int64, error) {
-	return strconv.ParseInt(os.Args[2], 10, 64)
+	return strconv.ParseInt(os.Args[3], 10, 64)
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
+)
+
+const (
+	// Dockerを使わずにホストで実行するとき、サンドボックスを準備させるための第1引数
+	sandboxArg = "--sandbox"
+	// サンドボックスの準備に失敗したときの終了コード
+	sandboxErrorExitCode = 125
+	// サンドボックスの中でワークスペースが見える場所。serverのworkers.Workspaceと同じ
+	sandboxWorkspace = "/tmp/koj-workspace"
+)
+
+// サンドボックスの中で使えるデバイス
+var sandboxDevices = []string{"null", "zero", "random", "urandom"}
+
+// 新しい名前空間で起動されたことを前提に、rootfsにchrootしてからコマンドを実行する。
+// args: cgroupのディレクトリ (空文字列のときは移動しない) 使うCPUの一覧 rootfs ワークスペース
+// インタラクタと共有するディレクトリ (空文字列のときはマウントしない) コマンド...
+func execSandbox(args []string) {
+	if len(args) < 6 {
+		os.Stderr.WriteString("invalid arg(s)\n")
+		os.Exit(sandboxErrorExitCode)
+	}
+
+	cpus, err := parseCPUList(args[1])
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(sandboxErrorExitCode)
+	}
+
+	if err := setupSandbox(args[0], args[2], args[3], args[4]); err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(sandboxErrorExitCode)
+	}
+
+	path, err := exec.LookPath(args[5])
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(sandboxErrorExitCode)
+	}
+
+	// Dockerのcpusetの代わりに、execするスレッドのaffinityで使えるCPUを制限する
+	runtime.LockOSThread()
+	if len(cpus) != 0 {
+		if err := setAffinity(cpus); err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(sandboxErrorExitCode)
+		}
+	}
+
+	err = syscall.Exec(path, args[5:], os.Environ())
+	os.Stderr.WriteString(err.Error() + "\n")
+	os.Exit(sandboxErrorExitCode)
+}
+
+func setupSandbox(cgroupDir, rootfs, workspace, interaction string) error {
+	// 子プロセスもすべてサーバーが用意したcgroupに入れる
+	if cgroupDir != "" {
+		if err := writeCgroupFile(cgroupDir, "cgroup.procs", "0"); err != nil {
+			return err
+		}
+	}
+
+	// マウントがホストに伝わらないようにする
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+
+	// rootfsはイメージごとに共有しているので、後のジョブのために書き換えられないようにする。
+	// マウント先は読み込み専用にする前に作っておく
+	if cgroupDir != "" {
+		if err := os.MkdirAll(filepath.Join(rootfs, cgroupMountPoint), 0755); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", rootfs, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return err
+	}
+
+	// /tmpはサンドボックスごとに分けて、その中にワークスペースを置く
+	tmp := filepath.Join(rootfs, "tmp")
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return err
+	}
+	if err := bindMount(workspace, filepath.Join(rootfs, sandboxWorkspace), 0); err != nil {
+		return err
+	}
+	if interaction != "" {
+		if err := bindMount(interaction, filepath.Join(rootfs, workers.InteractionDir), 0); err != nil {
+			return err
+		}
+	}
+
+	// 新しいPID名前空間のプロセスだけが見えるprocfs
+	proc := filepath.Join(rootfs, "proc")
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return err
+	}
+
+	// runnerがテストケースごとのcgroupを作れるように、Dockerのときと同じくサンドボックスのcgroupだけを見せる。
+	// ホストのcgroupをすべて見せると、rootで動くrunnerからほかのcgroupの制限を書き換えられる
+	if cgroupDir != "" {
+		if err := syscall.Mount(cgroupDir, filepath.Join(rootfs, cgroupMountPoint), "", syscall.MS_BIND, ""); err != nil {
+			return err
+		}
+	}
+
+	dev := filepath.Join(rootfs, "dev")
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=755"); err != nil {
+		return err
+	}
+	for _, d := range sandboxDevices {
+		if err := bindMount(filepath.Join("/dev", d), filepath.Join(dev, d), 0); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Chroot(rootfs); err != nil {
+		return err
+	}
+	return os.Chdir(sandboxWorkspace)
+}
+
+// マウント先がなければ、srcに合わせてファイルかディレクトリを作成する
+func bindMount(src, dst string, flags uintptr) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		err = os.MkdirAll(dst, 0755)
+	} else {
+		var f *os.File
+		f, err = os.OpenFile(dst, os.O_CREATE|os.O_RDONLY, 0644)
+		if err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return syscall.Mount(src, dst, "", syscall.MS_BIND|flags, "")
+}
@@ -1,5 +1,278 @@
 package main
 
-func loadSeccompContext() error {
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// 子プロセスとして自分自身を起動するときの第1引数
+	restrictedExecArg = "--restricted-exec"
+	// 親プロセスとの同期に使うパイプ (exec.Cmd.ExtraFilesの先頭)
+	syncFd = 3
+	// プロファイル名がこれのときはseccompを使わない
+	seccompProfileNone = "none"
+
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetAllow       = 0x7fff0000
+
+	// struct seccomp_data のオフセット
+	seccompDataNrOffset   = 0
+	seccompDataArchOffset = 4
+
+	bpfLd  = 0x00
+	bpfW   = 0x00
+	bpfAbs = 0x20
+	bpfJmp = 0x05
+	bpfJeq = 0x10
+	bpfK   = 0x00
+	bpfRet = 0x06
+)
+
+var (
+	errUnknownSeccompProfile = errors.New("unknown seccomp profile")
+	errSeccompFilterTooLarge = errors.New("seccomp filter is too large")
+)
+
+// Go のランタイムが exec までの間に呼ぶ可能性があるものも含めている
+var baseSyscalls = []uintptr{
+	syscall.SYS_READ,
+	syscall.SYS_WRITE,
+	syscall.SYS_READV,
+	syscall.SYS_WRITEV,
+	syscall.SYS_PREAD64,
+	syscall.SYS_OPEN,
+	syscall.SYS_OPENAT,
+	syscall.SYS_CLOSE,
+	syscall.SYS_STAT,
+	syscall.SYS_FSTAT,
+	syscall.SYS_LSTAT,
+	syscall.SYS_NEWFSTATAT,
+	sysStatx,
+	syscall.SYS_LSEEK,
+	syscall.SYS_ACCESS,
+	syscall.SYS_FACCESSAT,
+	syscall.SYS_READLINK,
+	syscall.SYS_READLINKAT,
+	syscall.SYS_GETCWD,
+	syscall.SYS_GETDENTS64,
+	syscall.SYS_IOCTL,
+	syscall.SYS_FCNTL,
+	syscall.SYS_DUP,
+	syscall.SYS_DUP2,
+	syscall.SYS_DUP3,
+	syscall.SYS_MMAP,
+	syscall.SYS_MPROTECT,
+	syscall.SYS_MUNMAP,
+	syscall.SYS_MREMAP,
+	syscall.SYS_MADVISE,
+	syscall.SYS_BRK,
+	syscall.SYS_RT_SIGACTION,
+	syscall.SYS_RT_SIGPROCMASK,
+	syscall.SYS_RT_SIGRETURN,
+	syscall.SYS_SIGALTSTACK,
+	syscall.SYS_FUTEX,
+	syscall.SYS_SCHED_YIELD,
+	syscall.SYS_NANOSLEEP,
+	syscall.SYS_CLOCK_GETTIME,
+	syscall.SYS_CLOCK_GETRES,
+	syscall.SYS_GETTIMEOFDAY,
+	syscall.SYS_TIME,
+	syscall.SYS_GETPID,
+	syscall.SYS_GETTID,
+	syscall.SYS_TGKILL,
+	syscall.SYS_GETUID,
+	syscall.SYS_GETGID,
+	syscall.SYS_GETEUID,
+	syscall.SYS_GETEGID,
+	syscall.SYS_GETRLIMIT,
+	syscall.SYS_PRLIMIT64,
+	syscall.SYS_UNAME,
+	syscall.SYS_SYSINFO,
+	syscall.SYS_ARCH_PRCTL,
+	syscall.SYS_SET_TID_ADDRESS,
+	syscall.SYS_SET_ROBUST_LIST,
+	sysRseq,
+	sysGetrandom,
+	syscall.SYS_EXECVE,
+	syscall.SYS_EXIT,
+	syscall.SYS_EXIT_GROUP,
+}
+
+var pythonSyscalls = []uintptr{
+	syscall.SYS_PIPE2,
+	syscall.SYS_SCHED_GETAFFINITY,
+	syscall.SYS_GETPPID,
+	syscall.SYS_POLL,
+	syscall.SYS_SELECT,
+}
+
+var javaSyscalls = []uintptr{
+	syscall.SYS_CLONE,
+	sysClone3,
+	syscall.SYS_SCHED_GETAFFINITY,
+	syscall.SYS_SCHED_GETPARAM,
+	syscall.SYS_SCHED_GETSCHEDULER,
+	syscall.SYS_GETPRIORITY,
+	syscall.SYS_SETPRIORITY,
+	syscall.SYS_PRCTL,
+	syscall.SYS_GETRUSAGE,
+	syscall.SYS_GETPPID,
+	syscall.SYS_KILL,
+	syscall.SYS_CLOCK_NANOSLEEP,
+	syscall.SYS_RT_SIGTIMEDWAIT,
+	syscall.SYS_PIPE2,
+	syscall.SYS_POLL,
+	syscall.SYS_EPOLL_CREATE1,
+	sysMembarrier,
+	// hsperfdataの作成と削除
+	syscall.SYS_MKDIR,
+	syscall.SYS_MKDIRAT,
+	syscall.SYS_UNLINK,
+	syscall.SYS_UNLINKAT,
+	syscall.SYS_FTRUNCATE,
+	syscall.SYS_FSYNC,
+}
+
+// 言語ごとに許可するシステムコールの一覧
+var seccompProfiles = map[string][]uintptr{
+	seccompProfileNone: nil,
+	"c":                baseSyscalls,
+	"python":           concatSyscalls(baseSyscalls, pythonSyscalls),
+	"java":             concatSyscalls(baseSyscalls, javaSyscalls),
+}
+
+func concatSyscalls(lists ...[]uintptr) []uintptr {
+	res := make([]uintptr, 0)
+	for _, l := range lists {
+		res = append(res, l...)
+	}
+	return res
+}
+
+func getSeccompProfile(name string) ([]uintptr, error) {
+	p, ok := seccompProfiles[name]
+	if !ok {
+		return nil, errUnknownSeccompProfile
+	}
+	return p, nil
+}
+
+// 許可リストにないシステムコールを呼んだらプロセスごとSIGSYSで殺すフィルタを作る
+func newSeccompFilter(allowed []uintptr) ([]syscall.SockFilter, error) {
+	n := len(allowed)
+	// 分岐のジャンプ先はuint8で表すので、それを超える長さにはできない
+	if 255 < n {
+		return nil, errSeccompFilterTooLarge
+	}
+
+	filter := []syscall.SockFilter{
+		bpfStmt(bpfLd|bpfW|bpfAbs, seccompDataArchOffset),
+		bpfJump(bpfJmp|bpfJeq|bpfK, auditArch, 1, 0),
+		bpfStmt(bpfRet|bpfK, seccompRetKillProcess),
+		bpfStmt(bpfLd|bpfW|bpfAbs, seccompDataNrOffset),
+	}
+	for i, nr := range allowed {
+		// 一致したら末尾のALLOWまで飛ぶ
+		filter = append(filter, bpfJump(bpfJmp|bpfJeq|bpfK, uint32(nr), uint8(n-i), 0))
+	}
+	filter = append(filter,
+		bpfStmt(bpfRet|bpfK, seccompRetKillProcess),
+		bpfStmt(bpfRet|bpfK, seccompRetAllow),
+	)
+
+	return filter, nil
+}
+
+func bpfStmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// 現在のスレッドにseccompのフィルタを適用する。
+// フィルタはexecve後のプログラムにも引き継がれる。
+func loadSeccompContext(name string) error {
+	allowed, err := getSeccompProfile(name)
+	if err != nil {
+		return err
+	}
+	if allowed == nil {
+		return nil
+	}
+	if auditArch == 0 {
+		return errNotSupportedOS
+	}
+
+	filter, err := newSeccompFilter(allowed)
+	if err != nil {
+		return err
+	}
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	if _, _, e := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); e != 0 {
+		return e
+	}
+	if _, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); e != 0 {
+		return e
+	}
 	return nil
 }
+
+// runner自身を子プロセスとして起動したときに呼ばれる。
+// CPUの固定とseccompを適用してからユーザーのプログラムにexecする。
+// args は [プロファイル名, CPUの番号 (固定しないときは-1), コマンド...]
+func execRestricted(args []string) {
+	if len(args) < 3 {
+		os.Stderr.WriteString("invalid arg(s)\n")
+		os.Exit(127)
+	}
+
+	// 親プロセスがcgroupの設定を終えるまで待つ
+	sync := os.NewFile(syncFd, "sync")
+	sync.Read(make([]byte, 1))
+	sync.Close()
+
+	cpu, err := strconv.Atoi(args[1])
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(127)
+	}
+
+	path, err := exec.LookPath(args[2])
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(127)
+	}
+
+	// フィルタとCPUの固定を適用したスレッドからexecしないといけない
+	runtime.LockOSThread()
+	if cpu != cpuUnpinned {
+		if err := setAffinity([]int{cpu}); err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(127)
+		}
+	}
+	if err := loadSeccompContext(args[0]); err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(127)
+	}
+
+	err = syscall.Exec(path, args[2:], os.Environ())
+	os.Stderr.WriteString(err.Error() + "\n")
+	os.Exit(127)
+}
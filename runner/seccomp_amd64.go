@@ -0,0 +1,13 @@
+package main
+
+// AUDIT_ARCH_X86_64
+const auditArch = 0xc000003e
+
+// syscallパッケージに定義されていないもの
+const (
+	sysGetrandom  = 318
+	sysMembarrier = 324
+	sysStatx      = 332
+	sysRseq       = 334
+	sysClone3     = 435
+)
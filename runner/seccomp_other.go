@@ -0,0 +1,15 @@
+//go:build !amd64
+// +build !amd64
+
+package main
+
+// amd64以外ではseccompのフィルタを作れないので、auditArchを0にしておく
+const auditArch = 0
+
+const (
+	sysGetrandom  = ^uintptr(0)
+	sysMembarrier = ^uintptr(0)
+	sysStatx      = ^uintptr(0)
+	sysRseq       = ^uintptr(0)
+	sysClone3     = ^uintptr(0)
+)
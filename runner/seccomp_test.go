@@ -0,0 +1,220 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestGetSeccompProfile(t *testing.T) {
+	inputs := []string{
+		"none",
+		"c",
+		"python",
+		"java",
+		"ruby",
+		"",
+	}
+	outputs := []struct {
+		Nil bool
+		Err error
+	}{
+		{true, nil},
+		{false, nil},
+		{false, nil},
+		{false, nil},
+		{true, errUnknownSeccompProfile},
+		{true, errUnknownSeccompProfile},
+	}
+
+	for i, in := range inputs {
+		p, err := getSeccompProfile(in)
+		if (p == nil) != outputs[i].Nil || err != outputs[i].Err {
+			t.Errorf("error on test case #%v", i)
+		}
+	}
+}
+
+func TestSeccompProfiles(t *testing.T) {
+	inputs := []struct {
+		Profile string
+		Syscall uintptr
+	}{
+		{"c", syscall.SYS_READ},
+		{"c", syscall.SYS_EXECVE},
+		{"c", syscall.SYS_EXIT_GROUP},
+		{"c", syscall.SYS_CLONE},
+		{"c", syscall.SYS_FORK},
+		{"c", syscall.SYS_SOCKET},
+		{"c", syscall.SYS_PTRACE},
+		{"c", syscall.SYS_KILL},
+		{"c", syscall.SYS_PIPE2},
+		{"python", syscall.SYS_PIPE2},
+		{"python", syscall.SYS_POLL},
+		{"python", syscall.SYS_CLONE},
+		{"python", syscall.SYS_SOCKET},
+		{"java", syscall.SYS_CLONE},
+		{"java", syscall.SYS_KILL},
+		{"java", syscall.SYS_MKDIR},
+		{"java", syscall.SYS_FORK},
+		{"java", syscall.SYS_CONNECT},
+		{"java", syscall.SYS_PTRACE},
+	}
+	outputs := []bool{
+		true,
+		true,
+		true,
+		false,
+		false,
+		false,
+		false,
+		false,
+		false,
+		true,
+		true,
+		false,
+		false,
+		true,
+		true,
+		true,
+		false,
+		false,
+		false,
+	}
+
+	for i, in := range inputs {
+		p, err := getSeccompProfile(in.Profile)
+		if err != nil {
+			t.Errorf("error on test case #%v: %v", i, err)
+			continue
+		}
+		if containsSyscall(p, in.Syscall) != outputs[i] {
+			t.Errorf("error on test case #%v", i)
+		}
+	}
+}
+
+// 同じシステムコールが2回入っていると、フィルタが無駄に長くなる
+func TestSeccompProfilesUnique(t *testing.T) {
+	for name, p := range seccompProfiles {
+		seen := map[uintptr]bool{}
+		for _, nr := range p {
+			if seen[nr] {
+				t.Errorf("duplicated syscall %v in %v", nr, name)
+			}
+			seen[nr] = true
+		}
+	}
+}
+
+func TestNewSeccompFilter(t *testing.T) {
+	large := make([]uintptr, 255)
+	for i := range large {
+		large[i] = uintptr(i)
+	}
+
+	inputs := []struct {
+		Allowed []uintptr
+		Arch    uint32
+		Syscall uint32
+	}{
+		{[]uintptr{syscall.SYS_READ, syscall.SYS_WRITE}, auditArch, syscall.SYS_READ},
+		{[]uintptr{syscall.SYS_READ, syscall.SYS_WRITE}, auditArch, syscall.SYS_WRITE},
+		{[]uintptr{syscall.SYS_READ, syscall.SYS_WRITE}, auditArch, syscall.SYS_OPEN},
+		{[]uintptr{syscall.SYS_READ, syscall.SYS_WRITE}, auditArch + 1, syscall.SYS_READ},
+		{[]uintptr{}, auditArch, syscall.SYS_READ},
+		{large, auditArch, 0},
+		{large, auditArch, 254},
+		{large, auditArch, 255},
+		{append(large, 255), auditArch, 0},
+	}
+	outputs := []struct {
+		Ret uint32
+		Err error
+	}{
+		{seccompRetAllow, nil},
+		{seccompRetAllow, nil},
+		{seccompRetKillProcess, nil},
+		{seccompRetKillProcess, nil},
+		{seccompRetKillProcess, nil},
+		{seccompRetAllow, nil},
+		{seccompRetAllow, nil},
+		{seccompRetKillProcess, nil},
+		{0, errSeccompFilterTooLarge},
+	}
+
+	for i, in := range inputs {
+		filter, err := newSeccompFilter(in.Allowed)
+		if err != outputs[i].Err {
+			t.Errorf("error on test case #%v: %v", i, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if ret := runSeccompFilter(t, filter, in.Arch, in.Syscall); ret != outputs[i].Ret {
+			t.Errorf("error on test case #%v: %#x", i, ret)
+		}
+	}
+}
+
+// 言語ごとのフィルタが作れて、許可リストにあるものだけを許可する
+func TestSeccompProfileFilters(t *testing.T) {
+	for name, p := range seccompProfiles {
+		if p == nil {
+			continue
+		}
+		filter, err := newSeccompFilter(p)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		for _, nr := range p {
+			if ret := runSeccompFilter(t, filter, auditArch, uint32(nr)); ret != seccompRetAllow {
+				t.Errorf("%v: syscall %v is not allowed", name, nr)
+			}
+		}
+		if ret := runSeccompFilter(t, filter, auditArch, syscall.SYS_PTRACE); ret != seccompRetKillProcess {
+			t.Errorf("%v: ptrace is allowed", name)
+		}
+	}
+}
+
+func containsSyscall(list []uintptr, nr uintptr) bool {
+	for _, x := range list {
+		if x == nr {
+			return true
+		}
+	}
+	return false
+}
+
+// newSeccompFilterが使う命令だけを解釈して、フィルタが返す値を求める
+func runSeccompFilter(t *testing.T, filter []syscall.SockFilter, arch, nr uint32) uint32 {
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		f := filter[pc]
+		switch f.Code {
+		case bpfLd | bpfW | bpfAbs:
+			switch f.K {
+			case seccompDataNrOffset:
+				acc = nr
+			case seccompDataArchOffset:
+				acc = arch
+			default:
+				t.Fatalf("unknown offset %v", f.K)
+			}
+		case bpfJmp | bpfJeq | bpfK:
+			if acc == f.K {
+				pc += int(f.Jt)
+			} else {
+				pc += int(f.Jf)
+			}
+		case bpfRet | bpfK:
+			return f.K
+		default:
+			t.Fatalf("unknown instruction %#x", f.Code)
+		}
+	}
+	t.Fatal("filter does not return")
+	return 0
+}
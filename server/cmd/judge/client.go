@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/models"
+)
+
+const apiTimeout = 30 * time.Second
+
+// APIサーバーの /judge_node 以下を呼び出す
+type apiClient struct {
+	baseURL string
+	header  http.Header
+	client  *http.Client
+}
+
+func newAPIClient(baseURL, secret string) *apiClient {
+	h := http.Header{}
+	h.Set(models.JudgeNodeTokenHeader, secret)
+	return &apiClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		header:  h,
+		client:  &http.Client{Timeout: apiTimeout},
+	}
+}
+
+func (c *apiClient) url(path string) string {
+	return c.baseURL + path
+}
+
+// inがnilでなければJSONにして送り、outがnilでなければレスポンスを読み込む。
+// ステータスコードが2xxでも404でもなければエラーを返す
+func (c *apiClient) do(method, path string, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.url(path), body)
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		logger.AppLog.Errorf("api: %v %v: %+v", method, path, err)
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return res.StatusCode, nil
+	}
+	if res.StatusCode/100 != 2 {
+		return res.StatusCode, fmt.Errorf("api: %v %v: %v", method, path, res.Status)
+	}
+	if out != nil {
+		return res.StatusCode, json.NewDecoder(res.Body).Decode(out)
+	}
+	return res.StatusCode, nil
+}
+
+func (c *apiClient) FetchJudgeTask(submissionID uint) (*models.JudgeTask, error) {
+	task := &models.JudgeTask{}
+	status, err := c.do(http.MethodGet, fmt.Sprintf("/judge_node/submissions/%v", submissionID), nil, task)
+	if err != nil || status == http.StatusNotFound {
+		return nil, err
+	}
+	return task, nil
+}
+
+func (c *apiClient) SetJudging(submissionID uint) error {
+	return c.report(fmt.Sprintf("/judge_node/submissions/%v/status", submissionID), nil)
+}
+
+func (c *apiClient) SetCaseSetResult(submissionID uint, result *models.JudgeSetResult) error {
+	return c.report(fmt.Sprintf("/judge_node/submissions/%v/judge_set_results", submissionID), result)
+}
+
+func (c *apiClient) SetResult(submissionID uint, report *models.JudgementReport) error {
+	return c.report(fmt.Sprintf("/judge_node/submissions/%v/result", submissionID), report)
+}
+
+// 報告先が見つからないのは、ジャッジ中に提出が削除されたときなのでエラーにしない
+func (c *apiClient) report(path string, in interface{}) error {
+	status, err := c.do(http.MethodPut, path, in, nil)
+	if status == http.StatusNotFound {
+		logger.AppLog.Infof("api: %v is not found", path)
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/conf"
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/models"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/testdata"
+	"github.com/labstack/gommon/log"
+)
+
+// ジャッジノード。APIサーバーと同じRedisのキューからジャッジのジョブを取り出して、
+// 提出の情報とテストケースをAPIサーバーから取得してジャッジし、結果をAPIサーバーに報告する。
+// runnerを使うので、serverのディレクトリで実行すること。
+func main() {
+	l := log.New("judge")
+	logger.AppLog = l
+
+	if err := conf.LoadConfig(); err != nil {
+		os.Exit(1)
+	}
+	cfg := conf.GetConfig()
+	if cfg.Koneko.Debug {
+		l.SetLevel(log.DEBUG)
+	} else {
+		l.SetLevel(log.INFO)
+	}
+
+	client := newAPIClient(cfg.JudgeNode.APIURL, cfg.JudgeNode.Secret)
+	if err := initTestData(cfg, client); err != nil {
+		l.Fatal("Test Data Store Error", err.Error())
+	}
+
+	models.InitJudgeNode(client)
+	defer models.StopPool()
+	l.Info("judge node started")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+}
+
+// S3に保存しているときは直接取得して、そうでなければAPIサーバーから取得する
+func initTestData(cfg *conf.Config, client *apiClient) error {
+	if cfg.TestData.Store == testdata.StoreS3 {
+		return models.InitTestDataStore()
+	}
+
+	s, err := testdata.NewHTTPStore(client.url("/judge_node/test_data"), client.header, cfg.TestData.Dir)
+	if err != nil {
+		return err
+	}
+	testdata.SetStore(s)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/conf"
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/models"
+	"github.com/labstack/gommon/log"
+)
+
+// 起動時には行わない、元に戻せないDBのマイグレーションを実行する。
+// APIサーバーを一度起動して、起動時のマイグレーションを終わらせてから実行すること。
+func main() {
+	dropTestCaseColumns := flag.Bool("drop-test-case-columns", false,
+		"テストケースの内容をストアに移したあと、test_casesのinputとoutputのカラムを削除する (削除する前にtest_cases_legacy_dataにバックアップする)")
+	flag.Parse()
+
+	l := log.New("migrate")
+	logger.AppLog = l
+
+	if !*dropTestCaseColumns {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := conf.LoadConfig(); err != nil {
+		os.Exit(1)
+	}
+	models.InitDB()
+
+	if err := models.DropLegacyTestCaseColumns(); err != nil {
+		l.Fatal("Migration Error", err.Error())
+	}
+	l.Info("test_cases.input and test_cases.output were dropped")
+}
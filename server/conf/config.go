@@ -10,6 +10,8 @@ type Config struct {
 	SMTP      SMTPConfig      `toml:"SMTP"`
 	Judgement JudgementConfig `toml:"Judgement"`
 	Client    ClientConfig    `toml:"Client"`
+	TestData  TestDataConfig  `toml:"TestData"`
+	JudgeNode JudgeNodeConfig `toml:"JudgeNode"`
 }
 
 type KoneConfig struct {
@@ -32,6 +34,60 @@ type SMTPConfig struct {
 
 type JudgementConfig struct {
 	Concurrently int `toml:"concurrently"`
+	// 開催中のコンテストへの提出だけを実行するワーカーの数。0のときは1で、負のときは用意しない
+	ContestReserved int `toml:"contestReserved"`
+	// イメージごとに使い回すコンテナの数の上限。0のときは使い回さない
+	ContainerPoolSize int `toml:"containerPoolSize"`
+	// 1つの提出で同時に実行するテストケースの数。テストケースはそれぞれ別のCPUに固定される
+	Parallelism int `toml:"parallelism"`
+	// ジャッジに使うCPUの番号。空のときはすべてのCPUを使う
+	CPUs []int `toml:"cpus"`
+	// コンパイル済みの実行ファイルを保存するディレクトリ。空のときはキャッシュしない
+	CompileCacheDir string `toml:"compileCacheDir"`
+	// コンパイル済みの実行ファイルのキャッシュの大きさの上限 (MiB)
+	CompileCacheSize int64 `toml:"compileCacheSize"`
+	// "docker" (デフォルト) か "local"
+	Sandbox string `toml:"sandbox"`
+	// localのときに使う、イメージ名のディレクトリにそれぞれのイメージの中身を置いたディレクトリ
+	RootfsDir string `toml:"rootfsDir"`
+	// サンドボックスごとのcgroupを作成するcgroup v2のディレクトリ。どちらのサンドボックスでも必須
+	CgroupParent string `toml:"cgroupParent"`
+	// 提出の内容によらないエラーで失敗したときに、ジャッジを試行する回数の上限
+	MaxFails uint `toml:"maxFails"`
+	// コードテストを同時に実行する数の上限。0のときはデフォルトの値を使う
+	TestRunConcurrency int `toml:"testRunConcurrency"`
+	// 優先度のクラスごとのキューの設定
+	Contest  JudgeQueueConfig `toml:"contest"`
+	Practice JudgeQueueConfig `toml:"practice"`
+	Rejudge  JudgeQueueConfig `toml:"rejudge"`
+}
+
+type JudgeQueueConfig struct {
+	// キューから取り出す割合の重み (1以上100000以下)。0のときはデフォルトの値を使う
+	Weight uint `toml:"weight"`
+	// このクラスのジョブを同時に実行する数の上限。0のときはconcurrentlyまで実行する
+	Concurrency uint `toml:"concurrency"`
+}
+
+type TestDataConfig struct {
+	// "local" (デフォルト) か "s3"
+	Store string `toml:"store"`
+	// localのときは保存先、s3のときはダウンロードしたテストケースのキャッシュ
+	Dir        string `toml:"dir"`
+	S3Endpoint string `toml:"s3Endpoint"`
+	Bucket     string `toml:"bucket"`
+	Region     string `toml:"region"`
+	AccessKey  string `toml:"accessKey"`
+	SecretKey  string `toml:"secretKey"`
+}
+
+type JudgeNodeConfig struct {
+	// APIサーバーでジャッジせずに、ジャッジノードだけでジャッジする
+	RemoteOnly bool `toml:"remoteOnly"`
+	// ジャッジノードの認証に使う。空のときはジャッジノードからのリクエストをすべて拒否する
+	Secret string `toml:"secret"`
+	// ジャッジノードから見たAPIサーバーのURL
+	APIURL string `toml:"apiURL"`
 }
 
 type ClientConfig struct {
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/models"
+	"github.com/labstack/echo"
+)
+
+// プロキシに接続を切られないように、何も起きなくてもこの間隔でコメントを送る
+const eventHeartbeatInterval = 30 * time.Second
+
+// Redisにつながらないときは、購読が始まるのをこれだけ待ってから最初の状態を送る
+const eventSubscribeTimeout = 5 * time.Second
+
+// 提出のジャッジの途中経過をServer-Sent Eventsで送る。最初に今の状態を送る
+func GetSubmissionEvents(c echo.Context) error {
+	s := getSession(c)
+	if s == nil {
+		return echo.ErrUnauthorized
+	}
+
+	submission := getSubmissionFromContext(c)
+	if submission == nil || !submission.CanView(s) {
+		return echo.ErrNotFound
+	}
+
+	return streamEvents(c, models.SubmissionEventChannel(submission.ID), func() *models.JudgementEvent {
+		if latest := models.GetSubmission(submission.ID); latest != nil {
+			return models.NewSubmissionStatusEvent(latest)
+		}
+		return nil
+	})
+}
+
+// コンテストでの自分の提出すべての途中経過
+func GetContestSubmissionEvents(c echo.Context) error {
+	s, contest, err := getContestForEvents(c)
+	if err != nil {
+		return err
+	}
+
+	return streamEvents(c, models.ContestUserEventChannel(contest.ID, s.UserID), nil)
+}
+
+// 順位表が変わったことを知らせる。順位表そのものはGetStandingsで取得し直す
+func GetStandingsEvents(c echo.Context) error {
+	_, contest, err := getContestForEvents(c)
+	if err != nil {
+		return err
+	}
+
+	return streamEvents(c, models.StandingsEventChannel(contest.ID), nil)
+}
+
+func getContestForEvents(c echo.Context) (*models.UserSession, *models.Contest, error) {
+	s := getSession(c)
+	if s == nil {
+		return nil, nil, echo.ErrUnauthorized
+	}
+
+	contest := getContestFromContext(c)
+	if contest == nil {
+		return nil, nil, echo.ErrNotFound
+	}
+	can, err := contest.CanViewProblems(s)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return nil, nil, ErrInternalServer
+	}
+	if !can {
+		return nil, nil, echo.ErrNotFound
+	}
+	return s, contest, nil
+}
+
+// Redisが購読を始めたのを確認してからinitialを呼ぶので、最初の状態と届いたイベントの間で取りこぼさない。
+// 確認できないまま待ちきれなかったときは、その間のイベントを取りこぼすことがある
+func streamEvents(c echo.Context, channel string, initial func() *models.JudgementEvent) error {
+	events, ready, unsubscribe := models.SubscribeEvents(channel)
+	defer unsubscribe()
+
+	done := c.Request().Context().Done()
+	timer := time.NewTimer(eventSubscribeTimeout)
+	select {
+	case <-ready:
+	case <-timer.C:
+		logger.AppLog.Errorf("event subscription is not confirmed: %v", channel)
+	case <-done:
+		timer.Stop()
+		return nil
+	}
+	timer.Stop()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	// nginxにバッファリングさせない
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	if initial != nil {
+		if e := initial(); e != nil {
+			data, err := json.Marshal(e)
+			if err != nil {
+				logger.AppLog.Error(err)
+				return nil
+			}
+			fmt.Fprintf(res, "data: %s\n\n", data)
+		}
+	}
+	res.Flush()
+
+	t := time.NewTicker(eventHeartbeatInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case data := <-events:
+			if _, err := fmt.Fprintf(res, "data: %s\n\n", data); err != nil {
+				return nil
+			}
+		case <-t.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/ProgrammingLab/koneko-online-judge/server/models"
 	"github.com/gocraft/work"
@@ -13,6 +14,11 @@ type scheduledJobsResponse struct {
 	ScheduledJobs []*work.ScheduledJob `json:"scheduled_jobs"`
 }
 
+type deadJobsResponse struct {
+	Total    int64           `json:"total"`
+	DeadJobs []*work.DeadJob `json:"dead_jobs"`
+}
+
 func GetWorkerStatus(c echo.Context) error {
 	s, err := getAdminSession(c)
 	if err != nil {
@@ -29,3 +35,62 @@ func GetWorkerStatus(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, q)
 }
+
+func GetDeadJobs(c echo.Context) error {
+	s, err := getAdminSession(c)
+	if err != nil {
+		return ErrInternalServer
+	}
+	if s == nil {
+		return echo.ErrNotFound
+	}
+
+	page, err := strconv.Atoi(models.DefaultString(c.QueryParam("page"), "1"))
+	if err != nil || page < 1 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{"invalid page"})
+	}
+
+	jobs, total, err := models.GetDeadJobs(uint(page))
+	if err != nil {
+		return ErrInternalServer
+	}
+
+	return c.JSON(http.StatusOK, deadJobsResponse{total, jobs})
+}
+
+func RetryDeadJob(c echo.Context) error {
+	s, err := getAdminSession(c)
+	if err != nil {
+		return ErrInternalServer
+	}
+	if s == nil {
+		return echo.ErrNotFound
+	}
+
+	diedAt, err := strconv.ParseInt(c.Param("diedAt"), 10, 64)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+
+	if err := models.RetryDeadJob(diedAt, c.Param("jobID")); err != nil {
+		return ErrInternalServer
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func RetryAllDeadJobs(c echo.Context) error {
+	s, err := getAdminSession(c)
+	if err != nil {
+		return ErrInternalServer
+	}
+	if s == nil {
+		return echo.ErrNotFound
+	}
+
+	if err := models.RetryAllDeadJobs(); err != nil {
+		return ErrInternalServer
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,101 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/conf"
+	"github.com/ProgrammingLab/koneko-online-judge/server/models"
+	"github.com/labstack/echo"
+)
+
+// ジャッジノードからのリクエストだけを通す
+func CheckJudgeNode(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		secret := conf.GetConfig().JudgeNode.Secret
+		token := c.Request().Header.Get(models.JudgeNodeTokenHeader)
+		if secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(token)) != 1 {
+			return echo.ErrNotFound
+		}
+		return next(c)
+	}
+}
+
+func getSubmissionIDFromContext(c echo.Context) (uint, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	return uint(id), err
+}
+
+func GetJudgeTask(c echo.Context) error {
+	id, err := getSubmissionIDFromContext(c)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+
+	task := models.GetJudgeTask(id)
+	if task == nil {
+		return echo.ErrNotFound
+	}
+	return c.JSON(http.StatusOK, task)
+}
+
+func SetJudging(c echo.Context) error {
+	id, err := getSubmissionIDFromContext(c)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+
+	return judgeReportResponse(c, models.DBReporter.SetJudging(id))
+}
+
+func SetJudgeSetResult(c echo.Context) error {
+	id, err := getSubmissionIDFromContext(c)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+
+	result := &models.JudgeSetResult{}
+	if err := c.Bind(result); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+	}
+	return judgeReportResponse(c, models.DBReporter.SetCaseSetResult(id, result))
+}
+
+func SetJudgementResult(c echo.Context) error {
+	id, err := getSubmissionIDFromContext(c)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+
+	report := &models.JudgementReport{}
+	if err := c.Bind(report); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+	}
+	return judgeReportResponse(c, models.DBReporter.SetResult(id, report))
+}
+
+func judgeReportResponse(c echo.Context, err error) error {
+	switch err {
+	case nil:
+		return c.NoContent(http.StatusNoContent)
+	case models.ErrSubmissionNotFound, models.ErrJudgeSetResultNotFound:
+		return echo.ErrNotFound
+	default:
+		return ErrInternalServer
+	}
+}
+
+func GetTestData(c echo.Context) error {
+	r, size, err := models.OpenTestData(c.Param("hash"))
+	if err != nil {
+		return ErrInternalServer
+	}
+	if r == nil {
+		return echo.ErrNotFound
+	}
+	defer r.Close()
+
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(size, 10))
+	return c.Stream(http.StatusOK, echo.MIMEOctetStream, r)
+}
@@ -9,6 +9,11 @@ import (
 	"github.com/labstack/echo"
 )
 
+type rejudgeResponse struct {
+	// キャンセルするときに使うリジャッジのまとまりのID
+	BatchID string `json:"batchID"`
+}
+
 func NewProblem(c echo.Context) error {
 	s := getSession(c)
 	if s == nil {
@@ -25,6 +30,9 @@ func NewProblem(c echo.Context) error {
 	if problem.JudgeType != models.JudgeTypeNormal && problem.JudgementConfig == nil {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{"judgementConfig is required"})
 	}
+	if problem.OutputOnly && problem.JudgeType == models.JudgeTypeInteractive {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{"interactive problems cannot be output-only"})
+	}
 
 	s.FetchUser()
 	problem.ID = 0
@@ -62,6 +70,9 @@ func UpdateProblem(c echo.Context) error {
 	if err := c.Validate(request); err != nil {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
 	}
+	if request.OutputOnly && request.JudgeType == models.JudgeTypeInteractive {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{"interactive problems cannot be output-only"})
+	}
 	request.WriterID = 0
 	request.Writer = models.User{}
 
@@ -179,6 +190,35 @@ func SetTestCasePoint(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+func UpdateCaseSets(c echo.Context) error {
+	s := getSession(c)
+	problem := getProblemFromContext(c)
+	if problem == nil || !problem.CanEdit(s) {
+		return echo.ErrNotFound
+	}
+
+	requests := make([]models.CaseSet, 0)
+	if err := c.Bind(&requests); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+	}
+	for i := range requests {
+		if err := c.Validate(&requests[i]); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+		}
+		if requests[i].Point < 0 {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{"点数は0以上である必要があります"})
+		}
+	}
+
+	if err := models.UpdateCaseSets(problem, requests); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+	}
+
+	problem.FetchCaseSets()
+
+	return c.JSON(http.StatusOK, problem.CaseSets)
+}
+
 func RejudgeProblem(c echo.Context) error {
 	s := getSession(c)
 	if s == nil {
@@ -194,7 +234,57 @@ func RejudgeProblem(c echo.Context) error {
 		return echo.ErrForbidden
 	}
 
-	if err := p.Rejudge(); err != nil {
+	batchID, err := p.Rejudge()
+	if err != nil {
+		return ErrInternalServer
+	}
+
+	return c.JSON(http.StatusAccepted, rejudgeResponse{batchID})
+}
+
+// 問題へのリジャッジを止めて、ジャッジが終わっていない提出をすべてキャンセルする
+func CancelProblemJudgements(c echo.Context) error {
+	s := getSession(c)
+	if s == nil {
+		return echo.ErrUnauthorized
+	}
+
+	p := getProblemFromContext(c)
+	if p == nil {
+		return echo.ErrNotFound
+	}
+
+	if !p.CanEdit(s) {
+		return echo.ErrForbidden
+	}
+
+	if err := p.CancelJudgements(); err != nil {
+		return ErrInternalServer
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func CancelRejudge(c echo.Context) error {
+	s := getSession(c)
+	if s == nil {
+		return echo.ErrUnauthorized
+	}
+
+	p := getProblemFromContext(c)
+	if p == nil {
+		return echo.ErrNotFound
+	}
+
+	if !p.CanEdit(s) {
+		return echo.ErrForbidden
+	}
+
+	err := p.CancelRejudge(c.Param("batchID"))
+	if err == models.ErrRejudgeBatchNotFound {
+		return echo.ErrNotFound
+	}
+	if err != nil {
 		return ErrInternalServer
 	}
 
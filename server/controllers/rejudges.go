@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/models"
+	"github.com/labstack/echo"
+)
+
+// 条件に合う提出をまとめてリジャッジする。
+// 問題かコンテストを指定したときはそれを編集できる人が、指定しないときは管理者だけがリジャッジできる
+func RejudgeSubmissions(c echo.Context) error {
+	s := getSession(c)
+	if s == nil {
+		return echo.ErrUnauthorized
+	}
+
+	filter := &models.RejudgeFilter{}
+	if err := c.Bind(filter); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+	}
+
+	switch {
+	case filter.ProblemID != 0:
+		p := models.GetProblem(filter.ProblemID)
+		if p == nil {
+			return echo.ErrNotFound
+		}
+		if !p.CanEdit(s) {
+			return echo.ErrForbidden
+		}
+	case filter.ContestID != 0:
+		contest := models.GetContest(filter.ContestID)
+		if contest == nil {
+			return echo.ErrNotFound
+		}
+		if !contest.CanEdit(s) {
+			return echo.ErrForbidden
+		}
+	default:
+		if _, err := getAdminSession(c); err != nil {
+			return err
+		}
+	}
+
+	submissions, err := filter.FindSubmissions()
+	if err != nil {
+		return ErrInternalServer
+	}
+	if len(submissions) == 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{"条件に合う提出がありません"})
+	}
+
+	batchID, err := models.RejudgeSubmissions(submissions)
+	if err != nil {
+		return ErrInternalServer
+	}
+
+	return c.JSON(http.StatusAccepted, rejudgeResponse{batchID})
+}
+
+func CancelRejudgeBatch(c echo.Context) error {
+	s := getSession(c)
+	if s == nil {
+		return echo.ErrUnauthorized
+	}
+
+	err := models.CancelRejudgeBatch(c.Param("batchID"), s)
+	if err == models.ErrRejudgeBatchNotFound {
+		return echo.ErrNotFound
+	}
+	if err != nil {
+		return ErrInternalServer
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
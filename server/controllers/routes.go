@@ -19,12 +19,23 @@ func Routes(e *echo.Echo) {
 	e.GET("/problems/:id", GetProblem)
 	e.POST("/problems/:id/cases/upload", UpdateCases)
 	e.PUT("/problems/:id/cases", SetTestCasePoint)
+	e.PUT("/problems/:id/case_sets", UpdateCaseSets)
 	e.POST("/problems/:id/rejudge", RejudgeProblem)
+	e.POST("/problems/:id/rejudge/:batchID/cancel", CancelRejudge)
+	e.POST("/problems/:id/cancel", CancelProblemJudgements)
 
 	e.POST("/problems/:id/submissions", Submit)
 	e.GET("/problems/:id/submissions", GetSubmissions)
+	e.POST("/problems/:id/test_runs", NewProblemTestRun)
+	e.POST("/test_runs", NewTestRun)
 
+	e.GET("/submissions", GetSubmissionFeed)
 	e.GET("/submissions/:id", GetSubmission)
+	e.GET("/submissions/:id/events", GetSubmissionEvents)
+	e.POST("/submissions/:id/cancel", CancelSubmission)
+	e.POST("/submissions/:id/rejudge", RejudgeSubmission)
+	e.POST("/rejudges", RejudgeSubmissions)
+	e.POST("/rejudges/:batchID/cancel", CancelRejudgeBatch)
 
 	e.GET("/languages", GetLanguages)
 
@@ -34,7 +45,9 @@ func Routes(e *echo.Echo) {
 	e.PUT("/contests/:contestID", UpdateContest)
 	e.POST("/contests/:contestID/enter", EnterContest)
 	e.GET("/contests/:contestID/standings", GetStandings)
+	e.GET("/contests/:contestID/standings/events", GetStandingsEvents)
 	e.GET("/contests/:contestID/submissions", GetContestSubmissions)
+	e.GET("/contests/:contestID/submissions/events", GetContestSubmissionEvents)
 	e.GET("/contests/:contestID/statuses", GetContestJudgeStatuses)
 
 	e.POST("/contests/:contestID/problems/new", NewContestProblem)
@@ -53,4 +66,14 @@ func Routes(e *echo.Echo) {
 	e.POST("/registrations/:token", RegisterUser)
 
 	e.GET("/workers", GetWorkerStatus)
+	e.GET("/dead_jobs", GetDeadJobs)
+	e.POST("/dead_jobs/retry", RetryAllDeadJobs)
+	e.POST("/dead_jobs/:diedAt/:jobID/retry", RetryDeadJob)
+
+	node := e.Group("/judge_node", CheckJudgeNode)
+	node.GET("/submissions/:id", GetJudgeTask)
+	node.PUT("/submissions/:id/status", SetJudging)
+	node.PUT("/submissions/:id/judge_set_results", SetJudgeSetResult)
+	node.PUT("/submissions/:id/result", SetJudgementResult)
+	node.GET("/test_data/:hash", GetTestData)
 }
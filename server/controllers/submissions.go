@@ -3,6 +3,7 @@ package controllers
 import (
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/ProgrammingLab/koneko-online-judge/server/models"
 	"github.com/labstack/echo"
@@ -11,6 +12,8 @@ import (
 type submissionRequest struct {
 	LanguageID uint   `json:"languageID"`
 	SourceCode string `json:"sourceCode"`
+	// 出力だけを提出する問題のときの、出力ファイルを並べたzip (base64)
+	Outputs []byte `json:"outputs"`
 }
 
 func Submit(c echo.Context) error {
@@ -25,20 +28,29 @@ func Submit(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
 	}
 
-	lang := models.GetLanguage(request.LanguageID)
-	if lang == nil {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{"使用できない言語です"})
-	}
-
 	submission := &models.Submission{
 		UserID:     s.UserID,
 		ProblemID:  problem.ID,
-		LanguageID: lang.ID,
 		SourceCode: request.SourceCode,
 		ContestID:  problem.ContestID,
 	}
+	// 出力だけを提出する問題では、コンパイルも実行もしないので言語は指定しない
+	if !problem.OutputOnly {
+		lang := models.GetLanguage(request.LanguageID)
+		if lang == nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{"使用できない言語です"})
+		}
+		submission.LanguageID = &lang.ID
+	}
 
-	if err := models.Submit(submission); err != nil {
+	if problem.OutputOnly {
+		if len(request.Outputs) == 0 {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{"outputs is required"})
+		}
+		if err := models.SubmitOutputs(submission, request.Outputs); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+		}
+	} else if err := models.Submit(submission); err != nil {
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{err.Error()})
 	}
 
@@ -61,6 +73,83 @@ func GetSubmissions(c echo.Context) error {
 	return c.JSON(http.StatusOK, problem.Submissions)
 }
 
+type submissionFeedResponse struct {
+	Submissions []models.Submission `json:"submissions"`
+	// 次のページを取得するときにbeforeに指定する。次のページがなければ0
+	NextCursor uint `json:"nextCursor"`
+}
+
+// すべての問題への提出を新しい順に返す。見られない提出は含めない
+func GetSubmissionFeed(c echo.Context) error {
+	s := getSession(c)
+	q := &models.SubmissionFeedQuery{Limit: 25}
+
+	ids := []struct {
+		name string
+		out  *uint
+	}{
+		{"userID", &q.UserID},
+		{"problemID", &q.ProblemID},
+		{"languageID", &q.LanguageID},
+		{"before", &q.Before},
+	}
+	for _, id := range ids {
+		v := c.QueryParam(id.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+		}
+		*id.out = uint(n)
+	}
+
+	queryStatus := c.QueryParam("status")
+	if n, err := strconv.Atoi(queryStatus); err == nil {
+		status := models.JudgementStatus(n)
+		q.Status = &status
+	} else if queryStatus != "" && err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+	}
+
+	times := []struct {
+		name string
+		out  **time.Time
+	}{
+		{"since", &q.Since},
+		{"until", &q.Until},
+	}
+	for _, t := range times {
+		v := c.QueryParam(t.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+		}
+		*t.out = &parsed
+	}
+
+	queryLimit := c.QueryParam("limit")
+	if n, err := strconv.Atoi(queryLimit); err == nil {
+		q.Limit = n
+		if q.Limit <= 0 || models.MaxSubmissionFeedLimit < q.Limit {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{"limit must be 0 < limit <= 100"})
+		}
+	} else if queryLimit != "" && err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+	}
+
+	submissions, next, err := models.GetSubmissionFeed(s, q)
+	if err != nil {
+		return ErrInternalServer
+	}
+
+	return c.JSON(http.StatusOK, submissionFeedResponse{submissions, next})
+}
+
 func GetSubmission(c echo.Context) error {
 	submission := getSubmissionFromContext(c)
 	if submission == nil {
@@ -84,17 +173,82 @@ func GetSubmission(c echo.Context) error {
 	default:
 		return c.JSON(http.StatusBadRequest, ErrorResponse{"cases"})
 	}
+	if !submission.CanViewErrorLogs(s) {
+		submission.HideErrorLogs()
+	}
 
 	return c.JSON(http.StatusOK, submission)
 }
 
+// 提出者本人による取り下げか、問題を編集できる人によるジャッジの中止
+func CancelSubmission(c echo.Context) error {
+	s := getSession(c)
+	if s == nil {
+		return echo.ErrUnauthorized
+	}
+
+	submission := getSubmissionFromContext(c)
+	if submission == nil || !submission.CanView(s) {
+		return echo.ErrNotFound
+	}
+	if !submission.CanCancel(s) {
+		return echo.ErrForbidden
+	}
+
+	err := submission.Cancel()
+	if err == models.ErrNotCancellable {
+		return c.JSON(http.StatusConflict, ErrorResponse{"ジャッジが終わった提出はキャンセルできません"})
+	}
+	if err != nil {
+		return ErrInternalServer
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func RejudgeSubmission(c echo.Context) error {
+	s := getSession(c)
+	if s == nil {
+		return echo.ErrUnauthorized
+	}
+
+	submission := getSubmissionFromContext(c)
+	if submission == nil || !submission.CanView(s) {
+		return echo.ErrNotFound
+	}
+	if !submission.Problem.CanEdit(s) {
+		return echo.ErrForbidden
+	}
+
+	err := submission.Rejudge()
+	if err == models.ErrAlreadyInQueue {
+		return c.JSON(http.StatusConflict, ErrorResponse{"ジャッジが終わっていない提出はリジャッジできません"})
+	}
+	if err != nil {
+		return ErrInternalServer
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 提出者と問題を編集できる人以外には、コンパイラの出力と標準エラー出力を隠す。
+// コンテスト中はテストケースごとのフィードバックも隠す
 func fetchSubmission(out *models.Submission, s *models.UserSession) {
+	// fetchProblemで問題のコンテストを隠す前に確かめる
+	canViewErrorLogs := out.CanViewErrorLogs(s)
 	out.FetchUser()
 	out.User.Email = ""
 	fetchProblem(&out.Problem, s)
 	out.Problem.ContestID = new(uint)
-	out.FetchJudgeSetResultsDeeply(true)
+	if s != nil {
+		out.FetchJudgeSetResultsDeeplyForContest(s)
+	} else {
+		out.FetchJudgeSetResultsDeeply(true)
+	}
 	out.FetchLanguage()
+	if !canViewErrorLogs {
+		out.HideErrorLogs()
+	}
 }
 
 func getSubmissionFromContext(c echo.Context) *models.Submission {
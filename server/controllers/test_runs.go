@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/models"
+	"github.com/labstack/echo"
+)
+
+// 問題の実行時間とメモリの制限で、提出せずに実行してみる
+func NewProblemTestRun(c echo.Context) error {
+	s := getSession(c)
+	problem := getProblemFromContext(c)
+	if problem == nil || s == nil || !problem.CanView(s) {
+		return echo.ErrNotFound
+	}
+	if problem.OutputOnly {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{"出力だけを提出する問題ではコードテストを実行できません"})
+	}
+
+	return runTest(c, problem)
+}
+
+// 問題によらないデフォルトの制限で実行する
+func NewTestRun(c echo.Context) error {
+	if getSession(c) == nil {
+		return echo.ErrUnauthorized
+	}
+
+	return runTest(c, nil)
+}
+
+func runTest(c echo.Context, problem *models.Problem) error {
+	request := &models.TestRun{}
+	if err := c.Bind(request); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+	}
+
+	lang := models.GetLanguage(request.LanguageID)
+	if lang == nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{"使用できない言語です"})
+	}
+
+	res, err := request.Run(lang, problem)
+	switch err {
+	case nil:
+		return c.JSON(http.StatusOK, res)
+	case models.ErrTestRunInputLimit:
+		return c.JSON(http.StatusBadRequest, ErrorResponse{err.Error()})
+	case models.ErrTestRunBusy:
+		return c.JSON(http.StatusTooManyRequests, ErrorResponse{"コードテストが混み合っています。しばらくしてから実行してください"})
+	case models.ErrTestRunUnavailable:
+		return c.JSON(http.StatusServiceUnavailable, ErrorResponse{err.Error()})
+	default:
+		return ErrInternalServer
+	}
+}
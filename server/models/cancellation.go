@@ -0,0 +1,363 @@
+package models
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/unique"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// ジャッジのキャンセルはRedisのフラグで伝える。ジャッジノードもキューと同じRedisを見ている
+const (
+	// キャンセルのフラグやリジャッジのまとまりを覚えておく時間 (秒)
+	cancellationTTL = 24 * 60 * 60
+	// 実行中のジャッジがキャンセルされていないか確かめる間隔
+	cancellationPollInterval = time.Second
+	rejudgeBatchIDLength     = 24
+)
+
+var (
+	ErrNotCancellable       = errors.New("submission is not in queue or judging")
+	ErrRejudgeBatchNotFound = errors.New("rejudge batch not found")
+)
+
+func cancelledKey(submissionID uint) string {
+	return redisNamespace + ":cancelled:" + strconv.FormatUint(uint64(submissionID), 10)
+}
+
+// リジャッジのまとまりに含まれる提出のIDの集合
+func rejudgeBatchKey(batchID string) string {
+	return redisNamespace + ":rejudge_batch:" + batchID
+}
+
+func rejudgeBatchCancelledKey(batchID string) string {
+	return redisNamespace + ":rejudge_batch_cancelled:" + batchID
+}
+
+// 問題ごとの、提出をキューに入れている途中のリジャッジのまとまりのIDの集合
+func activeRejudgeBatchesKey(problemID uint) string {
+	return redisNamespace + ":rejudge_batches:" + strconv.FormatUint(uint64(problemID), 10)
+}
+
+func isCancelled(submissionID uint) bool {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	ok, err := redis.Bool(conn.Do("EXISTS", cancelledKey(submissionID)))
+	if err != nil {
+		logger.AppLog.Errorf("redis error: %+v", err)
+		return false
+	}
+	return ok
+}
+
+// もう一度ジャッジするときは、前のキャンセルのフラグを消す
+func clearCancelled(submissionID uint) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", cancelledKey(submissionID))
+	if err != nil {
+		logger.AppLog.Errorf("redis error: %+v", err)
+	}
+	return err
+}
+
+func markCancelled(submissionIDs []uint) error {
+	if len(submissionIDs) == 0 {
+		return nil
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	for _, id := range submissionIDs {
+		conn.Send("SET", cancelledKey(id), 1, "EX", cancellationTTL)
+	}
+	if _, err := conn.Do(""); err != nil {
+		logger.AppLog.Errorf("redis error: %+v", err)
+		return err
+	}
+	return nil
+}
+
+// キューに入っているかジャッジ中の提出だけをキャンセル済みにする。
+// 実行中のジャッジはフラグを見てコンテナを止め、結果をキャンセル済みにする
+func cancelSubmissions(submissions []Submission) error {
+	pending := make([]Submission, 0, len(submissions))
+	ids := make([]uint, 0, len(submissions))
+	for _, s := range submissions {
+		if s.IsPending() {
+			pending = append(pending, s)
+			ids = append(ids, s.ID)
+		}
+	}
+	if err := markCancelled(ids); err != nil {
+		return err
+	}
+
+	for i := range pending {
+		// 読み込んでから終わったジャッジは、そのままにしておく
+		if err := pending[i].setCancelled(); err != nil && err != ErrNotCancellable {
+			return err
+		}
+	}
+	return nil
+}
+
+// キューに入っているかジャッジ中のときだけ、DBの上で条件を確かめてキャンセル済みにする。
+// 読み込んだ後にジャッジが終わっていたら、結果を上書きせずにErrNotCancellableを返す
+func (s *Submission) setCancelled() error {
+	pending := []JudgementStatus{StatusInQueue, StatusJudging}
+	res := db.Model(Submission{}).
+		Where("id = ? AND status IN (?)", s.ID, pending).
+		Update("status", StatusCancelled)
+	if res.Error != nil {
+		logger.AppLog.Errorf("error: %+v", res.Error)
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotCancellable
+	}
+	s.Status = StatusCancelled
+	if err := s.onStatusUpdated(); err != nil {
+		return err
+	}
+
+	var sets []uint
+	err := db.Model(JudgeSetResult{}).Where("submission_id = ?", s.ID).Pluck("id", &sets).Error
+	if err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+		return err
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+
+	err = db.Model(JudgeResult{}).
+		Where("judge_set_result_id IN (?) AND status IN (?)", sets, pending).
+		Update("status", StatusCancelled).Error
+	if err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+		return err
+	}
+
+	err = db.Model(JudgeSetResult{}).
+		Where("submission_id = ? AND status IN (?)", s.ID, pending).
+		Update("status", StatusCancelled).Error
+	if err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+	}
+	return err
+}
+
+func (s *Submission) IsPending() bool {
+	return s.Status == StatusInQueue || s.Status == StatusJudging
+}
+
+// 提出者本人は取り下げとして、問題を編集できる人はジャッジを止めるためにキャンセルできる
+func (s *Submission) CanCancel(session *UserSession) bool {
+	if s.UserID == session.UserID {
+		return true
+	}
+	s.FetchProblem()
+	return s.Problem.CanEdit(session)
+}
+
+func (s *Submission) Cancel() error {
+	if !s.IsPending() {
+		return ErrNotCancellable
+	}
+	if err := markCancelled([]uint{s.ID}); err != nil {
+		return err
+	}
+	return s.setCancelled()
+}
+
+// 問題へのキューに入れている途中のリジャッジを止めて、終わっていない提出をすべてキャンセルする
+func (p *Problem) CancelJudgements() error {
+	conn := redisPool.Get()
+	batches, err := redis.Strings(conn.Do("SMEMBERS", activeRejudgeBatchesKey(p.ID)))
+	conn.Close()
+	if err != nil {
+		logger.AppLog.Errorf("redis error: %+v", err)
+		return err
+	}
+	for _, b := range batches {
+		if err := setRejudgeBatchCancelled(b); err != nil {
+			return err
+		}
+	}
+
+	submissions := make([]Submission, 0)
+	err = db.Where("problem_id = ? AND status IN (?)", p.ID, []JudgementStatus{StatusInQueue, StatusJudging}).Find(&submissions).Error
+	if err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+		return err
+	}
+	return cancelSubmissions(submissions)
+}
+
+// リジャッジのまとまりのうち、その問題のまだ終わっていない提出をキャンセルする
+func (p *Problem) CancelRejudge(batchID string) error {
+	conn := redisPool.Get()
+	active, err := redis.Bool(conn.Do("SISMEMBER", activeRejudgeBatchesKey(p.ID), batchID))
+	conn.Close()
+	if err != nil {
+		logger.AppLog.Errorf("redis error: %+v", err)
+		return err
+	}
+	ids, err := getRejudgeBatchSubmissionIDs(batchID)
+	if err != nil {
+		return err
+	}
+
+	submissions := make([]Submission, 0)
+	if len(ids) != 0 {
+		err = db.Where("problem_id = ? AND id IN (?)", p.ID, ids).Find(&submissions).Error
+		if err != nil {
+			logger.AppLog.Errorf("error: %+v", err)
+			return err
+		}
+	}
+	if !active && len(submissions) == 0 {
+		return ErrRejudgeBatchNotFound
+	}
+
+	if err := setRejudgeBatchCancelled(batchID); err != nil {
+		return err
+	}
+	return cancelSubmissions(submissions)
+}
+
+// 条件を指定したリジャッジのまとまりをキャンセルする。
+// まとまりに含まれる提出の問題をすべて編集できなければErrRejudgeBatchNotFoundを返す
+func CancelRejudgeBatch(batchID string, session *UserSession) error {
+	ids, err := getRejudgeBatchSubmissionIDs(batchID)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return ErrRejudgeBatchNotFound
+	}
+
+	submissions := make([]Submission, 0)
+	if err := db.Where("id IN (?)", ids).Find(&submissions).Error; err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+		return err
+	}
+	editable := make(map[uint]bool)
+	for _, s := range submissions {
+		can, ok := editable[s.ProblemID]
+		if !ok {
+			p := GetProblem(s.ProblemID)
+			can = p != nil && p.CanEdit(session)
+			editable[s.ProblemID] = can
+		}
+		if !can {
+			return ErrRejudgeBatchNotFound
+		}
+	}
+
+	if err := setRejudgeBatchCancelled(batchID); err != nil {
+		return err
+	}
+	return cancelSubmissions(submissions)
+}
+
+func getRejudgeBatchSubmissionIDs(batchID string) ([]uint, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("SMEMBERS", rejudgeBatchKey(batchID)))
+	if err != nil {
+		logger.AppLog.Errorf("redis error: %+v", err)
+		return nil, err
+	}
+	ids := make([]uint, 0, len(values))
+	for _, v := range values {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+// リジャッジする提出の問題ごとに、問題へのキャンセルで止められるようにする
+func newRejudgeBatch(problemIDs []uint) (string, error) {
+	id, err := unique.GenerateRandomBase62String(rejudgeBatchIDLength)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return "", err
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	for _, p := range problemIDs {
+		key := activeRejudgeBatchesKey(p)
+		conn.Send("SADD", key, id)
+		conn.Send("EXPIRE", key, cancellationTTL)
+	}
+	if _, err := conn.Do(""); err != nil {
+		logger.AppLog.Errorf("redis error: %+v", err)
+		return "", err
+	}
+	return id, nil
+}
+
+// キューに入れた提出をリジャッジのまとまりに記録する
+func addToRejudgeBatch(batchID string, submissionID uint) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	key := rejudgeBatchKey(batchID)
+	conn.Send("SADD", key, submissionID)
+	conn.Send("EXPIRE", key, cancellationTTL)
+	if _, err := conn.Do(""); err != nil {
+		logger.AppLog.Errorf("redis error: %+v", err)
+		return err
+	}
+	return nil
+}
+
+// すべてキューに入れ終わったら、問題へのキャンセルで止める対象から外す
+func finishRejudgeBatch(batchID string, problemIDs []uint) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	for _, p := range problemIDs {
+		conn.Send("SREM", activeRejudgeBatchesKey(p), batchID)
+	}
+	if _, err := conn.Do(""); err != nil {
+		logger.AppLog.Errorf("redis error: %+v", err)
+	}
+}
+
+func setRejudgeBatchCancelled(batchID string) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", rejudgeBatchCancelledKey(batchID), 1, "EX", cancellationTTL)
+	if err != nil {
+		logger.AppLog.Errorf("redis error: %+v", err)
+	}
+	return err
+}
+
+func isRejudgeBatchCancelled(batchID string) bool {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	ok, err := redis.Bool(conn.Do("EXISTS", rejudgeBatchCancelledKey(batchID)))
+	if err != nil {
+		logger.AppLog.Errorf("redis error: %+v", err)
+		return false
+	}
+	return ok
+}
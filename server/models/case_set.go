@@ -20,6 +20,28 @@ type CaseSet struct {
 	ProblemID uint       `gorm:"not null" json:"problemID"`
 	Point     int        `gorm:"not null; default:'0'" json:"point"`
 	TestCases []TestCase `json:"-"`
+	// 点数の付け方
+	ScoringPolicy ScoringPolicy `gorm:"not null; default:'0'" json:"scoringPolicy" validate:"max=2,min=0"`
+	// このケースセットの点数が入るために正解している必要があるケースセットのID
+	Dependencies []uint `gorm:"-" json:"dependencies"`
+}
+
+type ScoringPolicy int
+
+const (
+	// すべてのテストケースに正解したときだけ点数が入る
+	ScoringPolicyAllOrNothing ScoringPolicy = 0
+	// 正解したテストケースの数に比例した点数が入る
+	ScoringPolicyProportional ScoringPolicy = 1
+	// テストケースごとのチェッカーの点数の最小値の割合で点数が入る
+	ScoringPolicyMinScore ScoringPolicy = 2
+)
+
+// IOI形式の小課題の依存関係
+type CaseSetDependency struct {
+	ID           uint `gorm:"primary_key"`
+	CaseSetID    uint `gorm:"not null; index"`
+	DependencyID uint `gorm:"not null"`
 }
 
 const (
@@ -30,6 +52,8 @@ const (
 var (
 	ErrNilArgument                         = errors.New("nil argument(s)")
 	ErrInvalidFileNameOrDirectoryStructure = errors.New("ファイルの命名かディレクトリの構造が正しくありません。")
+	ErrInvalidCaseSetDependency            = errors.New("依存できるのは同じ問題のより前のケースセットだけです。")
+	ErrCaseSetCountMismatch                = errors.New("ケースセットの数が一致しません。")
 
 	inputFileRegex  = regexp.MustCompile(inputFilePrefix + `(\d+)-(\d+)\.txt`)
 	outputFileRegex = regexp.MustCompile(outputFilePrefix + `(\d+)-(\d+)\.txt`)
@@ -123,11 +147,75 @@ func (s *CaseSet) UpdatePoint(point int) {
 	db.Model(s).Update("point", point)
 }
 
+func (s *CaseSet) FetchDependencies() {
+	deps := make([]CaseSetDependency, 0)
+	db.Where("case_set_id = ?", s.ID).Order("dependency_id ASC").Find(&deps)
+
+	s.Dependencies = make([]uint, 0, len(deps))
+	for _, d := range deps {
+		s.Dependencies = append(s.Dependencies, d.DependencyID)
+	}
+}
+
+// 点数、点数の付け方、依存関係をまとめて更新する。
+// setsはproblemのケースセットと同じ順番で並んでいること。
+func UpdateCaseSets(problem *Problem, sets []CaseSet) error {
+	problem.FetchCaseSets()
+	if len(sets) != len(problem.CaseSets) {
+		return ErrCaseSetCountMismatch
+	}
+
+	// 循環しないように、依存できるのはより前のケースセットだけにする
+	index := make(map[uint]int, len(problem.CaseSets))
+	for i, s := range problem.CaseSets {
+		index[s.ID] = i
+	}
+	for i, s := range sets {
+		for _, d := range s.Dependencies {
+			j, ok := index[d]
+			if !ok || i <= j {
+				return ErrInvalidCaseSetDependency
+			}
+		}
+	}
+
+	tx := db.Begin()
+	for i, s := range sets {
+		id := problem.CaseSets[i].ID
+		err := tx.Model(CaseSet{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"point":          s.Point,
+			"scoring_policy": s.ScoringPolicy,
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Delete(CaseSetDependency{}, "case_set_id = ?", id).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, d := range s.Dependencies {
+			if err := tx.Create(&CaseSetDependency{CaseSetID: id, DependencyID: d}).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+func deleteCaseSetDependencies(id uint) {
+	db.Delete(CaseSetDependency{}, "case_set_id = ? OR dependency_id = ?", id, id)
+}
+
 func (s *CaseSet) Delete() {
 	s.FetchTestCases()
 	for _, c := range s.TestCases {
 		c.Delete()
 	}
+	deleteCaseSetDependencies(s.ID)
 
 	db.Delete(CaseSet{}, "id = ?", s.ID)
 }
@@ -138,6 +226,7 @@ func (s *CaseSet) DeletePermanently() {
 	for _, c := range cases {
 		c.DeletePermanently()
 	}
+	deleteCaseSetDependencies(s.ID)
 
 	db.Unscoped().Delete(CaseSet{}, "id = ?", s.ID)
 }
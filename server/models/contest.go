@@ -318,6 +318,11 @@ func (c *Contest) GetSubmissions(session *UserSession, limit, page int, userID,
 	}
 	res = res[start:end]
 	fetchSubmissionFieldsWithCache(res)
+	for i := range res {
+		if !res[i].CanViewErrorLogs(session) {
+			res[i].HideErrorLogs()
+		}
+	}
 
 	return res, total, nil
 }
@@ -9,6 +9,7 @@ import (
 
 	"github.com/ProgrammingLab/koneko-online-judge/server/conf"
 	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/testdata"
 	"github.com/ProgrammingLab/koneko-online-judge/server/modules/unique"
 )
 
@@ -32,11 +33,57 @@ func InitDB() {
 	logger.AppLog.Info("DB Connected")
 	db.LogMode(cfg.Debug)
 
+	if err := InitTestDataStore(); err != nil {
+		logger.AppLog.Fatal("Test Data Store Error", err.Error())
+		panic(err)
+	}
+
 	createTables()
+	if err := migrateTestCaseData(); err != nil {
+		logger.AppLog.Fatal("Test Case Migration Error", err.Error())
+		panic(err)
+	}
+	if err := migrateSubmittedOutputData(); err != nil {
+		logger.AppLog.Fatal("Submitted Output Migration Error", err.Error())
+		panic(err)
+	}
 	seedLanguages()
 	insertAdmin()
 }
 
+// 出力だけを提出する問題への提出には言語がないので、language_idをNULLにできるようにする。
+// AutoMigrateはNOT NULLを外さないので、まだNOT NULLのときだけ変更する
+func makeSubmissionLanguageNullable() {
+	var nullable string
+	row := db.Raw("SELECT is_nullable FROM information_schema.columns " +
+		"WHERE table_schema = DATABASE() AND table_name = 'submissions' AND column_name = 'language_id'").Row()
+	if err := row.Scan(&nullable); err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+		return
+	}
+	if nullable == "NO" {
+		db.Exec("ALTER TABLE submissions MODIFY language_id int unsigned NULL")
+	}
+}
+
+// ストアに移す前のinputとoutputのカラムが残っているときは、新しく作るテストケースでは値を入れないのでNULLを許可する
+func makeLegacyTestCaseColumnsNullable() {
+	if !db.Dialect().HasColumn("test_cases", "input") {
+		return
+	}
+
+	var nullable string
+	row := db.Raw("SELECT is_nullable FROM information_schema.columns " +
+		"WHERE table_schema = DATABASE() AND table_name = 'test_cases' AND column_name = 'input'").Row()
+	if err := row.Scan(&nullable); err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+		return
+	}
+	if nullable == "NO" {
+		db.Exec("ALTER TABLE test_cases MODIFY input longtext NULL, MODIFY output longtext NULL")
+	}
+}
+
 func connectDB(driver, spec string) error {
 	// model.dbに代入したいので。
 	var err error
@@ -44,6 +91,18 @@ func connectDB(driver, spec string) error {
 	return err
 }
 
+func InitTestDataStore() error {
+	cfg := conf.GetConfig().TestData
+	s3 := testdata.S3Config{
+		Endpoint:  cfg.S3Endpoint,
+		Bucket:    cfg.Bucket,
+		Region:    cfg.Region,
+		AccessKey: cfg.AccessKey,
+		SecretKey: cfg.SecretKey,
+	}
+	return testdata.Init(cfg.Store, cfg.Dir, s3)
+}
+
 func utf8mb4() *gorm.DB {
 	return db.Set("gorm:table_options", "CHARACTER SET utf8mb4")
 }
@@ -66,10 +125,15 @@ func createTables() {
 	utf8mb4().AutoMigrate(&CaseSet{})
 	db.Model(&CaseSet{}).AddForeignKey("problem_id", "problems(id)", "RESTRICT", "RESTRICT")
 	utf8mb4().AutoMigrate(&TestCase{})
+	makeLegacyTestCaseColumnsNullable()
 	db.Model(&TestCase{}).AddForeignKey("case_set_id", "case_sets(id)", "RESTRICT", "RESTRICT")
+	utf8mb4().AutoMigrate(&CaseSetDependency{})
+	db.Model(&CaseSetDependency{}).AddForeignKey("case_set_id", "case_sets(id)", "CASCADE", "CASCADE")
+	db.Model(&CaseSetDependency{}).AddForeignKey("dependency_id", "case_sets(id)", "CASCADE", "CASCADE")
 
 	utf8mb4().AutoMigrate(&Language{})
 	utf8mb4().AutoMigrate(&Submission{})
+	makeSubmissionLanguageNullable()
 	db.Model(&Submission{}).AddForeignKey("user_id", "users(id)", "RESTRICT", "RESTRICT")
 	db.Model(&Submission{}).AddForeignKey("language_id", "languages(id)", "RESTRICT", "RESTRICT")
 	db.Model(&Submission{}).AddForeignKey("problem_id", "problems(id)", "RESTRICT", "RESTRICT")
@@ -83,6 +147,9 @@ func createTables() {
 	db.Model(&JudgeSetResult{}).AddForeignKey("case_set_id", "case_sets(id)", "RESTRICT", "RESTRICT")
 	db.Model(&JudgeResult{}).AddForeignKey("judge_set_result_id", "judge_set_results(id)", "RESTRICT", "RESTRICT")
 	db.Model(&JudgeResult{}).AddForeignKey("test_case_id", "test_cases(id)", "RESTRICT", "RESTRICT")
+	utf8mb4().AutoMigrate(&SubmittedOutput{})
+	db.Model(&SubmittedOutput{}).AddForeignKey("submission_id", "submissions(id)", "RESTRICT", "RESTRICT")
+	db.Model(&SubmittedOutput{}).AddForeignKey("test_case_id", "test_cases(id)", "RESTRICT", "RESTRICT")
 
 	utf8mb4().AutoMigrate(&Contest{})
 	db.Model(&Problem{}).AddForeignKey("contest_id", "contests(id)", "RESTRICT", "RESTRICT")
@@ -124,6 +191,7 @@ func seedLanguages() {
 			ExeFileName:    "main.o",
 			CompileCommand: "g++ -w -lm -std=gnu++17 -O2 -o main.o main.cpp",
 			ExecCommand:    "./main.o",
+			SeccompProfile: "c",
 		},
 		{
 			ImageName:      "cpp",
@@ -132,6 +200,7 @@ func seedLanguages() {
 			ExeFileName:    "main.o",
 			CompileCommand: "g++ -w -lm -std=gnu++11 -O2 -o main.o main.cpp",
 			ExecCommand:    "./main.o",
+			SeccompProfile: "c",
 		},
 		{
 			ImageName:      "cpp",
@@ -140,6 +209,7 @@ func seedLanguages() {
 			ExeFileName:    "main.o",
 			CompileCommand: "gcc -w -lm -std=gnu11 -O2 -o main.o main.c",
 			ExecCommand:    "./main.o",
+			SeccompProfile: "c",
 		},
 		{
 			ImageName:      "cpp",
@@ -148,6 +218,7 @@ func seedLanguages() {
 			ExeFileName:    "main.o",
 			CompileCommand: "g++ -w -lm -std=gnu++2a -O2 -o main.o main.cpp",
 			ExecCommand:    "./main.o",
+			SeccompProfile: "c",
 		},
 		{
 			ImageName:      "python3",
@@ -156,6 +227,7 @@ func seedLanguages() {
 			ExeFileName:    "main.py",
 			CompileCommand: "cp tmp.py main.py",
 			ExecCommand:    "python3 main.py",
+			SeccompProfile: "python",
 		},
 		{
 			ImageName:      "openjdk",
@@ -164,11 +236,14 @@ func seedLanguages() {
 			ExeFileName:    "main.jar",
 			CompileCommand: "/usr/local/openjdk-11/bin/javac -d classes Main.java && /usr/local/openjdk-11/bin/jar --create --file main.jar --main-class Main -C classes .",
 			ExecCommand:    "/usr/local/openjdk-11/bin/java -XX:+UseContainerSupport -jar main.jar",
+			SeccompProfile: "java",
 		},
 	}
 
 	for _, l := range languages {
 		db.Save(l)
+		// seccompのプロファイルが追加される前からある言語にも設定する
+		db.Model(Language{}).Where("display_name = ? AND seccomp_profile = ''", l.DisplayName).Update("seccomp_profile", l.SeccompProfile)
 	}
 }
 
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/testdata"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
+	"golang.org/x/net/context"
+)
+
+const interactorDir = "interactor"
+
+type interactiveEvaluator struct {
+	interactor *compiledProgram
+	simple     *simpleEvaluator
+	config     *JudgementConfig
+}
+
+func newInteractiveEvaluator(config *JudgementConfig) (*interactiveEvaluator, error) {
+	compiled, compileRes := compile(*config.JudgeSourceCode, config.Language, true)
+	if compiled == nil || compileRes == nil {
+		return nil, ErrTransientJudgement
+	}
+	if compileRes.Status != workers.StatusFinished {
+		return nil, ErrJudgeSourceCodeCompile{compileRes.Stderr}
+	}
+
+	e := &interactiveEvaluator{
+		interactor: compiled,
+		simple:     newSimpleEvaluator(),
+		config:     config,
+	}
+	return e, nil
+}
+
+func (e *interactiveEvaluator) next(set *CaseSet, factory func(set *CaseSet) caseSetEvaluator) caseSetEvaluator {
+	if factory != nil {
+		return e.simple.next(set, factory)
+	}
+
+	f := func(set *CaseSet) caseSetEvaluator {
+		return newInteractiveCaseSetEvaluator(set)
+	}
+	return e.simple.next(set, f)
+}
+
+func (e *interactiveEvaluator) evaluate() (JudgementStatus, int) {
+	return e.simple.evaluate()
+}
+
+func (e *interactiveEvaluator) remove() {}
+
+func (e *interactiveEvaluator) command() []string {
+	return e.config.Language.GetExecCommandSlice()
+}
+
+// インタラクタは提出されたプログラムの応答を待つので、実時間の制限は提出されたプログラムより長くする
+func (e *interactiveEvaluator) wallTimeLimit(problem *Problem) time.Duration {
+	return problem.GetWallTimeLimit() + compileTimeLimit
+}
+
+// 提出されたプログラムのworkerとは別に、インタラクタの言語のイメージでインタラクタを動かすworkerを作る。
+// テストケースはpeerと同じ順番で書き込むので、resultsはpeerに入力を書き込んだあとのものを渡すこと
+func (e *interactiveEvaluator) newWorker(peer *workers.Worker, results []JudgeResult, problem *Problem) (*workers.Worker, error) {
+	if err := peer.CreateInteractionPipes(len(results)); err != nil {
+		return nil, err
+	}
+
+	w, err := workers.NewInteractorWorker(imageNamePrefix+e.config.Language.ImageName, compileTimeLimit, e.wallTimeLimit(problem), compileMemoryLimit, peer, e.command())
+	if err != nil {
+		logger.AppLog.Errorf("exec: interactor container create error %+v", err)
+		return nil, err
+	}
+	if err := e.prepare(w, results); err != nil {
+		w.Remove()
+		return nil, err
+	}
+	return w, nil
+}
+
+// 提出されたプログラムとインタラクタを同時に実行する
+func (e *interactiveEvaluator) run(ctx context.Context, w, interactor *workers.Worker, problem *Problem) error {
+	return workers.RunInteraction(ctx, w, interactor, e.wallTimeLimit(problem)+compileTimeLimit)
+}
+
+func (e *interactiveEvaluator) prepare(w *workers.Worker, results []JudgeResult) error {
+	dir := w.HostJudgeDataDir + "/" + interactorDir
+	if err := os.Mkdir(dir, 0700); err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+	if err := writeFile(dir+"/"+e.config.Language.ExeFileName, string(e.interactor.exe), 0755); err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+
+	inputDir := w.HostJudgeDataDir + "/input"
+	answerDir := w.HostJudgeDataDir + "/answer"
+	for _, d := range []string{inputDir, answerDir} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			logger.AppLog.Error(err)
+			return err
+		}
+	}
+	for i, r := range results {
+		name := "/" + strconv.Itoa(i)
+		if err := testdata.Copy(r.TestCase.InputHash, inputDir+name); err != nil {
+			logger.AppLog.Error(err)
+			return err
+		}
+		if err := testdata.Copy(r.TestCase.OutputHash, answerDir+name); err != nil {
+			logger.AppLog.Error(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// インタラクタの実行結果を、同じテストケースの提出されたプログラムの実行結果に付ける
+func attachInteractorResults(execResults []*workers.ExecResult, interactor *workers.Worker) error {
+	p, err := workers.NewExecResultParser(interactor)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+	for i := range execResults {
+		_, res, err := p.Next()
+		if err != nil {
+			logger.AppLog.Error(err)
+			return err
+		}
+		if res == nil {
+			return ErrParseOutput
+		}
+		if execResults[i] != nil {
+			execResults[i].Interactor = res
+		}
+	}
+	return nil
+}
+
+type interactiveCaseSetEvaluator struct {
+	point    int
+	setPoint int
+	statuses map[JudgementStatus]int
+	// 直前のテストケースの点数 (0以上1以下)
+	lastScore float64
+}
+
+func newInteractiveCaseSetEvaluator(set *CaseSet) *interactiveCaseSetEvaluator {
+	return &interactiveCaseSetEvaluator{
+		setPoint: set.Point,
+		statuses: map[JudgementStatus]int{},
+	}
+}
+
+func (e *interactiveCaseSetEvaluator) next(res *workers.ExecResult, testCase *TestCase) (JudgementStatus, int) {
+	e.lastScore = 0
+	st, pt := func() (JudgementStatus, int) {
+		if res == nil || res.Interactor == nil {
+			return StatusUnknownError, 0
+		}
+
+		// インタラクタが先に終了すると提出されたプログラムが異常終了することがあるので、
+		// 実行時エラーよりもインタラクタの判定を優先する
+		switch res.Status {
+		case workers.StatusFinished, workers.StatusRuntimeError:
+		default:
+			return toJudgementStatus(res.Status), 0
+		}
+		switch res.Interactor.Status {
+		case workers.StatusFinished:
+		case workers.StatusRuntimeError:
+			return StatusWrongAnswer, 0
+		default:
+			// インタラクタ自体がTLEやMLEになったときはジャッジの失敗
+			logger.AppLog.Errorf("interactor failed: %+v", res.Interactor)
+			return StatusUnknownError, 0
+		}
+		if res.Status != workers.StatusFinished {
+			return toJudgementStatus(res.Status), 0
+		}
+
+		point, _ := strconv.Atoi(strings.TrimSpace(res.Interactor.Stdout))
+		e.point += point
+		e.lastScore = toCaseScore(point, e.setPoint)
+		return StatusAccepted, point
+	}()
+
+	e.statuses[st]++
+	return st, pt
+}
+
+func (e *interactiveCaseSetEvaluator) evaluate() (JudgementStatus, int) {
+	st := evaluateStatuses(e.statuses)
+	if st == StatusAccepted {
+		return st, MinInt(e.point, e.setPoint)
+	}
+	return st, 0
+}
+
+func (e *interactiveCaseSetEvaluator) caseScore() float64 {
+	return e.lastScore
+}
@@ -3,6 +3,8 @@ package models
 import (
 	"github.com/ProgrammingLab/koneko-online-judge/server/conf"
 	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/artifacts"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
 	"github.com/gocraft/work"
 	"github.com/gomodule/redigo/redis"
 )
@@ -13,8 +15,46 @@ const (
 	redisNamespace      = "koneko_online_judge"
 	submissionJobArgKey = "submission_id"
 	judgementJobName    = "judgement"
+	// ジョブの名前ごとに別のキューになる
+	contestJudgementJobName = "judgement_contest"
+	rejudgeJobName          = "judgement_rejudge"
 )
 
+// ジャッジのキューの優先度のクラス
+type judgePriority int
+
+const (
+	// 開催中のコンテストへの提出
+	priorityContest judgePriority = iota
+	// コンテスト外や、終わったコンテストへの提出
+	priorityPractice
+	// 問題ごとなどにまとめてリジャッジするとき
+	priorityRejudge
+)
+
+// 設定されていないときの、キューから取り出す割合の重み。
+// gocraft/workは重みに比例する確率でキューを選ぶので、開催中のコンテストのキューをほぼ必ず先に見るが、確実ではない。
+// リジャッジがすべてのワーカーを使っていても待たせないように、コンテスト専用のワーカーを別に用意する
+var defaultJudgePriorityWeights = map[judgePriority]uint{
+	priorityContest:  100000,
+	priorityPractice: 100,
+	priorityRejudge:  1,
+}
+
+const (
+	// 設定されていないときの、ジャッジを試行する回数の上限
+	defaultJudgeMaxFails = 4
+	// 再試行するまでの時間 (秒)。失敗するたびに倍にする
+	judgeBackoffBase = 10
+	judgeBackoffMax  = 10 * 60
+)
+
+var judgementJobNames = map[judgePriority]string{
+	priorityContest:  contestJudgementJobName,
+	priorityPractice: judgementJobName,
+	priorityRejudge:  rejudgeJobName,
+}
+
 var (
 	redisPool = &redis.Pool{
 		MaxActive: 3,
@@ -25,20 +65,119 @@ var (
 			return redis.Dial("tcp", cfg.RedisHost)
 		},
 	}
-	enqueuer     = work.NewEnqueuer(redisNamespace, redisPool)
-	workerPool   *work.WorkerPool
-	workerClient = work.NewClient(redisNamespace, redisPool)
+	enqueuer   = work.NewEnqueuer(redisNamespace, redisPool)
+	workerPool *work.WorkerPool
+	// 開催中のコンテストへの提出だけを取り出すワーカー
+	contestWorkerPool *work.WorkerPool
+	workerClient      = work.NewClient(redisNamespace, redisPool)
+	// ジャッジノードとして動いているときだけ設定される
+	nodeClient JudgeNodeClient
 )
 
 func InitJobs() {
+	if conf.GetConfig().JudgeNode.RemoteOnly {
+		logger.AppLog.Info("judgement is delegated to judge nodes")
+		return
+	}
+	initTestRuns()
+	startWorkers()
+}
+
+// DBにはつながずに、APIサーバーから提出の情報を取得してジャッジする
+func InitJudgeNode(client JudgeNodeClient) {
+	nodeClient = client
+	startWorkers()
+}
+
+func startWorkers() {
 	cfg := conf.GetConfig().Judgement
+	// 設定が間違ったままDockerで実行し始めないように、サンドボックスを用意できなければ起動しない
+	if err := workers.InitSandbox(cfg.Sandbox, cfg.RootfsDir, cfg.CgroupParent); err != nil {
+		logger.AppLog.Fatal("Sandbox Error", err.Error())
+		panic(err)
+	}
+	workers.InitCPUs(cfg.CPUs)
+	if err := artifacts.Init(cfg.CompileCacheDir, cfg.CompileCacheSize*1024*1024); err != nil {
+		logger.AppLog.Errorf("compile cache error: %+v", err)
+	}
+	if err := workers.InitPool(cfg.ContainerPoolSize); err != nil {
+		logger.AppLog.Errorf("container pool error: %+v", err)
+	}
 	workerPool = work.NewWorkerPool(jobContext{}, uint(cfg.Concurrently), redisNamespace, redisPool)
-	workerPool.Job(judgementJobName, (*jobContext).Judge)
+	for p, name := range judgementJobNames {
+		workerPool.JobWithOptions(name, judgeJobOptions(p), (*jobContext).Judge)
+	}
 	workerPool.Start()
+
+	if n := contestReservedWorkers(); 0 < n {
+		contestWorkerPool = work.NewWorkerPool(jobContext{}, n, redisNamespace, redisPool)
+		contestWorkerPool.JobWithOptions(contestJudgementJobName, judgeJobOptions(priorityContest), (*jobContext).Judge)
+		contestWorkerPool.Start()
+	}
+}
+
+func contestReservedWorkers() uint {
+	n := conf.GetConfig().Judgement.ContestReserved
+	if n == 0 {
+		return 1
+	}
+	if n < 0 {
+		return 0
+	}
+	return uint(n)
+}
+
+func judgeJobOptions(p judgePriority) work.JobOptions {
+	var q conf.JudgeQueueConfig
+	cfg := conf.GetConfig().Judgement
+	switch p {
+	case priorityContest:
+		q = cfg.Contest
+	case priorityPractice:
+		q = cfg.Practice
+	case priorityRejudge:
+		q = cfg.Rejudge
+	}
+
+	opts := work.JobOptions{
+		Priority:       q.Weight,
+		MaxConcurrency: q.Concurrency,
+		MaxFails:       judgeMaxFails(),
+		Backoff:        judgeBackoff,
+	}
+	if opts.Priority == 0 {
+		opts.Priority = defaultJudgePriorityWeights[p]
+	}
+	return opts
+}
+
+func judgeMaxFails() uint {
+	if n := conf.GetConfig().Judgement.MaxFails; 0 < n {
+		return n
+	}
+	return defaultJudgeMaxFails
+}
+
+func judgeBackoff(job *work.Job) int64 {
+	n := job.Fails
+	if n < 1 {
+		n = 1
+	}
+	if 10 < n {
+		n = 10
+	}
+	return MinLong(judgeBackoffBase<<uint(n-1), judgeBackoffMax)
 }
 
 func StopPool() {
+	if workerPool == nil {
+		return
+	}
 	workerPool.Stop()
+	if contestWorkerPool != nil {
+		contestWorkerPool.Stop()
+	}
+	workers.StopPool()
 }
 
 func GetWorkers() ([]*work.WorkerObservation, error) {
@@ -49,17 +188,64 @@ func GetWorkers() ([]*work.WorkerObservation, error) {
 	return w, err
 }
 
+// 再試行しても失敗したジョブ。pageは1から始まる
+func GetDeadJobs(page uint) ([]*work.DeadJob, int64, error) {
+	jobs, count, err := workerClient.DeadJobs(page)
+	if err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+	}
+	return jobs, count, err
+}
+
+// 失敗したジョブをキューに戻す
+func RetryDeadJob(diedAt int64, jobID string) error {
+	err := workerClient.RetryDeadJob(diedAt, jobID)
+	if err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+	}
+	return err
+}
+
+func RetryAllDeadJobs() error {
+	err := workerClient.RetryAllDeadJobs()
+	if err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+	}
+	return err
+}
+
 func (c *jobContext) Judge(job *work.Job) error {
 	id := job.ArgInt64(submissionJobArgKey)
 	if err := job.ArgError(); err != nil {
 		return err
 	}
 
+	// これが最後の試行のときは、失敗したら結果をUnknownErrorにする
+	lastAttempt := judgeMaxFails() <= uint(job.Fails)+1
 	judge := judgementJob{
 		submissionID: uint(id),
+		reporter:     DBReporter,
 	}
-	defer judge.Close()
-	judge.Run()
-
-	return nil
+	if nodeClient != nil {
+		task, err := nodeClient.FetchJudgeTask(uint(id))
+		if err != nil {
+			// ジョブを失敗させて、あとで再試行させる。最後の試行ならジャッジ中のまま残らないようにする
+			logger.AppLog.Errorf("judge task error: %+v", err)
+			if lastAttempt {
+				if err := nodeClient.SetResult(uint(id), &JudgementReport{Status: StatusUnknownError}); err != nil {
+					logger.AppLog.Errorf("report error: %+v", err)
+				}
+			}
+			return err
+		}
+		if task == nil {
+			logger.AppLog.Infof("submission(id = %v) is deleted", id)
+			return nil
+		}
+		judge.submission = task.submission()
+		judge.outputHashes = task.OutputHashes
+		judge.reporter = nodeClient
+	}
+	// エラーを返すとgocraft/workが再試行して、上限に達したらdeadのジョブになる
+	return judge.Run(lastAttempt)
 }
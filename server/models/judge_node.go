@@ -0,0 +1,359 @@
+package models
+
+import (
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/pkg/errors"
+)
+
+// ジャッジノードがAPIサーバーに認証してもらうためのヘッダー
+const JudgeNodeTokenHeader = "X-Judge-Node-Token"
+
+var (
+	ErrSubmissionNotFound     = errors.New("submission not found")
+	ErrJudgeSetResultNotFound = errors.New("judge set result not found")
+)
+
+// ジャッジの途中経過と結果の書き込み先。
+// APIサーバーの中でジャッジするときはDBに、ジャッジノードではAPIサーバーに書き込む
+type JudgementReporter interface {
+	SetJudging(submissionID uint) error
+	// ケースセットとそのテストケースの結果
+	SetCaseSetResult(submissionID uint, result *JudgeSetResult) error
+	SetResult(submissionID uint, report *JudgementReport) error
+}
+
+// ジャッジノードがAPIサーバーとやり取りするためのクライアント
+type JudgeNodeClient interface {
+	JudgementReporter
+	// 提出が削除されていればnilを返す
+	FetchJudgeTask(submissionID uint) (*JudgeTask, error)
+}
+
+// 提出全体の結果
+type JudgementReport struct {
+	Status      JudgementStatus `json:"status"`
+	Point       int             `json:"point"`
+	ExecTime    time.Duration   `json:"execTime"`
+	MemoryUsage int64           `json:"memoryUsage"`
+	// コンパイルエラーのときのコンパイラの出力
+	ErrorLog string `json:"errorLog"`
+	// コンテストの得点に反映するか。最後まで評価できなかったときはfalse
+	Scored bool `json:"scored"`
+}
+
+// ジャッジノードに渡す、1つの提出をジャッジするのに必要な情報。
+// ジャッジノードはDBにつながないので、モデルのJSONでは隠しているものも含める
+type JudgeTask struct {
+	SubmissionID    uint               `json:"submissionID"`
+	SourceCode      string             `json:"sourceCode"`
+	Language        JudgeTaskLanguage  `json:"language"`
+	TimeLimit       time.Duration      `json:"timeLimit"`
+	WallTimeLimit   time.Duration      `json:"wallTimeLimit"`
+	MemoryLimit     int                `json:"memoryLimit"`
+	JudgeType       JudgeType          `json:"judgeType"`
+	OutputOnly      bool               `json:"outputOnly"`
+	JudgementConfig *JudgementConfig   `json:"judgementConfig"`
+	CheckerLanguage *JudgeTaskLanguage `json:"checkerLanguage"`
+	CaseSets        []JudgeTaskCaseSet `json:"caseSets"`
+	// 出力だけを提出する問題のときの、テストケースのIDごとの提出された出力のハッシュ。
+	// 内容はテストケースと同じく、ジャッジノードのストアがAPIサーバーから取得する
+	OutputHashes map[uint]string `json:"outputHashes,omitempty"`
+}
+
+type JudgeTaskLanguage struct {
+	ImageName      string `json:"imageName"`
+	FileName       string `json:"fileName"`
+	ExeFileName    string `json:"exeFileName"`
+	CompileCommand string `json:"compileCommand"`
+	ExecCommand    string `json:"execCommand"`
+	SeccompProfile string `json:"seccompProfile"`
+}
+
+type JudgeTaskCaseSet struct {
+	// JudgeSetResultのID
+	ResultID uint            `json:"resultID"`
+	CaseSet  CaseSet         `json:"caseSet"`
+	Cases    []JudgeTaskCase `json:"cases"`
+}
+
+// テストケースの内容はハッシュでtestdataのストアから取得する
+type JudgeTaskCase struct {
+	// JudgeResultのID
+	ResultID   uint   `json:"resultID"`
+	TestCaseID uint   `json:"testCaseID"`
+	InputHash  string `json:"inputHash"`
+	OutputHash string `json:"outputHash"`
+}
+
+// APIサーバーの中でジャッジするときと、ジャッジノードからの報告を受け取ったときに使う
+var DBReporter JudgementReporter = dbReporter{}
+
+type dbReporter struct{}
+
+func (dbReporter) SetJudging(submissionID uint) error {
+	s := GetSubmission(submissionID)
+	if s == nil {
+		return ErrSubmissionNotFound
+	}
+	return s.SetStatus(StatusJudging)
+}
+
+// 報告された結果のうち、その提出のケースセットとテストケースのものだけを書き込む
+func (dbReporter) SetCaseSetResult(submissionID uint, result *JudgeSetResult) error {
+	set := &JudgeSetResult{}
+	nf := db.Where("id = ? AND submission_id = ?", result.ID, submissionID).First(set).RecordNotFound()
+	if nf {
+		return ErrJudgeSetResultNotFound
+	}
+	set.FetchJudgeResults(false)
+
+	reported := make(map[uint]*JudgeResult, len(result.JudgeResults))
+	for i := range result.JudgeResults {
+		reported[result.JudgeResults[i].ID] = &result.JudgeResults[i]
+	}
+
+	tx := db.Begin()
+	for _, r := range set.JudgeResults {
+		rep, ok := reported[r.ID]
+		if !ok {
+			continue
+		}
+		query := map[string]interface{}{
+			"status":       rep.Status,
+			"exec_time":    rep.ExecTime,
+			"wall_time":    rep.WallTime,
+			"memory_usage": rep.MemoryUsage,
+			"feedback":     rep.Feedback,
+			"stderr":       rep.Stderr,
+		}
+		if err := tx.Model(&JudgeResult{ID: r.ID}).Updates(query).Error; err != nil {
+			logger.AppLog.Errorf("error: %+v", err)
+			tx.Rollback()
+			return err
+		}
+	}
+
+	query := map[string]interface{}{
+		"point":        result.Point,
+		"status":       result.Status,
+		"exec_time":    result.ExecTime,
+		"memory_usage": result.MemoryUsage,
+	}
+	if err := tx.Model(&JudgeSetResult{ID: set.ID}).Updates(query).Error; err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+		return err
+	}
+
+	set.Point = result.Point
+	set.Status = result.Status
+	set.ExecTime = result.ExecTime
+	set.MemoryUsage = result.MemoryUsage
+	for i := range set.JudgeResults {
+		r := &set.JudgeResults[i]
+		if rep, ok := reported[r.ID]; ok {
+			r.Status = rep.Status
+			r.ExecTime = rep.ExecTime
+			r.WallTime = rep.WallTime
+			r.MemoryUsage = rep.MemoryUsage
+			r.Feedback = rep.Feedback
+			r.Stderr = rep.Stderr
+		}
+	}
+	if s := GetSubmission(submissionID); s != nil {
+		publishCaseSetEvent(s, set)
+	}
+	return nil
+}
+
+func (dbReporter) SetResult(submissionID uint, report *JudgementReport) error {
+	s := GetSubmission(submissionID)
+	if s == nil {
+		return ErrSubmissionNotFound
+	}
+
+	s.Point = report.Point
+	s.Status = report.Status
+	s.ExecTime = report.ExecTime
+	s.MemoryUsage = report.MemoryUsage
+	s.ErrorLog = truncateString(report.ErrorLog, errorLogLimit)
+	query := map[string]interface{}{
+		"point":        s.Point,
+		"status":       s.Status,
+		"exec_time":    s.ExecTime,
+		"memory_usage": s.MemoryUsage,
+		"error_log":    s.ErrorLog,
+	}
+	// キャンセルや再ジャッジで状態が変わったあとに、古いジャッジの結果で上書きしないようにする
+	pending := []JudgementStatus{StatusInQueue, StatusJudging}
+	res := db.Model(Submission{}).Where("id = ? AND status IN (?)", s.ID, pending).Updates(query)
+	if res.Error != nil {
+		logger.AppLog.Errorf("error: %+v", res.Error)
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		logger.AppLog.Infof("submission(id = %v) is no longer judged, the result is discarded", s.ID)
+		return nil
+	}
+
+	s.FetchProblem()
+	if err := onUpdateJudgementStatuses(s.Problem.ContestID, *s); err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+	}
+	publishSubmissionEvent(s, newSubmissionEvent(EventResult, s))
+	if !report.Scored || s.Problem.ContestID == nil {
+		return nil
+	}
+	return updateScore(s.UserID, s.ProblemID, *s.Problem.ContestID)
+}
+
+// ジャッジに必要なものをすべて読み込む。出力だけを提出する問題のときは提出された出力のハッシュも返す
+func loadJudgedSubmission(submissionID uint) (*Submission, map[uint]string) {
+	s := GetSubmission(submissionID)
+	if s == nil {
+		return nil, nil
+	}
+	s.FetchLanguage()
+	s.FetchProblem()
+	s.Problem.FetchJudgementConfig()
+	s.Problem.JudgementConfig.FetchLanguage()
+	s.FetchJudgeSetResults(false)
+	for i := range s.JudgeSetResults {
+		r := &s.JudgeSetResults[i]
+		r.FetchCaseSet()
+		r.FetchJudgeResults(false)
+		for k := range r.JudgeResults {
+			r.JudgeResults[k].FetchTestCase()
+		}
+	}
+
+	var outputHashes map[uint]string
+	if s.Problem.OutputOnly {
+		outputHashes = getSubmittedOutputHashes(s.ID)
+	}
+	return s, outputHashes
+}
+
+// 提出が削除されていればnilを返す
+func GetJudgeTask(submissionID uint) *JudgeTask {
+	s, outputHashes := loadJudgedSubmission(submissionID)
+	if s == nil {
+		return nil
+	}
+
+	p := &s.Problem
+	t := &JudgeTask{
+		SubmissionID:    s.ID,
+		SourceCode:      s.SourceCode,
+		Language:        newJudgeTaskLanguage(&s.Language),
+		TimeLimit:       p.TimeLimit,
+		WallTimeLimit:   p.GetWallTimeLimit(),
+		MemoryLimit:     p.MemoryLimit,
+		JudgeType:       p.JudgeType,
+		OutputOnly:      p.OutputOnly,
+		JudgementConfig: p.JudgementConfig,
+		CaseSets:        make([]JudgeTaskCaseSet, len(s.JudgeSetResults)),
+		OutputHashes:    outputHashes,
+	}
+	if l := p.JudgementConfig.Language; l != nil {
+		tl := newJudgeTaskLanguage(l)
+		t.CheckerLanguage = &tl
+	}
+
+	for i, r := range s.JudgeSetResults {
+		set := JudgeTaskCaseSet{
+			ResultID: r.ID,
+			CaseSet:  r.CaseSet,
+			Cases:    make([]JudgeTaskCase, len(r.JudgeResults)),
+		}
+		for k, c := range r.JudgeResults {
+			set.Cases[k] = JudgeTaskCase{
+				ResultID:   c.ID,
+				TestCaseID: c.TestCaseID,
+				InputHash:  c.TestCase.InputHash,
+				OutputHash: c.TestCase.OutputHash,
+			}
+		}
+		t.CaseSets[i] = set
+	}
+	return t
+}
+
+func newJudgeTaskLanguage(l *Language) JudgeTaskLanguage {
+	return JudgeTaskLanguage{
+		ImageName:      l.ImageName,
+		FileName:       l.FileName,
+		ExeFileName:    l.ExeFileName,
+		CompileCommand: l.CompileCommand,
+		ExecCommand:    l.ExecCommand,
+		SeccompProfile: l.SeccompProfile,
+	}
+}
+
+func (l JudgeTaskLanguage) language() Language {
+	return Language{
+		ImageName:      l.ImageName,
+		FileName:       l.FileName,
+		ExeFileName:    l.ExeFileName,
+		CompileCommand: l.CompileCommand,
+		ExecCommand:    l.ExecCommand,
+		SeccompProfile: l.SeccompProfile,
+	}
+}
+
+// loadJudgedSubmissionで読み込んだのと同じ形にする
+func (t *JudgeTask) submission() *Submission {
+	s := &Submission{
+		ID:         t.SubmissionID,
+		SourceCode: t.SourceCode,
+		Language:   t.Language.language(),
+		Problem: Problem{
+			TimeLimit:       t.TimeLimit,
+			WallTimeLimit:   t.WallTimeLimit,
+			MemoryLimit:     t.MemoryLimit,
+			JudgeType:       t.JudgeType,
+			OutputOnly:      t.OutputOnly,
+			JudgementConfig: t.JudgementConfig,
+		},
+		JudgeSetResults: make([]JudgeSetResult, len(t.CaseSets)),
+	}
+	if s.Problem.JudgementConfig == nil {
+		s.Problem.JudgementConfig = &JudgementConfig{}
+	}
+	if t.CheckerLanguage != nil {
+		l := t.CheckerLanguage.language()
+		s.Problem.JudgementConfig.Language = &l
+	}
+
+	for i, c := range t.CaseSets {
+		r := JudgeSetResult{
+			ID:           c.ResultID,
+			SubmissionID: t.SubmissionID,
+			CaseSet:      c.CaseSet,
+			CaseSetID:    c.CaseSet.ID,
+			JudgeResults: make([]JudgeResult, len(c.Cases)),
+		}
+		for k, tc := range c.Cases {
+			r.JudgeResults[k] = JudgeResult{
+				ID:               tc.ResultID,
+				JudgeSetResultID: c.ResultID,
+				TestCaseID:       tc.TestCaseID,
+				TestCase: TestCase{
+					CaseSetID:  c.CaseSet.ID,
+					InputHash:  tc.InputHash,
+					OutputHash: tc.OutputHash,
+				},
+			}
+			r.JudgeResults[k].TestCase.ID = tc.TestCaseID
+		}
+		s.JudgeSetResults[i] = r
+	}
+	return s
+}
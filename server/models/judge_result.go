@@ -11,7 +11,11 @@ type JudgeResult struct {
 	TestCaseID       uint            `gorm:"not null" json:"-"`
 	Status           JudgementStatus `gorm:"not null; default:'0'" json:"status"`
 	ExecTime         time.Duration   `json:"execTime"`
+	WallTime         time.Duration   `json:"wallTime"`
 	MemoryUsage      int64           `json:"memoryUsage"`
+	Feedback         string          `gorm:"type:text" json:"feedback"`
+	// 提出されたプログラムの標準エラー出力の先頭
+	Stderr string `gorm:"type:text" json:"stderr"`
 }
 
 func newJudgeResult(testCase *TestCase, setResult *JudgeSetResult) {
@@ -46,6 +46,7 @@ func newJudgeSetResult(set *CaseSet, submission *Submission) {
 
 func (r *JudgeSetResult) FetchCaseSet() {
 	db.Model(r).Related(&r.CaseSet)
+	r.CaseSet.FetchDependencies()
 }
 
 func (r *JudgeSetResult) FetchJudgeResults(sorted bool) {
@@ -64,6 +65,14 @@ func (r *JudgeSetResult) shuffleJudgeResults() error {
 	return nil
 }
 
+// チェッカーのメッセージや標準エラー出力からテストケースの中身がわかってしまうことがあるので消す
+func (r *JudgeSetResult) hideFeedback() {
+	for i := range r.JudgeResults {
+		r.JudgeResults[i].Feedback = ""
+		r.JudgeResults[i].Stderr = ""
+	}
+}
+
 func (r *JudgeSetResult) GetJudgeResultsSorted() []JudgeResult {
 	results := make([]JudgeResult, 0)
 	db.Order("id ASC").Model(r).Related(&results)
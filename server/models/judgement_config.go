@@ -10,9 +10,36 @@ type JudgementConfig struct {
 	JudgeSourceCode *string   `gorm:"type:text" json:"judgeSourceCode,omitempty"`
 	LanguageID      *uint     `json:"languageID,omitempty"`
 	Language        *Language `json:"language,omitempty"`
-	Difference      float64   `json:"difference"`
+	// AbsoluteErrorとRelativeErrorがどちらも設定されていないときに、両方の許容誤差として使う
+	Difference float64 `json:"difference"`
+	// 誤差許容のジャッジでの絶対誤差と相対誤差。nilのときはその誤差では判定しない
+	AbsoluteError *float64 `json:"absoluteError" validate:"omitempty,min=0"`
+	RelativeError *float64 `json:"relativeError" validate:"omitempty,min=0"`
+	// trueのときは、想定解が整数のトークンは誤差を許容せずに比較する
+	ExactIntegers   bool            `gorm:"not null; default:false" json:"exactIntegers"`
+	CheckerProtocol CheckerProtocol `gorm:"not null; default:'0'" json:"checkerProtocol"`
+	// 以下は通常のジャッジでの出力の比較方法
+	// 空白文字で区切ったトークンの列として比較する
+	TokenWise bool `gorm:"not null; default:false" json:"tokenWise"`
+	// 各行の末尾の空白と、出力の末尾の空行を無視する
+	IgnoreTrailingSpaces bool `gorm:"not null; default:false" json:"ignoreTrailingSpaces"`
+	// 大文字と小文字を区別しない
+	CaseInsensitive bool `gorm:"not null; default:false" json:"caseInsensitive"`
+	// 行の順番を無視する
+	UnorderedLines bool `gorm:"not null; default:false" json:"unorderedLines"`
 }
 
+type CheckerProtocol int
+
+const (
+	// `exec in out submission main.cpp`で起動して、正常終了すればAC。標準出力が点数になる。
+	// 出力だけを提出する問題では、ソースコードのファイル名は渡さない
+	CheckerProtocolKoneko CheckerProtocol = 0
+	// testlibの`checker in submission out`と同じ。終了コードで判定して、メッセージは標準エラー出力に出す。
+	// 部分点 (終了コード7) はquitpにケースセットの配点に対する割合を0以上1以下で渡す
+	CheckerProtocolTestlib CheckerProtocol = 1
+)
+
 func (d *JudgementConfig) FetchLanguage() {
 	if d.LanguageID == nil {
 		return
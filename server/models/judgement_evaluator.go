@@ -17,6 +17,23 @@ type caseSetEvaluator interface {
 	evaluate() (JudgementStatus, int)
 }
 
+// すべてのテストケースの実行結果が揃ってから、まとめて判定の準備をする評価器。
+// nextより先に一度だけ呼ばれる。実行結果が得られなかったテストケースはnil。
+type batchCaseSetEvaluator interface {
+	prepare(results []*workers.ExecResult, testCases []*TestCase)
+}
+
+// 直前のテストケースの点数を0以上1以下で返せる評価器。
+// 実装していなければ、ACのテストケースの点数は1になる
+type scoredCaseSetEvaluator interface {
+	caseScore() float64
+}
+
+// 直前のテストケースについてのメッセージを返せる評価器
+type feedbackCaseSetEvaluator interface {
+	caseFeedback() string
+}
+
 func evaluateStatuses(statuses map[JudgementStatus]int) JudgementStatus {
 	temp := make([]JudgementStatus, 0, len(statuses))
 	for k, v := range statuses {
@@ -41,6 +58,8 @@ func toJudgementStatus(status workers.ExecStatus) JudgementStatus {
 		return StatusRuntimeError
 	case workers.StatusOutputLimitExceeded:
 		return StatusOutputLimitExceeded
+	case workers.StatusRestrictedFunction:
+		return StatusRestrictedFunction
 	default:
 		return StatusUnknownError
 	}
@@ -0,0 +1,299 @@
+package models
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/conf"
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/gomodule/redigo/redis"
+)
+
+// ジャッジの途中経過をRedisのpub/subで配信する。
+// APIサーバーが複数あっても、どのサーバーに届いた報告でも購読しているクライアントに届く
+const (
+	eventChannelPrefix = redisNamespace + ":events:"
+	// 購読者ごとに溜めておくイベントの数。読むのが遅い購読者には、溢れた分を送らない
+	eventBufferSize = 64
+	// 購読用の接続が切れたときに、つなぎ直すまでの時間
+	eventReconnectInterval = 3 * time.Second
+)
+
+type JudgementEventType string
+
+const (
+	// キューに入った、ジャッジが始まった、キャンセルされたなど
+	EventStatus JudgementEventType = "status"
+	// ケースセットとそのテストケースの評価が終わった
+	EventCaseSet JudgementEventType = "caseSet"
+	// 提出全体の結果が出た
+	EventResult JudgementEventType = "result"
+	// コンテストの得点が変わった。順位表はクライアントが取得し直す
+	EventStandings JudgementEventType = "standings"
+)
+
+type JudgementEvent struct {
+	Type         JudgementEventType `json:"type"`
+	SubmissionID uint               `json:"submissionID,omitempty"`
+	UserID       uint               `json:"userID"`
+	ProblemID    uint               `json:"problemID"`
+	Status       JudgementStatus    `json:"status"`
+	Point        int                `json:"point"`
+	ExecTime     time.Duration      `json:"execTime"`
+	MemoryUsage  int64              `json:"memoryUsage"`
+	// EventCaseSetのときだけ設定される
+	JudgeSetResult *JudgeSetResult `json:"judgeSetResult,omitempty"`
+}
+
+func SubmissionEventChannel(submissionID uint) string {
+	return eventChannelPrefix + "submission:" + strconv.FormatUint(uint64(submissionID), 10)
+}
+
+// コンテストでのユーザーの提出すべて
+func ContestUserEventChannel(contestID, userID uint) string {
+	return eventChannelPrefix + "contest:" + strconv.FormatUint(uint64(contestID), 10) + ":user:" + strconv.FormatUint(uint64(userID), 10)
+}
+
+func StandingsEventChannel(contestID uint) string {
+	return eventChannelPrefix + "contest:" + strconv.FormatUint(uint64(contestID), 10) + ":standings"
+}
+
+func newSubmissionEvent(t JudgementEventType, s *Submission) *JudgementEvent {
+	return &JudgementEvent{
+		Type:         t,
+		SubmissionID: s.ID,
+		UserID:       s.UserID,
+		ProblemID:    s.ProblemID,
+		Status:       s.Status,
+		Point:        s.Point,
+		ExecTime:     s.ExecTime,
+		MemoryUsage:  s.MemoryUsage,
+	}
+}
+
+// 提出を見られる人に、今の状態を最初に送るためのイベント
+func NewSubmissionStatusEvent(s *Submission) *JudgementEvent {
+	return newSubmissionEvent(EventStatus, s)
+}
+
+// 提出のチャネルと、コンテストへの提出ならユーザーのチャネルにも配信する
+func publishSubmissionEvent(s *Submission, e *JudgementEvent) {
+	channels := []string{SubmissionEventChannel(s.ID)}
+	if s.ContestID != nil {
+		channels = append(channels, ContestUserEventChannel(*s.ContestID, s.UserID))
+	}
+	publishEvent(e, channels...)
+}
+
+func publishCaseSetEvent(s *Submission, result *JudgeSetResult) {
+	r := *result
+	r.JudgeResults = make([]JudgeResult, len(result.JudgeResults))
+	copy(r.JudgeResults, result.JudgeResults)
+	// コンテストの提出は、ジャッジの途中では誰が見るかわからないので、見られても困らない形にする
+	if s.ContestID != nil {
+		r.shuffleJudgeResults()
+		r.hideFeedback()
+	}
+	// 購読者が提出者かどうかはわからないので、標準エラー出力は送らない
+	for i := range r.JudgeResults {
+		r.JudgeResults[i].Stderr = ""
+	}
+
+	e := newSubmissionEvent(EventCaseSet, s)
+	e.JudgeSetResult = &r
+	publishSubmissionEvent(s, e)
+}
+
+func publishStandingsEvent(contestID, userID, problemID uint, point int) {
+	e := &JudgementEvent{
+		Type:      EventStandings,
+		UserID:    userID,
+		ProblemID: problemID,
+		Point:     point,
+	}
+	publishEvent(e, StandingsEventChannel(contestID))
+}
+
+// 配信に失敗しても、ジャッジの結果の書き込みは止めない
+func publishEvent(e *JudgementEvent, channels ...string) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		logger.AppLog.Errorf("event error: %+v", err)
+		return
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	for _, ch := range channels {
+		conn.Send("PUBLISH", ch, payload)
+	}
+	if _, err := conn.Do(""); err != nil {
+		logger.AppLog.Errorf("redis error: %+v", err)
+	}
+}
+
+// APIサーバーごとに購読用の接続を1つだけ作り、チャネルごとの購読者に配る。
+// 購読は接続を占有するので、キューと共有しているredisPoolは使わない
+type eventHub struct {
+	mu sync.Mutex
+	// 接続が切れている間はnil
+	conn        *redis.PubSubConn
+	subscribers map[string]map[chan []byte]struct{}
+	// SUBSCRIBEを送って、まだ返事が届いていない数
+	pending map[string]int
+	// Redisが購読を始めたチャネル
+	subscribed map[string]bool
+	// 購読が始まるのを待っている購読者
+	waiters map[string][]chan struct{}
+}
+
+var (
+	hub = &eventHub{
+		subscribers: make(map[string]map[chan []byte]struct{}),
+		pending:     make(map[string]int),
+		subscribed:  make(map[string]bool),
+		waiters:     make(map[string][]chan struct{}),
+	}
+	hubOnce sync.Once
+)
+
+// チャネルに届いたイベントのJSONを受け取る。使い終わったら返した関数を呼んで購読をやめること。
+// 2つ目に返すチャネルは、Redisが購読を始めたことを確認できたときに閉じられる
+func SubscribeEvents(channel string) (<-chan []byte, <-chan struct{}, func()) {
+	hubOnce.Do(func() {
+		go hub.run()
+	})
+
+	ch := make(chan []byte, eventBufferSize)
+	ready := make(chan struct{})
+	hub.mu.Lock()
+	if hub.subscribers[channel] == nil {
+		hub.subscribers[channel] = make(map[chan []byte]struct{})
+		if hub.conn != nil {
+			if err := hub.conn.Subscribe(channel); err != nil {
+				logger.AppLog.Errorf("redis error: %+v", err)
+			} else {
+				hub.pending[channel]++
+			}
+		}
+	}
+	hub.subscribers[channel][ch] = struct{}{}
+	if hub.subscribed[channel] && hub.pending[channel] == 0 {
+		close(ready)
+	} else {
+		hub.waiters[channel] = append(hub.waiters[channel], ready)
+	}
+	hub.mu.Unlock()
+
+	unsubscribe := func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		delete(hub.subscribers[channel], ch)
+		if len(hub.subscribers[channel]) != 0 {
+			return
+		}
+		delete(hub.subscribers, channel)
+		delete(hub.waiters, channel)
+		if hub.conn != nil {
+			if err := hub.conn.Unsubscribe(channel); err != nil {
+				logger.AppLog.Errorf("redis error: %+v", err)
+			}
+		}
+	}
+	return ch, ready, unsubscribe
+}
+
+func (h *eventHub) run() {
+	for {
+		if err := h.receive(); err != nil {
+			logger.AppLog.Errorf("event subscription error: %+v", err)
+		}
+		time.Sleep(eventReconnectInterval)
+	}
+}
+
+// つなぎ直したときは、購読者のいるチャネルをすべて購読し直す
+func (h *eventHub) receive() error {
+	conn, err := redis.Dial("tcp", conf.GetConfig().Koneko.RedisHost)
+	if err != nil {
+		return err
+	}
+	psc := &redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	h.mu.Lock()
+	channels := make([]interface{}, 0, len(h.subscribers))
+	for c := range h.subscribers {
+		channels = append(channels, c)
+	}
+	if len(channels) != 0 {
+		if err := psc.Subscribe(channels...); err != nil {
+			h.mu.Unlock()
+			return err
+		}
+	}
+	h.conn = psc
+	h.pending = make(map[string]int, len(channels))
+	for c := range h.subscribers {
+		h.pending[c] = 1
+	}
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		h.conn = nil
+		h.pending = make(map[string]int)
+		h.subscribed = make(map[string]bool)
+		h.mu.Unlock()
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			h.dispatch(v.Channel, v.Data)
+		case redis.Subscription:
+			h.confirm(v)
+		case error:
+			return v
+		}
+	}
+}
+
+// 購読をやめてすぐに購読し直すと、前のSUBSCRIBEの返事が先に届くので、送った数だけ返事が届いてから購読が始まったとみなす
+func (h *eventHub) confirm(s redis.Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch s.Kind {
+	case "subscribe":
+		if 0 < h.pending[s.Channel] {
+			h.pending[s.Channel]--
+		}
+		if h.pending[s.Channel] != 0 {
+			return
+		}
+		delete(h.pending, s.Channel)
+		h.subscribed[s.Channel] = true
+		for _, w := range h.waiters[s.Channel] {
+			close(w)
+		}
+		delete(h.waiters, s.Channel)
+	case "unsubscribe":
+		delete(h.subscribed, s.Channel)
+	}
+}
+
+func (h *eventHub) dispatch(channel string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers[channel] {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
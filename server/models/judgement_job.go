@@ -10,42 +10,86 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/ProgrammingLab/koneko-online-judge/server/conf"
 	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/artifacts"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/testdata"
 	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
 	"github.com/gocraft/work"
 	"github.com/pkg/errors"
+	"golang.org/x/net/context"
 )
 
 type judgementJob struct {
 	submissionID uint
 	submission   *Submission
+	// 出力だけを提出する問題のときの、テストケースのIDごとの提出された出力のハッシュ
+	outputHashes map[uint]string
+	// ジャッジの途中経過と結果の書き込み先
+	reporter JudgementReporter
+	// キャンセルされたら、実行中のテストケースを止める
+	ctx context.Context
+	// falseのときは失敗しても再試行されるので、途中経過をUnknownErrorにしない
+	lastAttempt bool
+
+	compiled   *compiledProgram
+	interactor *interactiveEvaluator
+}
 
-	compiled *workers.Worker
+// コンパイル済みの実行ファイル。コンパイルエラーのときはexeは空
+type compiledProgram struct {
+	exe []byte
 }
 
 const (
 	imageNamePrefix    = "koneko-online-judge-image-"
 	compileTimeLimit   = 20 * time.Second
 	compileMemoryLimit = 512 * 1024 * 1024
+	// 提出に保存するコンパイラの出力の大きさの上限
+	errorLogLimit = 64 * 1024
 )
 
-var ErrParseOutput = errors.New("stdout parse error")
+var (
+	ErrParseOutput = errors.New("stdout parse error")
+	// Dockerのエラーなど、提出の内容によらない理由で最後まで評価できなかった。再試行すれば成功するかもしれない
+	ErrTransientJudgement = errors.New("judgement failed by a transient error")
+)
 
-func judge(submissionID uint) error {
-	_, err := enqueuer.Enqueue(judgementJobName, work.Q{submissionJobArgKey: submissionID})
+func judge(submissionID uint, priority judgePriority) error {
+	if err := clearCancelled(submissionID); err != nil {
+		return err
+	}
+	_, err := enqueuer.Enqueue(judgementJobNames[priority], work.Q{submissionJobArgKey: submissionID})
 	if err != nil {
 		logger.AppLog.Errorf("job error: %+v", err)
 	}
 	return err
 }
 
-func compile(sourceCode string, language *Language) (*workers.Worker, *workers.ExecResult) {
+// 同じソースコードを同じ方法でコンパイルしたことがあれば、キャッシュした実行ファイルを使う。
+// storeがfalseのときはキャッシュから読むだけで、コンパイルした実行ファイルは保存しない
+func compile(sourceCode string, language *Language, store bool) (*compiledProgram, *workers.ExecResult) {
+	img := imageNamePrefix + language.ImageName
+	// 同じタグでイメージを作り直したときに古い実行ファイルを使わないように、イメージのIDをキーにする
+	key := ""
+	if id, err := workers.ImageID(img); err != nil {
+		logger.AppLog.Errorf("compile: image id error %v %+v", img, err)
+	} else {
+		key = artifacts.Key(sourceCode, language.CompileCommand, language.ExeFileName, id)
+	}
+	if key != "" {
+		if exe, ok := artifacts.Get(key); ok {
+			return &compiledProgram{exe}, &workers.ExecResult{Status: workers.StatusFinished}
+		}
+	}
+
 	cmd := language.GetCompileCommandSlice()
-	w, err := workers.NewTimeoutWorker(imageNamePrefix+language.ImageName, compileTimeLimit, compileMemoryLimit, cmd)
+	w, err := workers.NewTimeoutWorker(img, compileTimeLimit, compileMemoryLimit, cmd)
 	if err != nil {
 		logger.AppLog.Errorf("compile: container create error %+v", err)
 		return nil, nil
 	}
+	defer w.Remove()
 
 	err = w.CopyContentToContainer([]byte(sourceCode), workers.Workspace+language.FileName)
 	if err != nil {
@@ -58,53 +102,96 @@ func compile(sourceCode string, language *Language) (*workers.Worker, *workers.E
 		logger.AppLog.Errorf("compile: container attach error %+v", err)
 		return nil, nil
 	}
+	if res.Status != workers.StatusFinished {
+		return &compiledProgram{}, res
+	}
 
-	return w, res
+	exe, err := w.ReadFile(workers.Workspace + language.ExeFileName)
+	if err != nil {
+		logger.AppLog.Errorf("compile: docker cp %+v", err)
+		return nil, nil
+	}
+	if key != "" && store {
+		if err := artifacts.Put(key, exe); err != nil {
+			logger.AppLog.Errorf("compile: cache error %+v", err)
+		}
+	}
+
+	return &compiledProgram{exe}, res
 }
 
-func (j *judgementJob) Run() {
+// 提出の内容によらない理由で最後まで評価できなかったときはエラーを返す。
+// lastAttemptがfalseのときはあとで再試行されるので、提出の結果をUnknownErrorにせずにキューに戻す
+func (j *judgementJob) Run(lastAttempt bool) (err error) {
 	defer func() {
-		if err := recover(); err != nil {
-			stackSize := 4 << 10 // 4 KB
-			stack := make([]byte, stackSize)
-			length := runtime.Stack(stack, true)
-			logger.AppLog.Errorf("%+v, %s", err, stack[:length])
+		if r := recover(); r != nil {
+			err = recoverJudgement(r)
 		}
 	}()
 
-	defer j.Close()
-	j.submission = GetSubmission(j.submissionID)
+	// ジャッジノードではAPIサーバーから取得したものが設定されている
 	if j.submission == nil {
-		logger.AppLog.Infof("submission(id = %v) is deleted", j.submissionID)
-		return
-	}
-	j.submission.SetStatus(StatusJudging)
-	j.submission.FetchLanguage()
-	j.submission.FetchProblem()
-	j.submission.Problem.FetchJudgementConfig()
-	j.submission.FetchJudgeSetResults(false)
+		j.submission, j.outputHashes = loadJudgedSubmission(j.submissionID)
+		if j.submission == nil {
+			logger.AppLog.Infof("submission(id = %v) is deleted", j.submissionID)
+			return nil
+		}
+	}
+	// キューで待っている間にキャンセルされていたら何もしない
+	if j.submission.Status == StatusCancelled || isCancelled(j.submission.ID) {
+		logger.AppLog.Infof("submission(id = %v) is cancelled", j.submission.ID)
+		return nil
+	}
+
+	j.lastAttempt = lastAttempt
+	var cancel context.CancelFunc
+	j.ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go j.watchCancellation(cancel)
+
+	if err := j.reporter.SetJudging(j.submission.ID); err != nil {
+		logger.AppLog.Errorf("report error: %+v", err)
+	}
 	var (
 		execTime    time.Duration
 		memoryUsage int64
 		point       = 0
 		finalStatus = StatusUnknownError
+		// 最後まで評価できたときだけコンテストの点数に反映する
+		scored   bool
+		errorLog string
 	)
 
 	defer func() {
-		query := map[string]interface{}{
-			"point":        point,
-			"status":       finalStatus,
-			"exec_time":    execTime,
-			"memory_usage": memoryUsage,
+		if r := recover(); r != nil {
+			err = recoverJudgement(r)
+		}
+
+		report := &JudgementReport{
+			Status:      finalStatus,
+			Point:       point,
+			ExecTime:    execTime,
+			MemoryUsage: memoryUsage,
+			ErrorLog:    errorLog,
+			Scored:      scored,
+		}
+		if isCancelled(j.submission.ID) {
+			// 途中まで評価したケースセットの結果は残す。キャンセルしたので再試行もしない
+			logger.AppLog.Infof("submission(id = %v) is cancelled", j.submission.ID)
+			report = &JudgementReport{Status: StatusCancelled}
+			err = nil
+		} else if err != nil && !lastAttempt {
+			report = &JudgementReport{Status: StatusInQueue}
+		}
+		if err := j.reporter.SetResult(j.submission.ID, report); err != nil {
+			logger.AppLog.Errorf("report error: %+v", err)
 		}
-		db.Model(&Submission{ID: j.submission.ID}).Updates(query)
-		onUpdateJudgementStatuses(j.submission.Problem.ContestID, *j.submission)
 	}()
 
 	var eval evaluator
 	switch j.submission.Problem.JudgeType {
 	case JudgeTypeNormal:
-		eval = newSimpleEvaluator()
+		eval = newNormalEvaluator(j.submission.Problem.JudgementConfig)
 	case JudgeTypePrecision:
 		eval = newPrecisionEvaluator(j.submission.Problem.JudgementConfig)
 	case JudgeTypeSpecial:
@@ -113,42 +200,76 @@ func (j *judgementJob) Run() {
 		if err != nil {
 			logger.AppLog.Errorf("judge source code compile error: %+v", err)
 			finalStatus = StatusUnknownError
-			markAs(j.submission.JudgeSetResults, finalStatus)
-			return
+			return j.fail(transientOrNil(err))
+		}
+	case JudgeTypeInteractive:
+		var err error
+		j.interactor, err = newInteractiveEvaluator(j.submission.Problem.JudgementConfig)
+		if err != nil {
+			logger.AppLog.Errorf("interactor error: %+v", err)
+			finalStatus = StatusUnknownError
+			return j.fail(transientOrNil(err))
 		}
+		eval = j.interactor
 	default:
 		logger.AppLog.Errorf("%v is not implemented", j.submission.Problem.JudgeType)
 		finalStatus = StatusUnknownError
-		markAs(j.submission.JudgeSetResults, finalStatus)
-		return
+		return j.fail(nil)
 	}
 
 	defer eval.remove()
 
 	var compileRes *workers.ExecResult
-	j.compiled, compileRes = compile(j.submission.SourceCode[:], &j.submission.Language)
-	if j.compiled == nil || compileRes == nil {
+	if !j.submission.Problem.OutputOnly {
+		j.compiled, compileRes = compile(j.submission.SourceCode[:], &j.submission.Language, true)
+	}
+
+	switch {
+	case j.submission.Problem.OutputOnly:
+		// 実行はせずに、提出された出力をそのまま評価する
+		for i := range j.submission.JudgeSetResults {
+			r := &j.submission.JudgeSetResults[i]
+			setEval := eval.next(&r.CaseSet, nil)
+			if err := j.judgeOutputs(j.outputHashes, setEval, r); err != nil {
+				return ErrTransientJudgement
+			}
+		}
+	case j.compiled == nil || compileRes == nil:
 		finalStatus = StatusUnknownError
-		markAs(j.submission.JudgeSetResults, finalStatus)
-	} else {
+		return j.fail(ErrTransientJudgement)
+	default:
 		logger.AppLog.Debugf("%v %v", compileRes.Status, compileRes.Stderr)
 
 		if compileRes.Status != workers.StatusFinished {
 			finalStatus = StatusCompileError
-			markAs(j.submission.JudgeSetResults, finalStatus)
+			errorLog = truncateString(compileRes.Stderr, errorLogLimit)
+			j.markAs(finalStatus)
 			logger.AppLog.Debugf("compile error: worker status %v", compileRes.Status, compileRes.Stderr)
 		} else {
-			for _, r := range j.submission.JudgeSetResults {
-				r.FetchCaseSet()
-				setEval := eval.next(&r.CaseSet, nil)
-				w, err := j.executeCaseSet(setEval, &r)
+			results := make([]JudgeSetResult, len(j.submission.JudgeSetResults))
+			copy(results, j.submission.JudgeSetResults)
+			ctx, cancel := context.WithCancel(j.ctx)
+			defer cancel()
+			executed := j.executeCaseSets(ctx, results)
+			for i, ch := range executed {
+				e := <-ch
+				if e.err != nil {
+					logger.AppLog.Error(e.err)
+					e.done()
+					cancel()
+					removeExecutedCaseSets(executed[i+1:])
+					return ErrTransientJudgement
+				}
+				setEval := eval.next(&e.result.CaseSet, nil)
+				err := j.judgeCaseSet(e.worker, e.interactor, setEval, e.result)
+				e.done()
 				if err != nil {
-					logger.AppLog.Error(err)
-					break
+					cancel()
+					removeExecutedCaseSets(executed[i+1:])
+					return ErrTransientJudgement
 				}
-				j.judgeCaseSet(w, setEval, &r)
-				execTime = MaxDuration(execTime, r.ExecTime)
-				memoryUsage = MaxLong(memoryUsage, r.MemoryUsage)
+				execTime = MaxDuration(execTime, e.result.ExecTime)
+				memoryUsage = MaxLong(memoryUsage, e.result.MemoryUsage)
 			}
 		}
 	}
@@ -156,120 +277,316 @@ func (j *judgementJob) Run() {
 	if finalStatus != StatusCompileError {
 		finalStatus, point = eval.evaluate()
 	}
+	scored = true
+	return nil
+}
 
-	j.submission.Point = point
-	j.submission.Status = finalStatus
-	j.submission.ExecTime = execTime
-	j.submission.MemoryUsage = memoryUsage
+func recoverJudgement(r interface{}) error {
+	stackSize := 4 << 10 // 4 KB
+	stack := make([]byte, stackSize)
+	length := runtime.Stack(stack, true)
+	logger.AppLog.Errorf("%+v, %s", r, stack[:length])
+	return errors.Errorf("panic: %v", r)
+}
 
-	if j.submission.Problem.ContestID != nil {
-		p := &j.submission.Problem
-		p.FetchContest()
-		writer, err := p.Contest.IsWriter(j.submission.UserID)
-		if err != nil {
-			logger.AppLog.Errorf("error %+v", err)
-			return
-		}
-		open, err := p.Contest.IsOpen(j.submission.CreatedAt, &UserSession{UserID: j.submission.UserID})
-		if err != nil {
-			logger.AppLog.Error(err)
+func (j *judgementJob) watchCancellation(cancel context.CancelFunc) {
+	t := time.NewTicker(cancellationPollInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-j.ctx.Done():
 			return
+		case <-t.C:
+			if isCancelled(j.submission.ID) {
+				cancel()
+				return
+			}
 		}
-		if open && !writer {
-			updateScore(j.submission, *j.submission.Problem.ContestID)
+	}
+}
+
+// チェッカーやインタラクタのコンパイルエラーは、再試行しても変わらないので再試行しない
+func transientOrNil(err error) error {
+	if err == ErrTransientJudgement {
+		return err
+	}
+	return nil
+}
+
+// ケースセットを評価する前に失敗したときは、すべてUnknownErrorにしてerrを返す。
+// 再試行されるときはキューに戻すだけなので、ケースセットの結果は変えない
+func (j *judgementJob) fail(err error) error {
+	if err != ErrTransientJudgement || j.lastAttempt {
+		j.markAs(StatusUnknownError)
+	}
+	return err
+}
+
+// まだ実行していないケースセットとテストケースをすべてstatusにする
+func (j *judgementJob) markAs(status JudgementStatus) {
+	for i := range j.submission.JudgeSetResults {
+		s := &j.submission.JudgeSetResults[i]
+		s.Status = status
+		for k := range s.JudgeResults {
+			s.JudgeResults[k].Status = status
 		}
+		j.reportCaseSet(s)
+	}
+}
+
+// 再試行されるときは、読めなかったテストケースをUnknownErrorにしたケースセットの結果を送らない
+func (j *judgementJob) reportJudgedCaseSet(result *JudgeSetResult, err error) {
+	if err == nil || j.lastAttempt {
+		j.reportCaseSet(result)
 	}
 }
 
-func (j *judgementJob) Close() {
-	if j.compiled == nil {
-		return
+func (j *judgementJob) reportCaseSet(result *JudgeSetResult) {
+	if err := j.reporter.SetCaseSetResult(j.submission.ID, result); err != nil {
+		logger.AppLog.Errorf("report error: %+v", err)
 	}
-	j.compiled.Remove()
 }
 
-func markAs(setResults []JudgeSetResult, status JudgementStatus) {
-	for _, s := range setResults {
-		s.FetchJudgeResults(false)
-		db.Model(s).Update("status", status)
-		for _, r := range s.JudgeResults {
-			db.Model(r).Update("status", status)
+// 実行し終わったケースセット。errがnilでなければworkerはnil
+type executedCaseSet struct {
+	result *JudgeSetResult
+	worker *workers.Worker
+	// インタラクティブな問題でなければnil
+	interactor *workers.Worker
+	err        error
+	// workerを削除したら呼んで、次のケースセットを実行できるようにする
+	done func()
+}
+
+func (e executedCaseSet) remove() {
+	if e.worker != nil {
+		e.worker.Remove()
+	}
+	if e.interactor != nil {
+		e.interactor.Remove()
+	}
+	e.done()
+}
+
+// ケースセットを並列に実行して、実行し終わったものをそれぞれのチャネルに送る。
+// 評価は前のケースセットの結果に依存するので、呼び出し側で順番に受け取って評価し、workerを削除したらdoneを呼ぶこと。
+// 削除されていないworkerはparallelism個までにして、それ以上は前のケースセットの評価を待つ
+func (j *judgementJob) executeCaseSets(ctx context.Context, results []JudgeSetResult) []<-chan executedCaseSet {
+	chs := make([]chan executedCaseSet, len(results))
+	executed := make([]<-chan executedCaseSet, len(results))
+	for i := range chs {
+		chs[i] = make(chan executedCaseSet, 1)
+		executed[i] = chs[i]
+	}
+	if len(results) == 0 {
+		return executed
+	}
+
+	parallelism := judgeParallelism()
+	// 同時に実行するケースセットでCPUを分け合う
+	perSet := parallelism / MinInt(parallelism, len(results))
+	sem := make(chan struct{}, parallelism)
+	done := func() {
+		<-sem
+	}
+
+	go func() {
+		for i := range results {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				chs[i] <- executedCaseSet{result: &results[i], err: ctx.Err(), done: func() {}}
+				continue
+			}
+
+			go func(i int) {
+				e := executedCaseSet{result: &results[i], done: done}
+				defer func() {
+					if err := recover(); err != nil {
+						logger.AppLog.Errorf("%+v", err)
+						e.err = errors.Errorf("%v", err)
+					}
+					chs[i] <- e
+				}()
+
+				e.worker, e.interactor, e.err = j.executeCaseSet(ctx, e.result, perSet)
+			}(i)
 		}
+	}()
+
+	return executed
+}
+
+// 評価しないケースセットの実行が終わるのを待って削除する
+func removeExecutedCaseSets(executed []<-chan executedCaseSet) {
+	for _, ch := range executed {
+		e := <-ch
+		e.remove()
 	}
 }
 
-func (j *judgementJob) executeCaseSet(evaluator caseSetEvaluator, result *JudgeSetResult) (*workers.Worker, error) {
-	result.FetchJudgeResults(false)
+// 1つの提出で同時に実行するテストケースの数
+func judgeParallelism() int {
+	if p := conf.GetConfig().Judgement.Parallelism; 1 < p {
+		return p
+	}
+	return 1
+}
 
-	w, err := j.createJudgementWorker(result.JudgeResults)
+// インタラクティブな問題のときは、インタラクタを実行したworkerも返す
+func (j *judgementJob) executeCaseSet(ctx context.Context, result *JudgeSetResult, parallelism int) (*workers.Worker, *workers.Worker, error) {
+	w, err := j.createJudgementWorker(result.JudgeResults, parallelism)
 	if err != nil {
 		logger.AppLog.Error(err)
-		return nil, err
+		return nil, nil, err
+	}
+
+	if j.interactor == nil {
+		res, err := w.RunContext(ctx, "", false)
+		if err != nil {
+			logger.AppLog.Error(err)
+			w.Remove()
+			return nil, nil, err
+		}
+		logger.AppLog.Debug(res)
+		return w, nil, nil
 	}
 
-	res, err := w.Run("", false)
+	problem := &j.submission.Problem
+	iw, err := j.interactor.newWorker(w, result.JudgeResults, problem)
 	if err != nil {
 		logger.AppLog.Error(err)
-		return nil, err
+		w.Remove()
+		return nil, nil, err
+	}
+	if err := j.interactor.run(ctx, w, iw, problem); err != nil {
+		logger.AppLog.Error(err)
+		w.Remove()
+		iw.Remove()
+		return nil, nil, err
 	}
-	logger.AppLog.Debug(res)
 
-	return w, err
+	return w, iw, nil
 }
 
-func (j *judgementJob) judgeCaseSet(w *workers.Worker, evaluator caseSetEvaluator, setResult *JudgeSetResult) {
+// 実行結果や想定解を読めなかったときは、評価してからエラーを返す
+func (j *judgementJob) judgeCaseSet(w, interactor *workers.Worker, evaluator caseSetEvaluator, setResult *JudgeSetResult) error {
 	defer w.Remove()
+	if interactor != nil {
+		defer interactor.Remove()
+	}
 
-	var (
-		maxExecTime    time.Duration
-		maxMemoryUsage int64
-		hasErr         bool
-	)
+	var hasErr error
 
 	p, err := workers.NewExecResultParser(w)
 	if err != nil {
 		logger.AppLog.Error(err)
-		hasErr = true
+		hasErr = err
 	}
 	results := setResult.JudgeResults
+	execResults := make([]*workers.ExecResult, len(results))
+	testCases := make([]*TestCase, len(results))
+
+	for i := range results {
+		r := &results[i]
+		outputErr := r.TestCase.FetchOutput()
+		testCases[i] = &r.TestCase
+		if hasErr != nil {
+			continue
+		}
+
+		has, res, err := p.Next()
+		logger.AppLog.Debug(i)
+		if err != nil {
+			logger.AppLog.Error(err)
+			hasErr = err
+		} else if !has && i != len(results)-1 {
+			logger.AppLog.Error(ErrParseOutput)
+			hasErr = ErrParseOutput
+		} else if outputErr != nil {
+			// 想定解が読めなかったケースはnilのままにしてUnknownErrorにする
+			hasErr = outputErr
+		} else {
+			execResults[i] = res
+		}
+	}
 
-	for i, r := range results {
-		r.FetchTestCase()
-		var (
-			has bool
-			res *workers.ExecResult
-			err error
-		)
-		if !hasErr {
-			has, res, err = p.Next()
-			logger.AppLog.Debug(i)
-			if err != nil {
-				logger.AppLog.Error(err)
-				res = nil
-				hasErr = true
-			} else if !has && i != len(results)-1 {
-				logger.AppLog.Error(ErrParseOutput)
-				res = nil
-				hasErr = true
+	if interactor != nil {
+		if err := attachInteractorResults(execResults, interactor); err != nil && hasErr == nil {
+			hasErr = err
+		}
+	}
+
+	evaluateCaseSet(evaluator, setResult, execResults, testCases)
+	j.reportJudgedCaseSet(setResult, hasErr)
+	return hasErr
+}
+
+// 出力が提出されていないテストケースは空の出力として評価する
+func (j *judgementJob) judgeOutputs(outputHashes map[uint]string, evaluator caseSetEvaluator, setResult *JudgeSetResult) error {
+	results := setResult.JudgeResults
+	execResults := make([]*workers.ExecResult, len(results))
+	testCases := make([]*TestCase, len(results))
+
+	var hasErr error
+	for i := range results {
+		r := &results[i]
+		testCases[i] = &r.TestCase
+		if err := r.TestCase.FetchOutput(); err != nil {
+			hasErr = err
+			continue
+		}
+		out := ""
+		if hash, ok := outputHashes[r.TestCaseID]; ok {
+			var err error
+			if out, err = readTestData(hash); err != nil {
+				hasErr = err
+				continue
 			}
 		}
+		execResults[i] = &workers.ExecResult{
+			Status: workers.StatusFinished,
+			Stdout: out,
+		}
+	}
+
+	evaluateCaseSet(evaluator, setResult, execResults, testCases)
+	j.reportJudgedCaseSet(setResult, hasErr)
+	return hasErr
+}
+
+// 実行結果をテストケースごとに評価して、ケースセットの結果を設定する
+func evaluateCaseSet(evaluator caseSetEvaluator, setResult *JudgeSetResult, execResults []*workers.ExecResult, testCases []*TestCase) {
+	var (
+		maxExecTime    time.Duration
+		maxMemoryUsage int64
+	)
+	results := setResult.JudgeResults
+
+	if b, ok := evaluator.(batchCaseSetEvaluator); ok {
+		b.prepare(execResults, testCases)
+	}
 
+	for i := range results {
+		r := &results[i]
+		res := execResults[i]
 		r.Status, _ = evaluator.next(res, &r.TestCase)
-		if err != nil || res == nil {
+		if res == nil {
 			r.Status = StatusUnknownError
 		}
+		if f, ok := evaluator.(feedbackCaseSetEvaluator); ok {
+			r.Feedback = f.caseFeedback()
+		}
 		if res != nil {
 			r.ExecTime = res.ExecTime
+			r.WallTime = res.WallTime
 			r.MemoryUsage = res.MemoryUsage / 1024
+			r.Stderr = truncateString(res.Stderr, workers.CaseStderrLimit)
 		}
 
-		query := map[string]interface{}{
-			"status":       r.Status,
-			"exec_time":    r.ExecTime,
-			"memory_usage": r.MemoryUsage,
-		}
-		db.Model(&JudgeResult{ID: r.ID}).Updates(query)
-
 		maxExecTime = MaxDuration(maxExecTime, r.ExecTime)
 		maxMemoryUsage = MaxLong(maxMemoryUsage, r.MemoryUsage)
 	}
@@ -277,24 +594,15 @@ func (j *judgementJob) judgeCaseSet(w *workers.Worker, evaluator caseSetEvaluato
 	setResult.Status, setResult.Point = evaluator.evaluate()
 	setResult.ExecTime = maxExecTime
 	setResult.MemoryUsage = maxMemoryUsage
-
-	query := map[string]interface{}{
-		"point":        setResult.Point,
-		"status":       setResult.Status,
-		"exec_time":    setResult.ExecTime,
-		"memory_usage": setResult.MemoryUsage,
-	}
-	db.Model(&JudgeSetResult{ID: setResult.ID}).Updates(query)
 }
 
-func (j *judgementJob) createJudgementWorker(results []JudgeResult) (*workers.Worker, error) {
+func (j *judgementJob) createJudgementWorker(results []JudgeResult, parallelism int) (*workers.Worker, error) {
 	problem := &j.submission.Problem
 	language := &j.submission.Language
 	cmd := language.GetExecCommandSlice()
-	w, err := workers.NewJudgementWorker(imageNamePrefix+language.ImageName, problem.TimeLimit, int64(problem.MemoryLimit*1024*1024), cmd)
+	w, err := workers.NewJudgementWorker(imageNamePrefix+language.ImageName, problem.TimeLimit, problem.GetWallTimeLimit(), int64(problem.MemoryLimit*1024*1024), parallelism, language.SeccompProfile, j.interactor != nil, cmd)
 	if err != nil {
 		logger.AppLog.Errorf("exec: container create error %+v", err)
-		w.Remove()
 		return nil, err
 	}
 
@@ -308,28 +616,16 @@ func (j *judgementJob) createJudgementWorker(results []JudgeResult) (*workers.Wo
 
 	shuffleJudgeResults(results)
 
-	for i, r := range results {
-		r.FetchTestCase()
-		name := inputDir + "/" + strconv.Itoa(i)
-		err := func() error {
-			f, err := os.Create(name)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			_, err = f.WriteString(r.TestCase.Input)
-
-			return err
-		}()
-		if err != nil {
+	for i := range results {
+		r := &results[i]
+		if err := testdata.Copy(r.TestCase.InputHash, inputDir+"/"+strconv.Itoa(i)); err != nil {
 			logger.AppLog.Error(err)
 			w.Remove()
 			return nil, err
 		}
 	}
 
-	err = j.compiled.CopyTo(workers.Workspace+language.ExeFileName, w)
+	err = w.CopyContentToContainer(j.compiled.exe, workers.Workspace+language.ExeFileName)
 	if err != nil {
 		logger.AppLog.Errorf("exec: docker cp error %+v", err)
 		w.Remove()
@@ -339,6 +635,17 @@ func (j *judgementJob) createJudgementWorker(results []JudgeResult) (*workers.Wo
 	return w, nil
 }
 
+func writeFile(name, content string, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(content)
+	return err
+}
+
 func shuffleJudgeResults(results []JudgeResult) error {
 	seed, err := crand.Int(crand.Reader, big.NewInt(math.MaxInt64))
 	if err != nil {
@@ -15,6 +15,7 @@ type Language struct {
 	ExeFileName    string    `gorm:"not null" json:"-"`
 	CompileCommand string    `gorm:"not null" json:"compileCommand"`
 	ExecCommand    string    `gorm:"not null" json:"execCommand"`
+	SeccompProfile string    `gorm:"not null" json:"-"`
 }
 
 func GetAllLanguages() []*Language {
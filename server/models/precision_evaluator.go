@@ -3,19 +3,22 @@ package models
 import (
 	"bufio"
 	"math"
+	"math/big"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
 )
 
+var integerTokenRegex = regexp.MustCompile(`^[+-]?[0-9]+$`)
+
 type precisionEvaluator struct {
 	simple evaluator
 	config *JudgementConfig
 }
 
 func newPrecisionEvaluator(config *JudgementConfig) precisionEvaluator {
-	config.FetchLanguage()
 	return precisionEvaluator{
 		simple: newSimpleEvaluator(),
 		config: config,
@@ -57,6 +60,9 @@ func newPrecisionCaseSetEvaluator(set *CaseSet, config *JudgementConfig) *precis
 
 func (e *precisionCaseSetEvaluator) next(res *workers.ExecResult, testCase *TestCase) (JudgementStatus, int) {
 	st := func() JudgementStatus {
+		if res == nil {
+			return StatusUnknownError
+		}
 		if res.Status != workers.StatusFinished {
 			return toJudgementStatus(res.Status)
 		}
@@ -86,24 +92,57 @@ func (e *precisionCaseSetEvaluator) next(res *workers.ExecResult, testCase *Test
 	return st, 0
 }
 
+// bは想定解のトークン
 func (e *precisionCaseSetEvaluator) equals(a, b string) bool {
 	if a == b {
 		return true
 	}
 
+	if e.config.ExactIntegers && integerTokenRegex.MatchString(b) {
+		if !integerTokenRegex.MatchString(a) {
+			return false
+		}
+		ai, _ := new(big.Int).SetString(a, 10)
+		bi, _ := new(big.Int).SetString(b, 10)
+		return ai.Cmp(bi) == 0
+	}
+
 	af, err := strconv.ParseFloat(a, 64)
-	if err != nil {
+	if err != nil && !isRangeError(err) {
 		return false
 	}
 	bf, err := strconv.ParseFloat(b, 64)
-	if err != nil {
+	if err != nil && !isRangeError(err) {
 		return false
 	}
 
-	absolute := math.Abs(af - bf)
-	relative := math.Abs((af - bf) / bf)
-	diff := e.config.Difference
-	return absolute < diff || relative < diff
+	// NaNとInfは同じ種類のときだけ一致とする
+	switch {
+	case math.IsNaN(af) || math.IsNaN(bf):
+		return math.IsNaN(af) && math.IsNaN(bf)
+	case math.IsInf(af, 0) || math.IsInf(bf, 0):
+		return af == bf
+	}
+
+	diff := math.Abs(af - bf)
+	if e.config.AbsoluteError == nil && e.config.RelativeError == nil {
+		// 以前からある問題の判定が変わらないように、Differenceだけのときは誤差がちょうど等しいと一致としない
+		d := e.config.Difference
+		return diff < d || diff < d*math.Abs(bf)
+	}
+
+	absolute, relative := e.config.AbsoluteError, e.config.RelativeError
+	if absolute != nil && diff <= *absolute {
+		return true
+	}
+	// 想定解が0のときは相対誤差では判定できないので、絶対誤差だけで判定される
+	return relative != nil && diff <= *relative*math.Abs(bf)
+}
+
+// 1e-400のような表現できない値も、0やInfとして比較する
+func isRangeError(err error) bool {
+	numErr, ok := err.(*strconv.NumError)
+	return ok && numErr.Err == strconv.ErrRange
 }
 
 func (e *precisionCaseSetEvaluator) evaluate() (JudgementStatus, int) {
@@ -0,0 +1,57 @@
+package models
+
+import "testing"
+
+func TestPrecisionEquals(t *testing.T) {
+	abs := 1e-6
+	rel := 1e-6
+	half := 0.5
+	inputs := []struct {
+		Config *JudgementConfig
+		A, B   string
+	}{
+		{&JudgementConfig{Difference: 1e-6}, "1.0000001", "1"},
+		{&JudgementConfig{Difference: 1e-6}, "0.1", "0"},
+		{&JudgementConfig{AbsoluteError: &abs}, "0.0000001", "0"},
+		{&JudgementConfig{RelativeError: &rel}, "0.0000001", "0"},
+		{&JudgementConfig{RelativeError: &rel}, "1000000.5", "1000000"},
+		{&JudgementConfig{AbsoluteError: &abs}, "1000000.5", "1000000"},
+		{&JudgementConfig{AbsoluteError: &abs, RelativeError: &rel}, "nan", "0"},
+		{&JudgementConfig{AbsoluteError: &abs, RelativeError: &rel}, "nan", "nan"},
+		{&JudgementConfig{AbsoluteError: &abs, RelativeError: &rel}, "inf", "1e308"},
+		{&JudgementConfig{AbsoluteError: &abs, RelativeError: &rel}, "-inf", "-Inf"},
+		{&JudgementConfig{AbsoluteError: &abs, ExactIntegers: true}, "3.0000001", "3"},
+		{&JudgementConfig{AbsoluteError: &abs, ExactIntegers: true}, "+3", "3"},
+		{&JudgementConfig{AbsoluteError: &abs, ExactIntegers: true}, "3.0000001", "3.0"},
+		{&JudgementConfig{AbsoluteError: &abs}, "abc", "0"},
+		{&JudgementConfig{Difference: 0.5}, "1.5", "1"},
+		{&JudgementConfig{AbsoluteError: &half}, "1.5", "1"},
+		{&JudgementConfig{RelativeError: &half}, "3", "2"},
+	}
+	outputs := []bool{
+		true,
+		false,
+		true,
+		false,
+		true,
+		false,
+		false,
+		true,
+		false,
+		true,
+		false,
+		true,
+		true,
+		false,
+		false,
+		true,
+		true,
+	}
+
+	for i, in := range inputs {
+		e := &precisionCaseSetEvaluator{config: in.Config}
+		if e.equals(in.A, in.B) != outputs[i] {
+			t.Errorf("error on test case #%v", i)
+		}
+	}
+}
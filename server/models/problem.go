@@ -7,20 +7,23 @@ import (
 )
 
 type Problem struct {
-	ID              uint             `gorm:"primary_key" json:"id"`
-	WriterID        uint             `gorm:"not null" json:"writerID"`
-	Writer          User             `gorm:"ForeignKey:WriterID" json:"writer,omitempty"`
-	CreatedAt       time.Time        `json:"createdAt"`
-	UpdatedAt       time.Time        `json:"updatedAt"`
-	Title           string           `gorm:"not null" json:"title"`
-	Body            string           `gorm:"type:text; not null" json:"body"`
-	InputFormat     string           `gorm:"type:text" json:"inputFormat"`
-	OutputFormat    string           `gorm:"type:text" json:"outputFormat"`
-	Constraints     string           `gorm:"type:text" json:"constraints"`
-	Samples         []Sample         `json:"samples,omitempty"`
-	TimeLimit       time.Duration    `gorm:"not null" json:"timeLimit" validate:"required,max=60000000000,min=1000000000"`
-	MemoryLimit     int              `gorm:"not null" json:"memoryLimit" validate:"required,max=512,min=128"`
-	JudgeType       JudgeType        `gorm:"not null; default:'0'" json:"judgeType" validate:"max=2,min=0"`
+	ID            uint          `gorm:"primary_key" json:"id"`
+	WriterID      uint          `gorm:"not null" json:"writerID"`
+	Writer        User          `gorm:"ForeignKey:WriterID" json:"writer,omitempty"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	UpdatedAt     time.Time     `json:"updatedAt"`
+	Title         string        `gorm:"not null" json:"title"`
+	Body          string        `gorm:"type:text; not null" json:"body"`
+	InputFormat   string        `gorm:"type:text" json:"inputFormat"`
+	OutputFormat  string        `gorm:"type:text" json:"outputFormat"`
+	Constraints   string        `gorm:"type:text" json:"constraints"`
+	Samples       []Sample      `json:"samples,omitempty"`
+	TimeLimit     time.Duration `gorm:"not null" json:"timeLimit" validate:"required,max=60000000000,min=1000000000"`
+	WallTimeLimit time.Duration `gorm:"not null; default:'0'" json:"wallTimeLimit" validate:"omitempty,gtefield=TimeLimit,max=180000000000"`
+	MemoryLimit   int           `gorm:"not null" json:"memoryLimit" validate:"required,max=512,min=128"`
+	JudgeType     JudgeType     `gorm:"not null; default:'0'" json:"judgeType" validate:"max=3,min=0"`
+	// trueのときはソースコードではなく、テストケースごとの出力を提出する
+	OutputOnly      bool             `gorm:"not null; default:false" json:"outputOnly"`
 	CaseSets        []CaseSet        `json:"caseSets,omitempty"`
 	Submissions     []Submission     `json:"-"`
 	Contest         *Contest         `json:"contest,omitempty"`
@@ -30,6 +33,9 @@ type Problem struct {
 
 type JudgeType int
 
+// WallTimeLimitが設定されていない問題では、実時間の制限をCPU時間の制限のこの倍数にする
+const defaultWallTimeLimitFactor = 2
+
 const (
 	// inputとoutputが1対1の普通のジャッジ
 	JudgeTypeNormal JudgeType = 0
@@ -37,6 +43,8 @@ const (
 	JudgeTypePrecision JudgeType = 1
 	// 特別なoutputの評価器が必要なジャッジ
 	JudgeTypeSpecial JudgeType = 2
+	// インタラクタと標準入出力をつないで対話させるジャッジ
+	JudgeTypeInteractive JudgeType = 3
 )
 
 func NewProblem(problem *Problem) error {
@@ -85,8 +93,10 @@ func (p *Problem) Update(request *Problem) {
 	p.OutputFormat = request.OutputFormat
 	p.Constraints = request.Constraints
 	p.TimeLimit = request.TimeLimit
+	p.WallTimeLimit = request.WallTimeLimit
 	p.MemoryLimit = request.MemoryLimit
 	p.JudgeType = request.JudgeType
+	p.OutputOnly = request.OutputOnly
 
 	db.Delete(JudgementConfig{}, "problem_id = ?", p.ID)
 	if request.JudgementConfig != nil {
@@ -101,14 +111,16 @@ func (p *Problem) Update(request *Problem) {
 	p.UpdateSamples()
 
 	db.Model(Problem{}).Where("id = ?", p.ID).Updates(map[string]interface{}{
-		"title":         request.Title,
-		"body":          request.Body,
-		"input_format":  request.InputFormat,
-		"output_format": request.OutputFormat,
-		"constraints":   request.Constraints,
-		"time_limit":    request.TimeLimit,
-		"memory_limit":  request.MemoryLimit,
-		"judge_type":    request.JudgeType,
+		"title":           request.Title,
+		"body":            request.Body,
+		"input_format":    request.InputFormat,
+		"output_format":   request.OutputFormat,
+		"constraints":     request.Constraints,
+		"time_limit":      request.TimeLimit,
+		"wall_time_limit": request.WallTimeLimit,
+		"memory_limit":    request.MemoryLimit,
+		"judge_type":      request.JudgeType,
+		"output_only":     request.OutputOnly,
 	})
 }
 
@@ -122,19 +134,18 @@ func (p *Problem) ReplaceTestCases(archive []byte) error {
 	return err
 }
 
-func (p *Problem) Rejudge() error {
-	go func() {
-		p.FetchSubmissions()
-		deleteScoreDetails(p.ID)
-		for i := range p.Submissions {
-			if err := p.Submissions[i].rejudge(); err != nil {
-				logger.AppLog.Errorf("error: %+v", err)
-				break
-			}
-		}
-	}()
+// 提出をすべてリジャッジのキューに入れる。返したIDでまとめてキャンセルできる
+func (p *Problem) Rejudge() (string, error) {
+	p.FetchSubmissions()
+	return RejudgeSubmissions(p.Submissions)
+}
 
-	return nil
+// 実時間の制限を返す。設定されていなければCPU時間の制限から決める。
+func (p *Problem) GetWallTimeLimit() time.Duration {
+	if p.WallTimeLimit != 0 {
+		return p.WallTimeLimit
+	}
+	return p.TimeLimit * defaultWallTimeLimitFactor
 }
 
 func (p *Problem) FetchSamples() {
@@ -146,7 +157,10 @@ func (p *Problem) FetchWriter() {
 }
 
 func (p *Problem) FetchCaseSets() {
-	db.Model(p).Related(&p.CaseSets)
+	db.Order("id ASC").Model(p).Related(&p.CaseSets)
+	for i := range p.CaseSets {
+		p.CaseSets[i].FetchDependencies()
+	}
 }
 
 func (p *Problem) FetchSubmissions() {
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/pkg/errors"
+)
+
+var ErrAlreadyInQueue = errors.New("submission is already in queue or judging")
+
+// リジャッジする提出の条件。0やnilのものは条件にしない。
+// キューに入っているかジャッジ中の提出は含めない
+type RejudgeFilter struct {
+	ProblemID  uint              `json:"problemID"`
+	ContestID  uint              `json:"contestID"`
+	UserID     uint              `json:"userID"`
+	LanguageID uint              `json:"languageID"`
+	Statuses   []JudgementStatus `json:"statuses"`
+	// 提出日時がSince以降、Untilより前のもの
+	Since *time.Time `json:"since"`
+	Until *time.Time `json:"until"`
+}
+
+func (f *RejudgeFilter) FindSubmissions() ([]Submission, error) {
+	query := db.Where("status NOT IN (?)", []JudgementStatus{StatusInQueue, StatusJudging})
+	if f.ProblemID != 0 {
+		query = query.Where("problem_id = ?", f.ProblemID)
+	}
+	if f.ContestID != 0 {
+		query = query.Where("contest_id = ?", f.ContestID)
+	}
+	if f.UserID != 0 {
+		query = query.Where("user_id = ?", f.UserID)
+	}
+	if f.LanguageID != 0 {
+		query = query.Where("language_id = ?", f.LanguageID)
+	}
+	if len(f.Statuses) != 0 {
+		query = query.Where("status IN (?)", f.Statuses)
+	}
+	if f.Since != nil {
+		query = query.Where("created_at >= ?", *f.Since)
+	}
+	if f.Until != nil {
+		query = query.Where("created_at < ?", *f.Until)
+	}
+
+	submissions := make([]Submission, 0)
+	if err := query.Order("id ASC").Find(&submissions).Error; err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+		return nil, err
+	}
+	return submissions, nil
+}
+
+// 1つの提出をリジャッジする
+func (s *Submission) Rejudge() error {
+	if s.IsPending() {
+		return ErrAlreadyInQueue
+	}
+	return s.rejudge()
+}
+
+// 提出をリジャッジのキューに入れるのは時間がかかるので、裏で行う。
+// 返したIDでまとめてキャンセルできる
+func RejudgeSubmissions(submissions []Submission) (string, error) {
+	problemIDs := make([]uint, 0)
+	seen := make(map[uint]bool)
+	for _, s := range submissions {
+		if !seen[s.ProblemID] {
+			seen[s.ProblemID] = true
+			problemIDs = append(problemIDs, s.ProblemID)
+		}
+	}
+
+	batchID, err := newRejudgeBatch(problemIDs)
+	if err != nil {
+		return "", err
+	}
+
+	go func() {
+		defer finishRejudgeBatch(batchID, problemIDs)
+
+		for i := range submissions {
+			s := &submissions[i]
+			if isRejudgeBatchCancelled(batchID) {
+				return
+			}
+			if err := addToRejudgeBatch(batchID, s.ID); err != nil {
+				return
+			}
+			if err := s.rejudge(); err != nil {
+				logger.AppLog.Errorf("error: %+v", err)
+				return
+			}
+			// キャンセルされたときにまだまとまりに入っていなかったかもしれないので、ここでも止める
+			if isRejudgeBatchCancelled(batchID) {
+				cancelSubmissions([]Submission{*s})
+				return
+			}
+		}
+	}()
+
+	return batchID, nil
+}
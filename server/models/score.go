@@ -3,6 +3,7 @@ package models
 import (
 	"time"
 
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
 	"github.com/jinzhu/gorm"
 )
 
@@ -28,50 +29,131 @@ func newScore(userID, contestID uint, tx *gorm.DB) *Score {
 	return s
 }
 
-func updateScore(submission *Submission, contestID uint) {
-	// TODO コンテスト開始時間を変更したあとにリジャッジすると、合計点がバグる
-	s := &Score{}
-	db.Where("user_id = ? AND contest_id = ?", submission.UserID, contestID).First(s)
+// 得点に数えない、提出の内容によらない結果
+var unscoredStatuses = []JudgementStatus{StatusInQueue, StatusJudging, StatusCancelled, StatusUnknownError}
 
-	d := &ScoreDetail{}
-	found := !db.Where("score_id = ? AND problem_id = ?", s.ID, submission.ProblemID).First(d).RecordNotFound()
+// ユーザーのその問題への提出をすべて見直して、得点の詳細を計算し直す。
+// リジャッジで結果が変わっても、ほかの問題の得点の詳細はそのまま使う
+func updateScore(userID, problemID, contestID uint) error {
+	c := GetContest(contestID)
+	if c == nil {
+		return nil
+	}
+	writer, err := c.IsWriter(userID)
+	if err != nil {
+		logger.AppLog.Errorf("error %+v", err)
+		return err
+	}
+	if writer {
+		return nil
+	}
 
-	if found && submission.Point <= d.Point && d.Accepted {
-		return
+	s := &Score{}
+	if db.Where("user_id = ? AND contest_id = ?", userID, contestID).First(s).RecordNotFound() {
+		return nil
 	}
-	if submission.IsWrong() {
-		d.WrongCount += 1
+
+	submissions := make([]Submission, 0)
+	err = db.Where("user_id = ? AND problem_id = ? AND status NOT IN (?)", userID, problemID, unscoredStatuses).
+		Order("created_at ASC, id ASC").Find(&submissions).Error
+	if err != nil {
+		logger.AppLog.Errorf("error %+v", err)
+		return err
 	}
-	ac := submission.Status == StatusAccepted
-	if found {
-		newPoint := MaxInt(d.Point, submission.Point)
-		if d.Point < submission.Point {
-			d.UpdatedAt = submission.CreatedAt
+	session := &UserSession{UserID: userID}
+	scored := make([]Submission, 0, len(submissions))
+	for _, sub := range submissions {
+		open, err := c.IsOpen(sub.CreatedAt, session)
+		if err != nil {
+			logger.AppLog.Errorf("error %+v", err)
+			return err
+		}
+		if open {
+			scored = append(scored, sub)
 		}
-		db.Model(d).UpdateColumns(map[string]interface{}{
-			"updated_at":  d.UpdatedAt,
-			"point":       newPoint,
-			"wrong_count": d.WrongCount,
-			"accepted":    ac,
-		})
-	} else {
-		newScoreDetail(s, submission, d.WrongCount, db)
 	}
 
-	s.FetchDetails()
-	s.Point = 0
-	for _, d := range s.ScoreDetails {
-		pt := d.Point
-		if pt <= 0 {
+	tx := db.Begin()
+	if err := tx.Delete(ScoreDetail{}, "score_id = ? AND problem_id = ?", s.ID, problemID).Error; err != nil {
+		logger.AppLog.Errorf("error %+v", err)
+		tx.Rollback()
+		return err
+	}
+	if d, ok := replayScoreDetail(scored); ok {
+		d.ScoreID = s.ID
+		d.ProblemID = problemID
+		if err := createScoreDetail(&d, tx); err != nil {
+			logger.AppLog.Errorf("error %+v", err)
+			tx.Rollback()
+			return err
+		}
+	}
+
+	details := make([]ScoreDetail, 0)
+	if err := tx.Where("score_id = ?", s.ID).Find(&details).Error; err != nil {
+		logger.AppLog.Errorf("error %+v", err)
+		tx.Rollback()
+		return err
+	}
+	s.Point, s.UpdatedAt = sumScoreDetails(s.CreatedAt, details)
+	err = tx.Model(s).UpdateColumns(map[string]interface{}{"point": s.Point, "updated_at": s.UpdatedAt}).Error
+	if err != nil {
+		logger.AppLog.Errorf("error %+v", err)
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		logger.AppLog.Errorf("error %+v", err)
+		return err
+	}
+
+	publishStandingsEvent(contestID, userID, problemID, s.Point)
+	return nil
+}
+
+// 提出された順に並んだ提出から得点の詳細を求める。満点を取ったあとの提出は数えない。
+// 得点に数える提出がひとつもなければfalseを返す
+func replayScoreDetail(submissions []Submission) (ScoreDetail, bool) {
+	d := ScoreDetail{}
+	found := false
+	for i := range submissions {
+		sub := &submissions[i]
+		if found && sub.Point <= d.Point && d.Accepted {
+			continue
+		}
+		if sub.IsWrong() {
+			d.WrongCount++
+		}
+		d.Accepted = sub.Status == StatusAccepted
+		if !found {
+			d.Point = sub.Point
+			d.CreatedAt = sub.CreatedAt
+			d.UpdatedAt = sub.CreatedAt
+			found = true
 			continue
 		}
-		s.Point += pt
-		if s.UpdatedAt.Before(d.UpdatedAt) {
-			s.UpdatedAt = d.UpdatedAt
+		if d.Point < sub.Point {
+			d.Point = sub.Point
+			d.UpdatedAt = sub.CreatedAt
 		}
 	}
+	return d, found
+}
 
-	db.Model(s).UpdateColumns(map[string]interface{}{"point": s.Point, "updated_at": s.UpdatedAt})
+// 合計点と、最後に点数が増えた時刻を返す。点数がなければsinceを返す
+func sumScoreDetails(since time.Time, details []ScoreDetail) (int, time.Time) {
+	point := 0
+	updatedAt := since
+	for _, d := range details {
+		if d.Point <= 0 {
+			continue
+		}
+		point += d.Point
+		if updatedAt.Before(d.UpdatedAt) {
+			updatedAt = d.UpdatedAt
+		}
+	}
+	return point, updatedAt
 }
 
 func (s *Score) FetchDetails() {
@@ -18,23 +18,14 @@ type ScoreDetail struct {
 	ScoreTime  time.Duration `gorm:"-" json:"scoreTime"`
 }
 
-func newScoreDetail(score *Score, submission *Submission, wrongCount int, tx *gorm.DB) *ScoreDetail {
-	d := &ScoreDetail{
-		Point:      submission.Point,
-		WrongCount: wrongCount,
-		Accepted:   submission.Status == StatusAccepted,
-		ScoreID:    score.ID,
-		ProblemID:  submission.ProblemID,
+// 作成日時と更新日時は、得点に数えた提出の日時にする
+func createScoreDetail(d *ScoreDetail, tx *gorm.DB) error {
+	createdAt, updatedAt := d.CreatedAt, d.UpdatedAt
+	if err := tx.Create(d).Error; err != nil {
+		return err
 	}
-	tx.Create(d)
-	tx.Model(d).UpdateColumns(map[string]interface{}{
-		"created_at": submission.CreatedAt,
-		"updated_at": submission.CreatedAt,
-	})
-
-	return d
-}
-
-func deleteScoreDetails(problemID uint) {
-	db.Delete(ScoreDetail{}, "problem_id = ?", problemID)
+	return tx.Model(d).UpdateColumns(map[string]interface{}{
+		"created_at": createdAt,
+		"updated_at": updatedAt,
+	}).Error
 }
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayScoreDetail(t *testing.T) {
+	at := func(min int) time.Time {
+		return time.Date(2018, 1, 1, 12, min, 0, 0, time.Local)
+	}
+	inputs := [][]Submission{
+		{},
+		{
+			{Status: StatusWrongAnswer, Point: 0, CreatedAt: at(1)},
+			{Status: StatusAccepted, Point: 100, CreatedAt: at(2)},
+		},
+		{
+			{Status: StatusAccepted, Point: 100, CreatedAt: at(1)},
+			{Status: StatusWrongAnswer, Point: 0, CreatedAt: at(2)},
+			{Status: StatusAccepted, Point: 100, CreatedAt: at(3)},
+		},
+		{
+			{Status: StatusWrongAnswer, Point: 30, CreatedAt: at(1)},
+			{Status: StatusCompileError, Point: 0, CreatedAt: at(2)},
+			{Status: StatusTimeLimitExceeded, Point: 20, CreatedAt: at(3)},
+			{Status: StatusWrongAnswer, Point: 50, CreatedAt: at(4)},
+		},
+	}
+	outputs := []struct {
+		Detail ScoreDetail
+		Found  bool
+	}{
+		{ScoreDetail{}, false},
+		{ScoreDetail{Point: 100, WrongCount: 1, Accepted: true, CreatedAt: at(1), UpdatedAt: at(2)}, true},
+		{ScoreDetail{Point: 100, WrongCount: 0, Accepted: true, CreatedAt: at(1), UpdatedAt: at(1)}, true},
+		{ScoreDetail{Point: 50, WrongCount: 3, Accepted: false, CreatedAt: at(1), UpdatedAt: at(4)}, true},
+	}
+
+	for i, in := range inputs {
+		d, found := replayScoreDetail(in)
+		if d != outputs[i].Detail || found != outputs[i].Found {
+			t.Errorf("error on test case #%v: %+v %v", i, d, found)
+		}
+	}
+}
+
+func TestSumScoreDetails(t *testing.T) {
+	since := time.Date(2018, 1, 1, 12, 0, 0, 0, time.Local)
+	inputs := [][]ScoreDetail{
+		{},
+		{
+			{Point: 100, UpdatedAt: since.Add(10 * time.Minute)},
+			{Point: 0, UpdatedAt: since.Add(30 * time.Minute)},
+			{Point: 50, UpdatedAt: since.Add(20 * time.Minute)},
+		},
+	}
+	outputs := []struct {
+		Point     int
+		UpdatedAt time.Time
+	}{
+		{0, since},
+		{150, since.Add(20 * time.Minute)},
+	}
+
+	for i, in := range inputs {
+		p, u := sumScoreDetails(since, in)
+		if p != outputs[i].Point || !u.Equal(outputs[i].UpdatedAt) {
+			t.Errorf("error on test case #%v", i)
+		}
+	}
+}
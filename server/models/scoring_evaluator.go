@@ -0,0 +1,88 @@
+package models
+
+import (
+	"math"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
+)
+
+// ケースセットの評価器を包んで、ScoringPolicyに従って点数を付け直す
+type scoringCaseSetEvaluator struct {
+	inner    caseSetEvaluator
+	policy   ScoringPolicy
+	setPoint int
+	total    int
+	accepted int
+	// テストケースごとの点数 (0以上1以下) のうち最小のもの
+	minScore float64
+	// 依存しているケースセットがACでないときは、点数を0にする
+	dependencyFailed bool
+}
+
+func newScoringCaseSetEvaluator(set *CaseSet, inner caseSetEvaluator) *scoringCaseSetEvaluator {
+	return &scoringCaseSetEvaluator{
+		inner:    inner,
+		policy:   set.ScoringPolicy,
+		setPoint: set.Point,
+		minScore: 1,
+	}
+}
+
+func (e *scoringCaseSetEvaluator) next(res *workers.ExecResult, testCase *TestCase) (JudgementStatus, int) {
+	st, pt := e.inner.next(res, testCase)
+
+	score := 0.0
+	if st == StatusAccepted {
+		e.accepted++
+		score = 1
+		if s, ok := e.inner.(scoredCaseSetEvaluator); ok {
+			score = s.caseScore()
+		}
+	}
+	e.total++
+	e.minScore = math.Min(e.minScore, score)
+
+	return st, pt
+}
+
+func (e *scoringCaseSetEvaluator) evaluate() (JudgementStatus, int) {
+	st, pt := e.inner.evaluate()
+	if e.dependencyFailed {
+		return st, 0
+	}
+
+	switch e.policy {
+	case ScoringPolicyProportional, ScoringPolicyMinScore:
+		// テストケースが1つもなければ、minScoreは初期値の1のままなので0点にする
+		if e.total == 0 {
+			return st, 0
+		}
+		if e.policy == ScoringPolicyProportional {
+			return st, e.setPoint * e.accepted / e.total
+		}
+		return st, int(math.Round(float64(e.setPoint) * e.minScore))
+	default:
+		return st, pt
+	}
+}
+
+func (e *scoringCaseSetEvaluator) prepare(results []*workers.ExecResult, testCases []*TestCase) {
+	if b, ok := e.inner.(batchCaseSetEvaluator); ok {
+		b.prepare(results, testCases)
+	}
+}
+
+func (e *scoringCaseSetEvaluator) caseFeedback() string {
+	if f, ok := e.inner.(feedbackCaseSetEvaluator); ok {
+		return f.caseFeedback()
+	}
+	return ""
+}
+
+// 点数を0以上1以下に収めて、setPointに対する割合にする
+func toCaseScore(point, setPoint int) float64 {
+	if setPoint <= 0 {
+		return 1
+	}
+	return math.Max(0, math.Min(1, float64(point)/float64(setPoint)))
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
+)
+
+// テストケースごとに決まった結果と点数 (0以上1以下) を順番に返すケースセットの評価器
+type scoredStubCaseSetEvaluator struct {
+	statuses []JudgementStatus
+	scores   []float64
+	index    int
+}
+
+func (e *scoredStubCaseSetEvaluator) next(res *workers.ExecResult, testCase *TestCase) (JudgementStatus, int) {
+	e.index++
+	return e.statuses[e.index-1], 0
+}
+
+func (e *scoredStubCaseSetEvaluator) evaluate() (JudgementStatus, int) {
+	return StatusAccepted, 100
+}
+
+func (e *scoredStubCaseSetEvaluator) caseScore() float64 {
+	return e.scores[e.index-1]
+}
+
+func TestScoringCaseSetEvaluator(t *testing.T) {
+	inputs := []struct {
+		Policy   ScoringPolicy
+		Statuses []JudgementStatus
+		Scores   []float64
+	}{
+		{ScoringPolicyProportional, nil, nil},
+		{ScoringPolicyMinScore, nil, nil},
+		{ScoringPolicyProportional, []JudgementStatus{StatusAccepted, StatusWrongAnswer, StatusAccepted}, []float64{1, 0, 1}},
+		{ScoringPolicyMinScore, []JudgementStatus{StatusAccepted}, []float64{0.29}},
+		{ScoringPolicyMinScore, []JudgementStatus{StatusAccepted, StatusAccepted}, []float64{1, 0.5}},
+		{ScoringPolicyMinScore, []JudgementStatus{StatusAccepted, StatusWrongAnswer}, []float64{1, 1}},
+		{ScoringPolicyAllOrNothing, []JudgementStatus{StatusAccepted}, []float64{0.5}},
+	}
+	outputs := []int{
+		0,
+		0,
+		66,
+		29,
+		50,
+		0,
+		100,
+	}
+
+	for i, in := range inputs {
+		set := &CaseSet{Point: 100, ScoringPolicy: in.Policy}
+		e := newScoringCaseSetEvaluator(set, &scoredStubCaseSetEvaluator{statuses: in.Statuses, scores: in.Scores})
+		for range in.Statuses {
+			e.next(nil, nil)
+		}
+		if _, p := e.evaluate(); p != outputs[i] {
+			t.Errorf("error on test case #%v: %v", i, p)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"sort"
 	"strings"
 
 	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
@@ -10,33 +11,64 @@ type simpleEvaluator struct {
 	point    int
 	statuses map[JudgementStatus]int
 	lastSet  caseSetEvaluator
+	// lastSetで評価しているケースセット
+	lastCaseSet *CaseSet
+	// 評価し終わったケースセットごとの結果
+	setStatuses map[uint]JudgementStatus
+	// 出力の比較方法。nilのときは完全一致で比較する
+	config *JudgementConfig
 }
 
 func newSimpleEvaluator() *simpleEvaluator {
 	return &simpleEvaluator{
-		statuses: map[JudgementStatus]int{},
+		statuses:    map[JudgementStatus]int{},
+		setStatuses: map[uint]JudgementStatus{},
 	}
 }
 
+// 通常のジャッジ用。configの設定で出力を比較する
+func newNormalEvaluator(config *JudgementConfig) *simpleEvaluator {
+	e := newSimpleEvaluator()
+	e.config = config
+	return e
+}
+
 func (e *simpleEvaluator) next(set *CaseSet, factory func(set *CaseSet) caseSetEvaluator) caseSetEvaluator {
 	if e.lastSet != nil {
+		// 依存しているケースセットがACでなければ、ケースセットの結果の点数も0になっている
 		st, pt := e.lastSet.evaluate()
 		e.point += pt
 		e.statuses[st]++
+		e.setStatuses[e.lastCaseSet.ID] = st
 	}
 
 	if set == nil {
 		return nil
 	}
 
+	var inner caseSetEvaluator
 	if factory == nil {
-		e.lastSet = newSimpleCaseSetEvaluator(set)
+		inner = newSimpleCaseSetEvaluator(set, e.config)
 	} else {
-		e.lastSet = factory(set)
+		inner = factory(set)
 	}
+	scoring := newScoringCaseSetEvaluator(set, inner)
+	scoring.dependencyFailed = !e.dependenciesAccepted(set)
+	e.lastSet = scoring
+	e.lastCaseSet = set
 	return e.lastSet
 }
 
+// 依存しているケースセットがすべてACなら、このケースセットの点数が入る
+func (e *simpleEvaluator) dependenciesAccepted(set *CaseSet) bool {
+	for _, d := range set.Dependencies {
+		if st, ok := e.setStatuses[d]; !ok || st != StatusAccepted {
+			return false
+		}
+	}
+	return true
+}
+
 func (e *simpleEvaluator) evaluate() (JudgementStatus, int) {
 	if e.lastSet == nil {
 		return StatusUnknownError, 0
@@ -52,12 +84,14 @@ func (e *simpleEvaluator) remove() {}
 type simpleCaseSetEvaluator struct {
 	setPoint int
 	statuses map[JudgementStatus]int
+	config   *JudgementConfig
 }
 
-func newSimpleCaseSetEvaluator(set *CaseSet) *simpleCaseSetEvaluator {
+func newSimpleCaseSetEvaluator(set *CaseSet, config *JudgementConfig) *simpleCaseSetEvaluator {
 	return &simpleCaseSetEvaluator{
 		setPoint: set.Point,
 		statuses: map[JudgementStatus]int{},
+		config:   config,
 	}
 }
 
@@ -72,7 +106,7 @@ func (e *simpleCaseSetEvaluator) next(res *workers.ExecResult, testCase *TestCas
 			return toJudgementStatus(res.Status)
 		}
 
-		if res.Stdout == testCase.Output {
+		if compareOutputs(e.config, res.Stdout, testCase.Output) {
 			return StatusAccepted
 		}
 		if strings.TrimSpace(res.Stdout) == strings.TrimSpace(testCase.Output) {
@@ -92,3 +126,65 @@ func (e *simpleCaseSetEvaluator) evaluate() (JudgementStatus, int) {
 	}
 	return st, 0
 }
+
+// configで設定された方法で、提出の出力と想定解が一致するかを調べる
+func compareOutputs(config *JudgementConfig, output, answer string) bool {
+	if output == answer {
+		return true
+	}
+	if config == nil {
+		return false
+	}
+
+	if config.CaseInsensitive {
+		output = strings.ToLower(output)
+		answer = strings.ToLower(answer)
+	}
+
+	o := splitOutput(config, output)
+	a := splitOutput(config, answer)
+	if config.UnorderedLines {
+		sort.Strings(o)
+		sort.Strings(a)
+	}
+
+	if len(o) != len(a) {
+		return false
+	}
+	for i := range o {
+		if o[i] != a[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 比較の単位 (トークンか行) に分ける
+func splitOutput(config *JudgementConfig, s string) []string {
+	if config.TokenWise && !config.UnorderedLines {
+		return strings.Fields(s)
+	}
+
+	lines := strings.Split(s, "\n")
+	res := make([]string, 0, len(lines))
+	for _, l := range lines {
+		switch {
+		case config.TokenWise:
+			// 行の中のトークンの列として比較するので、空行は無視する
+			l = strings.Join(strings.Fields(l), " ")
+			if l == "" {
+				continue
+			}
+		case config.IgnoreTrailingSpaces:
+			l = strings.TrimRight(l, " \t\r")
+		}
+		res = append(res, l)
+	}
+
+	if config.IgnoreTrailingSpaces || config.UnorderedLines {
+		for 0 < len(res) && res[len(res)-1] == "" {
+			res = res[:len(res)-1]
+		}
+	}
+	return res
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
+)
+
+func TestCompareOutputs(t *testing.T) {
+	inputs := []struct {
+		Config         *JudgementConfig
+		Output, Answer string
+	}{
+		{nil, "1 2\n", "1 2\n"},
+		{nil, "1 2 \n", "1 2\n"},
+		{&JudgementConfig{}, "1 2\n", "1  2\n"},
+		{&JudgementConfig{TokenWise: true}, "1  2\n3\n\n", "1 2 3\n"},
+		{&JudgementConfig{TokenWise: true}, "1 2\n", "1 3\n"},
+		{&JudgementConfig{IgnoreTrailingSpaces: true}, "1 2  \n3\t\n\n", "1 2\n3\n"},
+		{&JudgementConfig{IgnoreTrailingSpaces: true}, " 1 2\n", "1 2\n"},
+		{&JudgementConfig{CaseInsensitive: true}, "Yes\n", "YES\n"},
+		{&JudgementConfig{CaseInsensitive: true}, "Yes \n", "YES\n"},
+		{&JudgementConfig{UnorderedLines: true}, "b\na\nc\n", "a\nb\nc\n"},
+		{&JudgementConfig{UnorderedLines: true}, "b\na\n", "a\nb\nb\n"},
+		{&JudgementConfig{UnorderedLines: true, TokenWise: true}, "2  1\n\n1 2\n", "1 2\n2 1\n"},
+		{&JudgementConfig{UnorderedLines: true, TokenWise: true}, "1 2\n", "2 1\n"},
+	}
+	outputs := []bool{
+		true,
+		false,
+		false,
+		true,
+		false,
+		true,
+		false,
+		true,
+		false,
+		true,
+		false,
+		true,
+		false,
+	}
+
+	for i, in := range inputs {
+		if compareOutputs(in.Config, in.Output, in.Answer) != outputs[i] {
+			t.Errorf("error on test case #%v", i)
+		}
+	}
+}
+
+// テストケースの実行結果によらず、決まった結果を返すケースセットの評価器
+type fixedCaseSetEvaluator struct {
+	status JudgementStatus
+	point  int
+}
+
+func (e fixedCaseSetEvaluator) next(res *workers.ExecResult, testCase *TestCase) (JudgementStatus, int) {
+	return e.status, e.point
+}
+
+func (e fixedCaseSetEvaluator) evaluate() (JudgementStatus, int) {
+	return e.status, e.point
+}
+
+func TestSimpleEvaluatorDependencies(t *testing.T) {
+	sets := []CaseSet{
+		{ID: 1, Point: 10},
+		{ID: 2, Point: 20, Dependencies: []uint{1}},
+		{ID: 3, Point: 30},
+	}
+	inputs := [][]JudgementStatus{
+		{StatusAccepted, StatusAccepted, StatusAccepted},
+		{StatusWrongAnswer, StatusAccepted, StatusAccepted},
+	}
+	outputs := []struct {
+		SetPoints []int
+		Point     int
+	}{
+		{[]int{10, 20, 30}, 60},
+		{[]int{0, 0, 30}, 30},
+	}
+
+	for i, in := range inputs {
+		e := newSimpleEvaluator()
+		for k := range sets {
+			st := in[k]
+			pt := 0
+			if st == StatusAccepted {
+				pt = sets[k].Point
+			}
+			setEval := e.next(&sets[k], func(set *CaseSet) caseSetEvaluator {
+				return fixedCaseSetEvaluator{st, pt}
+			})
+			if _, p := setEval.evaluate(); p != outputs[i].SetPoints[k] {
+				t.Errorf("error on test case #%v, set #%v: %v", i, k, p)
+			}
+		}
+		if _, p := e.evaluate(); p != outputs[i].Point {
+			t.Errorf("error on test case #%v: %v", i, p)
+		}
+	}
+}
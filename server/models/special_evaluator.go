@@ -1,10 +1,13 @@
 package models
 
 import (
+	"math"
+	"os"
 	"strconv"
 	"strings"
 
 	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/testdata"
 	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
 )
 
@@ -17,17 +20,16 @@ func (e ErrJudgeSourceCodeCompile) Error() string {
 }
 
 type specialEvaluator struct {
-	verifier   *workers.Worker
+	verifier   *compiledProgram
 	simple     *simpleEvaluator
 	config     *JudgementConfig
 	submission *Submission
 }
 
 func newSpecialEvaluator(config *JudgementConfig, submission *Submission) (specialEvaluator, error) {
-	config.FetchLanguage()
-	compiled, compileRes := compile(*config.JudgeSourceCode, config.Language)
+	compiled, compileRes := compile(*config.JudgeSourceCode, config.Language, true)
 	if compiled == nil || compileRes == nil {
-		return specialEvaluator{}, ErrJudgeSourceCodeCompile{"unknown (｡>﹏<｡)"}
+		return specialEvaluator{}, ErrTransientJudgement
 	}
 	if compileRes.Status != workers.StatusFinished {
 		return specialEvaluator{}, ErrJudgeSourceCodeCompile{compileRes.Stderr}
@@ -57,24 +59,29 @@ func (e specialEvaluator) evaluate() (JudgementStatus, int) {
 	return e.simple.evaluate()
 }
 
-func (e specialEvaluator) remove() {
-	if e.verifier != nil {
-		e.verifier.Remove()
-	}
-}
+func (e specialEvaluator) remove() {}
 
 type specialCaseSetEvaluator struct {
-	point      int
-	setPoint   int
+	point    int
+	setPoint int
+	// testlibのチェッカーの点数 (0以上1以下) のうち最小のもの
+	score    float64
+	feedback string
+	// 直前のテストケースの点数 (0以上1以下)
+	lastScore float64
+	// テストケースごとのチェッカーの実行結果
+	judged     []*workers.ExecResult
+	index      int
 	statuses   map[JudgementStatus]int
-	verifier   *workers.Worker
+	verifier   *compiledProgram
 	config     *JudgementConfig
 	submission *Submission
 }
 
-func newSpecialCaseSetEvaluator(set *CaseSet, verifier *workers.Worker, config *JudgementConfig, submission *Submission) *specialCaseSetEvaluator {
+func newSpecialCaseSetEvaluator(set *CaseSet, verifier *compiledProgram, config *JudgementConfig, submission *Submission) *specialCaseSetEvaluator {
 	return &specialCaseSetEvaluator{
 		setPoint:   set.Point,
+		score:      1,
 		statuses:   map[JudgementStatus]int{},
 		verifier:   verifier,
 		config:     config,
@@ -82,42 +89,56 @@ func newSpecialCaseSetEvaluator(set *CaseSet, verifier *workers.Worker, config *
 	}
 }
 
+// 正常に終了したテストケースだけを集めて、1つのコンテナでまとめてチェッカーを実行する
+func (e *specialCaseSetEvaluator) prepare(results []*workers.ExecResult, testCases []*TestCase) {
+	e.judged = make([]*workers.ExecResult, len(results))
+
+	targets := make([]int, 0, len(results))
+	for i, res := range results {
+		if res != nil && res.Status == workers.StatusFinished {
+			targets = append(targets, i)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	judged, err := e.runChecker(results, testCases, targets)
+	if err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+		return
+	}
+	for k, i := range targets {
+		e.judged[i] = judged[k]
+	}
+}
+
 func (e *specialCaseSetEvaluator) next(res *workers.ExecResult, testCase *TestCase) (JudgementStatus, int) {
+	e.feedback = ""
+	e.lastScore = 0
+	i := e.index
+	e.index++
+
 	st, pt := func() (JudgementStatus, int) {
+		if res == nil {
+			return StatusUnknownError, 0
+		}
 		if res.Status != workers.StatusFinished {
 			return toJudgementStatus(res.Status), 0
 		}
-
-		l := e.submission.Language
-		const (
-			input      = "in"
-			output     = "out"
-			userOutput = "submission"
-		)
-		cmd := append(e.config.Language.GetExecCommandSlice(), input, output, userOutput, l.FileName)
-		w, err := workers.NewTimeoutWorker(imageNamePrefix+e.config.Language.ImageName, compileTimeLimit, compileMemoryLimit, cmd)
-		if err != nil {
-			logger.AppLog.Errorf("error: %+v", err)
+		if len(e.judged) <= i || e.judged[i] == nil {
 			return StatusUnknownError, 0
 		}
-		defer w.Remove()
-
-		e.verifier.CopyTo(workers.Workspace+e.config.Language.ExeFileName, w)
-
-		w.CopyContentToContainer([]byte(testCase.Input), workers.Workspace+input)
-		w.CopyContentToContainer([]byte(testCase.Output), workers.Workspace+output)
-		w.CopyContentToContainer([]byte(res.Stdout), workers.Workspace+userOutput)
-		w.CopyContentToContainer([]byte(e.submission.SourceCode), workers.Workspace+l.FileName)
 
-		judged, err := w.Run("", true)
-		if err != nil {
-			logger.AppLog.Errorf("error: %+v", err)
-			return StatusUnknownError, 0
+		judged := e.judged[i]
+		if e.config.CheckerProtocol == CheckerProtocolTestlib {
+			return e.evaluateTestlib(judged)
 		}
 
 		point, _ := strconv.Atoi(strings.TrimSpace(judged.Stdout))
 		if judged.Status == workers.StatusFinished {
 			e.point += point
+			e.lastScore = toCaseScore(point, e.setPoint)
 			return StatusAccepted, e.point
 		}
 		return StatusWrongAnswer, 0
@@ -127,10 +148,171 @@ func (e *specialCaseSetEvaluator) next(res *workers.ExecResult, testCase *TestCa
 	return st, pt
 }
 
+func (e *specialCaseSetEvaluator) runChecker(results []*workers.ExecResult, testCases []*TestCase, targets []int) ([]*workers.ExecResult, error) {
+	l := e.submission.Language
+	// 出力だけを提出する問題への提出には言語がないので、ソースコードは渡さない。
+	// ジャッジノードではLanguageIDが送られてこないので、言語の中身で確かめる
+	hasSource := l.FileName != ""
+	cmd := e.config.Language.GetExecCommandSlice()
+	if e.config.CheckerProtocol == CheckerProtocolTestlib {
+		cmd = append(cmd, workers.CheckerInputPlaceholder, workers.CheckerOutputPlaceholder, workers.CheckerAnswerPlaceholder)
+	} else {
+		cmd = append(cmd, workers.CheckerInputPlaceholder, workers.CheckerAnswerPlaceholder, workers.CheckerOutputPlaceholder)
+		if hasSource {
+			cmd = append(cmd, l.FileName)
+		}
+	}
+	w, err := workers.NewCheckerWorker(imageNamePrefix+e.config.Language.ImageName, compileTimeLimit, compileMemoryLimit, judgeParallelism(), cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Remove()
+
+	const (
+		checkerDir    = "/checker/"
+		inputDir      = "/input/"
+		answerDir     = "/answer/"
+		submissionDir = "/submission/"
+	)
+	for _, d := range []string{checkerDir, inputDir, answerDir, submissionDir} {
+		if err := os.Mkdir(w.HostJudgeDataDir+d, 0700); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeFile(w.HostJudgeDataDir+checkerDir+e.config.Language.ExeFileName, string(e.verifier.exe), 0755); err != nil {
+		return nil, err
+	}
+	if hasSource {
+		if err := writeFile(w.HostJudgeDataDir+checkerDir+l.FileName, e.submission.SourceCode, 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	// runnerは0から順番に実行するので、対象のテストケースだけを詰めて書き込む
+	for k, i := range targets {
+		name := strconv.Itoa(k)
+		if err := testdata.Copy(testCases[i].InputHash, w.HostJudgeDataDir+inputDir+name); err != nil {
+			return nil, err
+		}
+		if err := testdata.Copy(testCases[i].OutputHash, w.HostJudgeDataDir+answerDir+name); err != nil {
+			return nil, err
+		}
+		if err := writeFile(w.HostJudgeDataDir+submissionDir+name, results[i].Stdout, 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := w.Run("", false); err != nil {
+		return nil, err
+	}
+
+	p, err := workers.NewExecResultParser(w)
+	if err != nil {
+		return nil, err
+	}
+	judged := make([]*workers.ExecResult, 0, len(targets))
+	for {
+		_, res, err := p.Next()
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			break
+		}
+		judged = append(judged, res)
+	}
+	if len(judged) != len(targets) {
+		return nil, ErrParseOutput
+	}
+
+	return judged, nil
+}
+
+// testlibの終了コード
+const (
+	testlibExitOK              = 0
+	testlibExitWrongAnswer     = 1
+	testlibExitPresentation    = 2
+	testlibExitFail            = 3
+	testlibExitPartialScore    = 7
+	checkerFeedbackLengthLimit = workers.CaseStderrLimit
+)
+
+func (e *specialCaseSetEvaluator) evaluateTestlib(judged *workers.ExecResult) (JudgementStatus, int) {
+	e.feedback = truncateString(strings.TrimSpace(judged.Stderr), checkerFeedbackLengthLimit)
+
+	switch judged.Status {
+	case workers.StatusFinished, workers.StatusRuntimeError:
+	default:
+		// チェッカー自体がTLEやMLEになったときはジャッジの失敗
+		logger.AppLog.Errorf("checker failed: %+v", judged)
+		return StatusUnknownError, 0
+	}
+
+	switch judged.ExitStatus {
+	case testlibExitOK:
+		e.lastScore = 1
+		return StatusAccepted, 0
+	case testlibExitWrongAnswer:
+		return StatusWrongAnswer, 0
+	case testlibExitPresentation:
+		return StatusPresentationError, 0
+	case testlibExitFail:
+		// チェッカーが答えの誤りなどを見つけたときは、提出ではなくジャッジの失敗
+		logger.AppLog.Errorf("checker reported a failure: %+v", judged)
+		return StatusUnknownError, 0
+	case testlibExitPartialScore:
+		score, ok := parseTestlibScore(judged.Stderr)
+		if !ok {
+			logger.AppLog.Errorf("invalid partial score: %v", judged.Stderr)
+			return StatusUnknownError, 0
+		}
+		if score <= 0 {
+			return StatusWrongAnswer, 0
+		}
+		e.score = math.Min(e.score, score)
+		e.lastScore = score
+		return StatusAccepted, 0
+	default:
+		logger.AppLog.Errorf("checker failed: %+v", judged)
+		return StatusUnknownError, 0
+	}
+}
+
+// quitpのメッセージは`points 0.5 message`か`0.5 message`の形式になっている。
+// 点数はケースセットの配点に対する割合として扱うので、0以上1以下でなければ失敗にする
+func parseTestlibScore(message string) (float64, bool) {
+	fields := strings.Fields(message)
+	if 0 < len(fields) && fields[0] == "points" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return 0, false
+	}
+
+	score, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || math.IsNaN(score) || score < 0 || 1 < score {
+		return 0, false
+	}
+	return score, true
+}
+
 func (e *specialCaseSetEvaluator) evaluate() (JudgementStatus, int) {
 	st := evaluateStatuses(e.statuses)
-	if st == StatusAccepted {
-		return st, MinInt(e.point, e.setPoint)
+	if st != StatusAccepted {
+		return st, 0
+	}
+	if e.config.CheckerProtocol == CheckerProtocolTestlib {
+		// 0.29 * 100 が 28.999... になるので、切り捨てずに丸める
+		return st, int(math.Round(float64(e.setPoint) * e.score))
 	}
-	return st, 0
+	return st, MinInt(e.point, e.setPoint)
+}
+
+func (e *specialCaseSetEvaluator) caseFeedback() string {
+	return e.feedback
+}
+
+func (e *specialCaseSetEvaluator) caseScore() float64 {
+	return e.lastScore
 }
@@ -0,0 +1,74 @@
+package models
+
+import "testing"
+
+func TestParseTestlibScore(t *testing.T) {
+	inputs := []string{
+		"points 0.5 ok",
+		"0.25",
+		"points 1",
+		"points 0",
+		"points 35 ok",
+		"points -0.5",
+		"points nan",
+		"points",
+		"",
+	}
+	outputs := []struct {
+		Score float64
+		OK    bool
+	}{
+		{0.5, true},
+		{0.25, true},
+		{1, true},
+		{0, true},
+		{0, false},
+		{0, false},
+		{0, false},
+		{0, false},
+		{0, false},
+	}
+
+	for i, in := range inputs {
+		score, ok := parseTestlibScore(in)
+		if score != outputs[i].Score || ok != outputs[i].OK {
+			t.Errorf("error on test case #%v: %v %v", i, score, ok)
+		}
+	}
+}
+
+func TestSpecialEvaluatorTestlibPoint(t *testing.T) {
+	inputs := []struct {
+		SetPoint int
+		Score    float64
+	}{
+		{100, 0.29},
+		{100, 0.5},
+		{100, 1},
+		{100, 0},
+		{3, 0.5},
+		{7, 0.333},
+	}
+	outputs := []int{
+		29,
+		50,
+		100,
+		0,
+		2,
+		2,
+	}
+
+	config := &JudgementConfig{CheckerProtocol: CheckerProtocolTestlib}
+	for i, in := range inputs {
+		e := &specialCaseSetEvaluator{
+			setPoint: in.SetPoint,
+			score:    in.Score,
+			statuses: map[JudgementStatus]int{StatusAccepted: 1},
+			config:   config,
+		}
+		st, point := e.evaluate()
+		if st != StatusAccepted || point != outputs[i] {
+			t.Errorf("error on test case #%v: %v %v", i, st, point)
+		}
+	}
+}
@@ -8,18 +8,19 @@ import (
 )
 
 type Submission struct {
-	ID              uint             `gorm:"primary_key" json:"id"`
-	CreatedAt       time.Time        `json:"createdAt"`
-	UpdatedAt       time.Time        `json:"updatedAt"`
-	UserID          uint             `gorm:"not null" json:"userID"`
-	User            User             `json:"user"`
-	ProblemID       uint             `gorm:"not null" json:"problemID"`
-	Problem         Problem          `json:"problem"`
-	LanguageID      uint             `gorm:"not null" json:"languageID"`
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	UserID    uint      `gorm:"not null" json:"userID"`
+	User      User      `json:"user"`
+	ProblemID uint      `gorm:"not null" json:"problemID"`
+	Problem   Problem   `json:"problem"`
+	// 出力だけを提出する問題への提出ではnil
+	LanguageID      *uint            `json:"languageID"`
 	Language        Language         `json:"language"`
 	SourceCode      string           `gorm:"type:text; not null" json:"sourceCode"`
 	Point           int              `json:"point"`
-	Status          JudgementStatus  `gorm:"default:'0'" json:"status"`
+	Status          JudgementStatus  `gorm:"default:'0'; index" json:"status"`
 	ErrorLog        string           `gorm:"type:text" json:"errorLog"`
 	ExecTime        time.Duration    `json:"execTime"`
 	MemoryUsage     int64            `json:"memoryUsage"`
@@ -42,9 +43,30 @@ const (
 	StatusCompileError        JudgementStatus = 8
 	StatusOutputLimitExceeded JudgementStatus = 9
 	StatusUnknownError        JudgementStatus = 10
+	StatusRestrictedFunction  JudgementStatus = 11
+	// ジャッジの途中で取り下げられたか、止められた
+	StatusCancelled JudgementStatus = 12
 )
 
 func Submit(submission *Submission) error {
+	return submit(submission, nil)
+}
+
+// 出力だけを提出する問題への提出。archiveは`outputX-Y.txt`を並べたzip
+func SubmitOutputs(submission *Submission, archive []byte) error {
+	problem := GetProblem(submission.ProblemID)
+	if problem == nil {
+		return ErrNilArgument
+	}
+	outputs, err := parseSubmittedOutputs(problem, archive)
+	if err != nil {
+		return err
+	}
+
+	return submit(submission, outputs)
+}
+
+func submit(submission *Submission, outputs []SubmittedOutput) error {
 	submission.CodeBytes = uint(len(submission.SourceCode))
 	submission.ID = 0
 	db.Create(submission)
@@ -53,11 +75,17 @@ func Submit(submission *Submission) error {
 		return errors.New("something wrong")
 	}
 
+	for i := range outputs {
+		outputs[i].SubmissionID = submission.ID
+		db.Create(&outputs[i])
+	}
+
 	submission.FetchProblem()
 	onUpdateJudgementStatuses(submission.Problem.ContestID, *submission)
 	initJudgeSetResults(submission)
+	publishSubmissionEvent(submission, newSubmissionEvent(EventStatus, submission))
 
-	return judge(submission.ID)
+	return judge(submission.ID, submission.judgePriority())
 }
 
 func GetSubmission(submissionID uint) *Submission {
@@ -100,11 +128,14 @@ func fetchSubmissionFieldsWithCache(out []Submission) error {
 			problems[problem.ID] = problem
 		}
 
-		if l, ok := languages[out[i].LanguageID]; ok {
+		if out[i].LanguageID == nil {
+			continue
+		}
+		if l, ok := languages[*out[i].LanguageID]; ok {
 			out[i].Language = l
 		} else {
 			language := Language{}
-			err := db.Model(Language{}).Where("id = ?", out[i].LanguageID).Scan(&language).Error
+			err := db.Model(Language{}).Where("id = ?", *out[i].LanguageID).Scan(&language).Error
 			if err != nil {
 				return err
 			}
@@ -118,7 +149,7 @@ func fetchSubmissionFieldsWithCache(out []Submission) error {
 
 func (s *Submission) IsWrong() bool {
 	stat := s.Status
-	return stat == StatusWrongAnswer || stat == StatusTimeLimitExceeded || stat == StatusMemoryLimitExceeded || stat == StatusRuntimeError
+	return stat == StatusWrongAnswer || stat == StatusTimeLimitExceeded || stat == StatusMemoryLimitExceeded || stat == StatusRuntimeError || stat == StatusRestrictedFunction
 }
 
 func (s *Submission) FetchUser() {
@@ -126,6 +157,9 @@ func (s *Submission) FetchUser() {
 }
 
 func (s *Submission) FetchLanguage() {
+	if s.LanguageID == nil {
+		return
+	}
 	db.Model(s).Related(&s.Language)
 }
 
@@ -178,6 +212,7 @@ func (s *Submission) FetchJudgeSetResultsDeeplyForContest(session *UserSession)
 
 	for i := range s.JudgeSetResults {
 		s.JudgeSetResults[i].shuffleJudgeResults()
+		s.JudgeSetResults[i].hideFeedback()
 	}
 
 	return nil
@@ -185,11 +220,21 @@ func (s *Submission) FetchJudgeSetResultsDeeplyForContest(session *UserSession)
 
 func (s *Submission) CanView(session *UserSession) bool {
 	s.FetchProblem()
-	if s.Problem.ContestID == nil || s.UserID == session.UserID || s.Problem.CanEdit(session) {
+	if s.Problem.ContestID == nil {
+		return true
+	}
+	if session == nil {
+		return false
+	}
+	if s.UserID == session.UserID || s.Problem.CanEdit(session) {
 		return true
 	}
 
 	s.Problem.FetchContest()
+	// 削除されたコンテストは読み込めないので、終わっていても見せない
+	if s.Problem.Contest.ID == 0 {
+		return false
+	}
 	ended, err := s.Problem.Contest.Ended(time.Now(), session)
 	if err != nil {
 		logger.AppLog.Error(err)
@@ -198,9 +243,59 @@ func (s *Submission) CanView(session *UserSession) bool {
 	return s.Problem.CanView(session) && ended
 }
 
+// コンパイラの出力と標準エラー出力は、提出者と問題を編集できる人だけが見られる
+func (s *Submission) CanViewErrorLogs(session *UserSession) bool {
+	if session == nil {
+		return false
+	}
+	if s.UserID == session.UserID {
+		return true
+	}
+	if s.Problem.ID != s.ProblemID {
+		s.FetchProblem()
+	}
+	return s.Problem.CanEdit(session)
+}
+
+func (s *Submission) HideErrorLogs() {
+	s.ErrorLog = ""
+	for i := range s.JudgeSetResults {
+		for k := range s.JudgeSetResults[i].JudgeResults {
+			s.JudgeSetResults[i].JudgeResults[k].Stderr = ""
+		}
+	}
+}
+
 func (s *Submission) rejudge() error {
 	s.resetJudgeSetResults()
-	return judge(s.ID)
+	// 前の結果を得点から外しておき、ジャッジが終わったら数え直す
+	if s.Problem.ContestID != nil {
+		if err := updateScore(s.UserID, s.ProblemID, *s.Problem.ContestID); err != nil {
+			logger.AppLog.Errorf("error: %+v", err)
+		}
+	}
+	return judge(s.ID, priorityRejudge)
+}
+
+// 開催中のコンテストへの提出は、ほかの提出より先にジャッジする
+func (s *Submission) judgePriority() judgePriority {
+	if s.Problem.ContestID == nil {
+		return priorityPractice
+	}
+
+	c := GetContest(*s.Problem.ContestID)
+	if c == nil {
+		return priorityPractice
+	}
+	open, err := c.IsOpen(s.CreatedAt, &UserSession{UserID: s.UserID})
+	if err != nil {
+		logger.AppLog.Error(err)
+		return priorityPractice
+	}
+	if open {
+		return priorityContest
+	}
+	return priorityPractice
 }
 
 func (s *Submission) SetStatus(status JudgementStatus) error {
@@ -210,9 +305,15 @@ func (s *Submission) SetStatus(status JudgementStatus) error {
 		logger.AppLog.Errorf("error: %+v", err)
 		return err
 	}
+	return s.onStatusUpdated()
+}
+
+// 状態の変更を購読者に送って、コンテストの順位に反映する
+func (s *Submission) onStatusUpdated() error {
+	publishSubmissionEvent(s, newSubmissionEvent(EventStatus, s))
 
 	s.FetchProblem()
-	err = onUpdateJudgementStatuses(s.Problem.ContestID, *s)
+	err := onUpdateJudgementStatuses(s.Problem.ContestID, *s)
 	if err != nil {
 		logger.AppLog.Errorf("error: %+v", err)
 	}
@@ -224,11 +325,17 @@ func (s *Submission) Delete() {
 	for _, r := range s.JudgeSetResults {
 		r.Delete()
 	}
+	deleteSubmittedOutputs(s.ID)
 
 	db.Delete(Submission{}, "id = ?", s.ID)
 }
 
 func (s *Submission) resetJudgeSetResults() error {
+	s.ErrorLog = ""
+	if err := db.Model(Submission{}).Where("id = ?", s.ID).Update("error_log", "").Error; err != nil {
+		logger.AppLog.Errorf("error: %+v", err)
+		return err
+	}
 	if err := s.SetStatus(StatusInQueue); err != nil {
 		return err
 	}
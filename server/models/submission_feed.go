@@ -0,0 +1,98 @@
+package models
+
+import (
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	defaultSubmissionFeedLimit = 25
+	MaxSubmissionFeedLimit     = 100
+	// 一覧ではソースコードやコンパイラの出力は返さない
+	submissionFeedColumns = "id, created_at, updated_at, user_id, problem_id, language_id, point, status, exec_time, memory_usage, code_bytes, contest_id"
+)
+
+// 提出の一覧の条件。0やnilのものは条件にしない
+type SubmissionFeedQuery struct {
+	UserID     uint
+	ProblemID  uint
+	LanguageID uint
+	Status     *JudgementStatus
+	// 提出日時がSince以降、Untilより前のもの
+	Since *time.Time
+	Until *time.Time
+	// このIDより前の提出を返す。0のときは最新のものから返す
+	Before uint
+	Limit  int
+}
+
+// 新しい順に、sessionが見られる提出だけを返す。
+// 次のページがあるときは、次に取得するときにBeforeに指定するIDも返す
+func GetSubmissionFeed(session *UserSession, q *SubmissionFeedQuery) ([]Submission, uint, error) {
+	limit := q.Limit
+	if limit <= 0 || MaxSubmissionFeedLimit < limit {
+		limit = defaultSubmissionFeedLimit
+	}
+
+	query := submissionFeedVisibility(db.Model(Submission{}).Select(submissionFeedColumns), session)
+	if q.UserID != 0 {
+		query = query.Where("user_id = ?", q.UserID)
+	}
+	if q.ProblemID != 0 {
+		query = query.Where("problem_id = ?", q.ProblemID)
+	}
+	if q.LanguageID != 0 {
+		query = query.Where("language_id = ?", q.LanguageID)
+	}
+	if q.Status != nil {
+		query = query.Where("status = ?", *q.Status)
+	}
+	if q.Since != nil {
+		query = query.Where("created_at >= ?", *q.Since)
+	}
+	if q.Until != nil {
+		query = query.Where("created_at < ?", *q.Until)
+	}
+	if q.Before != 0 {
+		query = query.Where("id < ?", q.Before)
+	}
+
+	// 1件多く取得して、次のページがあるかを調べる
+	res := make([]Submission, 0, limit+1)
+	if err := query.Order("id DESC").Limit(limit + 1).Scan(&res).Error; err != nil {
+		logger.AppLog.Error(err)
+		return nil, 0, err
+	}
+
+	var next uint
+	if limit < len(res) {
+		res = res[:limit]
+		next = res[limit-1].ID
+	}
+
+	if err := fetchSubmissionFieldsWithCache(res); err != nil {
+		logger.AppLog.Error(err)
+		return nil, 0, err
+	}
+	return res, next, nil
+}
+
+// Submission.CanViewと同じ条件をSQLで表す。見られない提出はSQLで除くので、ページの件数はLIMITの通りになる。
+// コンテストの問題への提出は、自分の提出と、作問したコンテストと終わったコンテストの提出を見られる。
+// 削除されたコンテストは終わっていても見せない
+func submissionFeedVisibility(query *gorm.DB, session *UserSession) *gorm.DB {
+	if session == nil {
+		return query.Where("problem_id IN (SELECT id FROM problems WHERE contest_id IS NULL)")
+	}
+
+	const visible = "user_id = ? OR problem_id IN (SELECT id FROM problems WHERE contest_id IS NULL " +
+		"OR contest_id IN (SELECT contest_id FROM contests_writers WHERE user_id = ?) " +
+		"OR contest_id IN (SELECT id FROM contests WHERE deleted_at IS NULL AND duration IS NULL AND end_at < ?) " +
+		// 参加した時刻から時間を測るコンテストは、参加者ごとに終わる時刻が違う
+		"OR contest_id IN (SELECT p.contest_id FROM contests_participants p INNER JOIN contests c ON c.id = p.contest_id " +
+		"WHERE p.user_id = ? AND c.deleted_at IS NULL AND c.duration IS NOT NULL AND DATE_ADD(p.created_at, INTERVAL c.duration DIV 1000 MICROSECOND) < ?))"
+	now := time.Now()
+	return query.Where(visible, session.UserID, session.UserID, now, session.UserID, now)
+}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"time"
+)
+
+// 出力だけを提出する問題で、テストケースごとに提出された出力。
+// 内容はテストケースと同じくtestdataのストアにSHA-256をキーにして保存する
+type SubmittedOutput struct {
+	ID           uint `gorm:"primary_key"`
+	CreatedAt    time.Time
+	SubmissionID uint   `gorm:"not null; index"`
+	TestCaseID   uint   `gorm:"not null"`
+	OutputHash   string `gorm:"type:char(64); not null; index"`
+	OutputSize   int64  `gorm:"not null"`
+}
+
+// テストケースと同じ`outputX-Y.txt`の命名で並んだzipを読んで、テストケースに対応づける。
+// 提出されなかったテストケースは空の出力として扱う。
+func parseSubmittedOutputs(problem *Problem, archive []byte) ([]SubmittedOutput, error) {
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkValidZip(r); err != nil {
+		return nil, err
+	}
+
+	sets := make([]CaseSet, 0)
+	db.Order("id ASC").Where("problem_id = ?", problem.ID).Find(&sets)
+	cases := make([][]TestCase, len(sets))
+	for i := range sets {
+		db.Order("id ASC").Where("case_set_id = ?", sets[i].ID).Find(&cases[i])
+	}
+
+	files := make(map[uint]*zip.File)
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if outputFileRegex.FindString(f.Name) != f.Name {
+			return nil, ErrInvalidFileNameOrDirectoryStructure
+		}
+
+		i, j := parseCaseFileName(f.Name, outputFilePrefix)
+		if i <= 0 || len(cases) < i || j <= 0 || len(cases[i-1]) < j {
+			return nil, ErrInvalidFileNameOrDirectoryStructure
+		}
+		files[cases[i-1][j-1].ID] = f
+	}
+
+	res := make([]SubmittedOutput, 0)
+	for _, s := range cases {
+		for _, c := range s {
+			content := ""
+			if f, ok := files[c.ID]; ok {
+				b, err := readStringFull(f)
+				if err != nil {
+					return nil, err
+				}
+				content = newlineReplacer.Replace(*b)
+			}
+
+			out := SubmittedOutput{TestCaseID: c.ID}
+			var err error
+			out.OutputHash, out.OutputSize, _, err = putTestData(content)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, out)
+		}
+	}
+
+	return res, nil
+}
+
+func getSubmittedOutputHashes(submissionID uint) map[uint]string {
+	outputs := make([]SubmittedOutput, 0)
+	db.Where("submission_id = ?", submissionID).Find(&outputs)
+
+	res := make(map[uint]string, len(outputs))
+	for _, o := range outputs {
+		res[o.TestCaseID] = o.OutputHash
+	}
+	return res
+}
+
+func deleteSubmittedOutputs(submissionID uint) {
+	outputs := make([]SubmittedOutput, 0)
+	db.Where("submission_id = ?", submissionID).Find(&outputs)
+	db.Delete(SubmittedOutput{}, "submission_id = ?", submissionID)
+	for _, o := range outputs {
+		deleteUnusedTestData(o.OutputHash)
+	}
+}
+
+// 以前はsubmitted_outputsのoutputのカラムに内容を保存していたので、ストアに移してカラムにNULLを許可する
+func migrateSubmittedOutputData() error {
+	if !db.Dialect().HasColumn("submitted_outputs", "output") {
+		return nil
+	}
+	if err := db.Exec("ALTER TABLE submitted_outputs MODIFY output longtext NULL").Error; err != nil {
+		return err
+	}
+
+	rows, err := db.Table("submitted_outputs").Select("id, output").Where("output_hash = ''").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// 途中で失敗したときは1件も書き換えずに、次の起動でやり直す
+	tx := db.Begin()
+	for rows.Next() {
+		var (
+			id     uint
+			output string
+		)
+		if err := rows.Scan(&id, &output); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		hash, size, _, err := putTestData(output)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		query := map[string]interface{}{
+			"output_hash": hash,
+			"output_size": size,
+		}
+		if err := tx.Model(SubmittedOutput{}).Where("id = ?", id).Updates(query).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
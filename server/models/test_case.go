@@ -3,16 +3,30 @@ package models
 import (
 	"archive/zip"
 	"io"
+	"io/ioutil"
 	"strings"
 
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/testdata"
 	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
 )
 
+// 一覧などで内容を見られるように、先頭だけをDBに保存する
+const testCasePreviewLength = 256
+
+// 入力と出力の内容はtestdataのストアにSHA-256をキーにして保存する
 type TestCase struct {
 	gorm.Model
-	CaseSetID uint   `gorm:"not null"`
-	Input     string `gorm:"type:longtext; not null"`
-	Output    string `gorm:"type:longtext; not null"`
+	CaseSetID     uint   `gorm:"not null"`
+	InputHash     string `gorm:"type:char(64); not null; index"`
+	InputSize     int64  `gorm:"not null"`
+	InputPreview  string `gorm:"type:text; not null"`
+	OutputHash    string `gorm:"type:char(64); not null; index"`
+	OutputSize    int64  `gorm:"not null"`
+	OutputPreview string `gorm:"type:text; not null"`
+	// FetchOutputを呼んだときだけ設定される
+	Output string `gorm:"-"`
 }
 
 var newlineReplacer = strings.NewReplacer(
@@ -33,10 +47,19 @@ func newTestCase(set *CaseSet, input *zip.File, output *zip.File) (*TestCase, er
 
 	testCase := &TestCase{
 		CaseSetID: set.ID,
-		Input:     newlineReplacer.Replace(*in),
-		Output:    newlineReplacer.Replace(*out),
 	}
-	db.Create(testCase)
+	testCase.InputHash, testCase.InputSize, testCase.InputPreview, err = putTestData(newlineReplacer.Replace(*in))
+	if err != nil {
+		return nil, err
+	}
+	testCase.OutputHash, testCase.OutputSize, testCase.OutputPreview, err = putTestData(newlineReplacer.Replace(*out))
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Create(testCase).Error; err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
 
 	return testCase, nil
 }
@@ -58,14 +81,194 @@ func readStringFull(file *zip.File) (*string, error) {
 	return &result, nil
 }
 
+// contentをストアに保存して、ハッシュと大きさとプレビューを返す
+func putTestData(content string) (string, int64, string, error) {
+	hash := testdata.Hash([]byte(content))
+	size := int64(len(content))
+	if err := testdata.Put(hash, strings.NewReader(content), size); err != nil {
+		logger.AppLog.Errorf("test data error: %+v", err)
+		return "", 0, "", err
+	}
+	return hash, size, truncateString(content, testCasePreviewLength), nil
+}
+
+func (c *TestCase) FetchOutput() error {
+	out, err := readTestData(c.OutputHash)
+	if err != nil {
+		return err
+	}
+	c.Output = out
+	return nil
+}
+
+func readTestData(hash string) (string, error) {
+	r, err := testdata.Open(hash)
+	if err != nil {
+		logger.AppLog.Errorf("test data error: %+v", err)
+		return "", err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return "", err
+	}
+	return string(b), nil
+}
+
 func (c TestCase) Delete() {
-	db.Model(TestCase{}).Where("id = ?", c.ID).Updates(map[string]interface{}{
-		"input":  "",
-		"output": "",
-	})
 	db.Delete(TestCase{}, "id = ?", c.ID)
 }
 
 func (c TestCase) DeletePermanently() {
 	db.Unscoped().Delete(TestCase{}, "id = ?", c.ID)
+	deleteUnusedTestData(c.InputHash)
+	deleteUnusedTestData(c.OutputHash)
+}
+
+// 同じ内容のテストケースや提出された出力が他にもあるときは消さない
+func deleteUnusedTestData(hash string) {
+	if hash == "" {
+		return
+	}
+
+	count := 0
+	db.Unscoped().Model(TestCase{}).Where("input_hash = ? OR output_hash = ?", hash, hash).Count(&count)
+	if count != 0 {
+		return
+	}
+	db.Model(SubmittedOutput{}).Where("output_hash = ?", hash).Count(&count)
+	if count != 0 {
+		return
+	}
+	if err := testdata.Delete(hash); err != nil {
+		logger.AppLog.Errorf("test data error: %+v", err)
+	}
+}
+
+// test_casesのinputとoutputのカラムをDropLegacyTestCaseColumnsでバックアップしてから削除するまでのテーブル
+const legacyTestCaseDataTable = "test_cases_legacy_data"
+
+// 以前はtest_casesのinputとoutputのカラムに内容を保存していたので、ストアに移す。
+// カラムは残しておくので、削除するときはcmd/migrateでDropLegacyTestCaseColumnsを実行する
+func migrateTestCaseData() error {
+	if !db.Dialect().HasColumn("test_cases", "input") {
+		return nil
+	}
+
+	count := 0
+	if err := db.Unscoped().Table("test_cases").Where("input_hash = ''").Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	logger.AppLog.Infof("migrating %v test case(s) to the test data store", count)
+
+	rows, err := db.Unscoped().Table("test_cases").Select("id, input, output").Where("input_hash = ''").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// 途中で失敗したときは1件も書き換えずに、次の起動でやり直す
+	tx := db.Begin()
+	for rows.Next() {
+		var (
+			id            uint
+			input, output string
+		)
+		if err := rows.Scan(&id, &input, &output); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		c := &TestCase{}
+		c.InputHash, c.InputSize, c.InputPreview, err = putTestData(input)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		c.OutputHash, c.OutputSize, c.OutputPreview, err = putTestData(output)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		query := map[string]interface{}{
+			"input_hash":     c.InputHash,
+			"input_size":     c.InputSize,
+			"input_preview":  c.InputPreview,
+			"output_hash":    c.OutputHash,
+			"output_size":    c.OutputSize,
+			"output_preview": c.OutputPreview,
+		}
+		if err := tx.Unscoped().Model(TestCase{}).Where("id = ?", id).Updates(query).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// すべてのテストケースをストアに移し終わっていれば、内容をバックアップのテーブルにコピーしてから
+// test_casesのinputとoutputのカラムを削除する。元に戻せないので、起動時には実行しない
+func DropLegacyTestCaseColumns() error {
+	if !db.Dialect().HasColumn("test_cases", "input") {
+		return nil
+	}
+
+	count := 0
+	if err := db.Unscoped().Table("test_cases").Where("input_hash = ''").Count(&count).Error; err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+	if count != 0 {
+		return errors.Errorf("%v test case(s) are not migrated to the test data store yet", count)
+	}
+
+	if db.HasTable(legacyTestCaseDataTable) {
+		return errors.Errorf("backup table %v already exists", legacyTestCaseDataTable)
+	}
+	err := db.Exec("CREATE TABLE " + legacyTestCaseDataTable + " AS SELECT id, input, output FROM test_cases").Error
+	if err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+
+	// 片方だけ削除されることがないように、1つのALTER TABLEで削除する
+	err = db.Exec("ALTER TABLE test_cases DROP COLUMN input, DROP COLUMN output").Error
+	if err != nil {
+		logger.AppLog.Error(err)
+	}
+	return err
+}
+
+// ジャッジノードに渡すテストケースや提出された出力の内容。どれにも使われていないハッシュのときはnilを返す
+func OpenTestData(hash string) (io.ReadCloser, int64, error) {
+	var size int64
+	c := &TestCase{}
+	o := &SubmittedOutput{}
+	if !db.Unscoped().Where("input_hash = ? OR output_hash = ?", hash, hash).First(c).RecordNotFound() {
+		size = c.InputSize
+		if c.OutputHash == hash {
+			size = c.OutputSize
+		}
+	} else if !db.Where("output_hash = ?", hash).First(o).RecordNotFound() {
+		size = o.OutputSize
+	} else {
+		return nil, 0, nil
+	}
+
+	r, err := testdata.Open(hash)
+	if err != nil {
+		logger.AppLog.Errorf("test data error: %+v", err)
+		return nil, 0, err
+	}
+	return r, size, nil
 }
@@ -0,0 +1,160 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/conf"
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/workers"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// 問題を指定しないときの制限
+	testRunTimeLimit   = 2 * time.Second
+	testRunMemoryLimit = 256
+	// 標準入力と、返す標準出力の大きさの上限
+	testRunInputLimit  = 1024 * 1024
+	testRunOutputLimit = 64 * 1024
+	// 設定されていないときの、同時に実行する数の上限
+	defaultTestRunConcurrency = 2
+)
+
+var (
+	ErrTestRunBusy        = errors.New("too many test runs")
+	ErrTestRunUnavailable = errors.New("test runs are not available on this server")
+	ErrTestRunInputLimit  = errors.New("input is too large")
+	// 同時に実行できる数だけ値が入る
+	testRunSlots chan struct{}
+)
+
+// 提出とは別に、ユーザーが与えた入力でプログラムを実行してみる。
+// 結果はどこにも保存しないので、得点には影響しない
+type TestRun struct {
+	LanguageID uint   `json:"languageID"`
+	SourceCode string `json:"sourceCode"`
+	Input      string `json:"input"`
+}
+
+type TestRunResult struct {
+	// コンパイルエラーのときはtrueで、Stderrにコンパイラの出力が入る
+	CompileError bool               `json:"compileError"`
+	Status       workers.ExecStatus `json:"status"`
+	ExecTime     time.Duration      `json:"execTime"`
+	MemoryUsage  int64              `json:"memoryUsage"`
+	Stdout       string             `json:"stdout"`
+	Stderr       string             `json:"stderr"`
+	ExitStatus   int                `json:"exitStatus"`
+}
+
+func initTestRuns() {
+	n := conf.GetConfig().Judgement.TestRunConcurrency
+	if n <= 0 {
+		n = defaultTestRunConcurrency
+	}
+	testRunSlots = make(chan struct{}, n)
+}
+
+// problemがnilのときは、問題によらないデフォルトの制限で実行する
+func (t *TestRun) Run(language *Language, problem *Problem) (*TestRunResult, error) {
+	if conf.GetConfig().JudgeNode.RemoteOnly {
+		return nil, ErrTestRunUnavailable
+	}
+	if testRunInputLimit < len(t.Input) {
+		return nil, ErrTestRunInputLimit
+	}
+
+	select {
+	case testRunSlots <- struct{}{}:
+	default:
+		return nil, ErrTestRunBusy
+	}
+	defer func() {
+		<-testRunSlots
+	}()
+
+	// 試しに実行しただけのプログラムで、ジャッジに使う実行ファイルがキャッシュから追い出されないようにする
+	compiled, compileRes := compile(t.SourceCode, language, false)
+	if compiled == nil || compileRes == nil {
+		return nil, ErrTransientJudgement
+	}
+	if compileRes.Status != workers.StatusFinished {
+		return &TestRunResult{
+			CompileError: true,
+			Status:       compileRes.Status,
+			Stderr:       compileRes.Stderr,
+			ExitStatus:   compileRes.ExitStatus,
+		}, nil
+	}
+
+	limits := &Problem{TimeLimit: testRunTimeLimit, MemoryLimit: testRunMemoryLimit}
+	if problem != nil {
+		limits = problem
+	}
+	res, err := execTestRun(compiled, language, limits, t.Input)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TestRunResult{
+		Status:      res.Status,
+		ExecTime:    res.ExecTime,
+		MemoryUsage: res.MemoryUsage,
+		Stdout:      truncateString(res.Stdout, testRunOutputLimit),
+		Stderr:      res.Stderr,
+		ExitStatus:  res.ExitStatus,
+	}, nil
+}
+
+// ジャッジと同じrunnerで、入力が1つのテストケースとして実行する
+func execTestRun(compiled *compiledProgram, language *Language, limits *Problem, input string) (*workers.ExecResult, error) {
+	img := imageNamePrefix + language.ImageName
+	w, err := workers.NewJudgementWorker(img, limits.TimeLimit, limits.GetWallTimeLimit(), int64(limits.MemoryLimit*1024*1024), 1, language.SeccompProfile, false, language.GetExecCommandSlice())
+	if err != nil {
+		logger.AppLog.Errorf("test run: container create error %+v", err)
+		return nil, err
+	}
+	defer w.Remove()
+
+	inputDir := w.HostJudgeDataDir + "/input"
+	if err := os.Mkdir(inputDir, 0700); err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
+	if err := ioutil.WriteFile(inputDir+"/0", []byte(input), 0600); err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
+
+	err = w.CopyContentToContainer(compiled.exe, workers.Workspace+language.ExeFileName)
+	if err != nil {
+		logger.AppLog.Errorf("test run: docker cp error %+v", err)
+		return nil, err
+	}
+
+	// runnerが止まらなくなっても、リクエストを待たせ続けないようにする
+	ctx, cancel := context.WithTimeout(context.Background(), limits.GetWallTimeLimit()+compileTimeLimit)
+	defer cancel()
+	if _, err := w.RunContext(ctx, "", false); err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
+
+	p, err := workers.NewExecResultParser(w)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
+	_, res, err := p.Next()
+	if err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
+	if res == nil {
+		return nil, ErrParseOutput
+	}
+	return res, nil
+}
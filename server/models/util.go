@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"fmt"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -39,6 +40,13 @@ func MaxInt(a, b int) int {
 	return a
 }
 
+func MinLong(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func MinInt(a, b int) int {
 	if a < b {
 		return a
@@ -60,6 +68,17 @@ func DefaultString(value, def string) string {
 	return value
 }
 
+// UTF-8として壊れないように、先頭からmaxBytesバイト以内に切り詰める
+func truncateString(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	for 0 < maxBytes && !utf8.RuneStart(s[maxBytes]) {
+		maxBytes--
+	}
+	return s[:maxBytes]
+}
+
 func EqualTime(t1, t2 time.Time) bool {
 	diff := time.Duration(t1.UnixNano() - t2.UnixNano())
 	if diff < 0 {
@@ -122,3 +122,29 @@ func TestUniqueUsers(t *testing.T) {
 		}
 	}
 }
+
+func TestTruncateString(t *testing.T) {
+	inputs := []struct {
+		S        string
+		MaxBytes int
+	}{
+		{"abc", 5},
+		{"abcdef", 3},
+		{"ねこ", 6},
+		{"ねこ", 5},
+		{"ねこ", 2},
+	}
+	outputs := []string{
+		"abc",
+		"abc",
+		"ねこ",
+		"ね",
+		"",
+	}
+
+	for i, in := range inputs {
+		if truncateString(in.S, in.MaxBytes) != outputs[i] {
+			t.Errorf("error on test case #%v", i)
+		}
+	}
+}
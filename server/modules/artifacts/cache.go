@@ -0,0 +1,158 @@
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/atomicfile"
+)
+
+// コンパイル済みの実行ファイルを、ソースコードとコンパイル方法のハッシュをキーにして保存するキャッシュ。
+// 合計の大きさがmaxBytesを超えたら、最後に使われたのが古いものから削除する。
+type Cache struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+}
+
+var cache *Cache
+
+// dirが空文字列かmaxBytesが0以下のときはキャッシュしない
+func Init(dir string, maxBytes int64) error {
+	if dir == "" || maxBytes <= 0 {
+		cache = nil
+		return nil
+	}
+
+	c, err := NewCache(dir, maxBytes)
+	if err != nil {
+		return err
+	}
+	cache = c
+	return nil
+}
+
+func NewCache(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
+	return &Cache{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// 区切りを含む文字列を並べても衝突しないように、それぞれの長さも含めてハッシュを計算する
+func Key(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(strconv.Itoa(len(p))))
+		h.Write([]byte{0})
+		h.Write([]byte(p))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Initで設定したキャッシュから読む。キャッシュしない設定のときは常にfalseを返す
+func Get(key string) ([]byte, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	return cache.Get(key)
+}
+
+// Initで設定したキャッシュに保存する。キャッシュしない設定のときは何もしない
+func Put(key string, content []byte) error {
+	if cache == nil {
+		return nil
+	}
+	return cache.Put(key, content)
+}
+
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := c.path(key)
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.AppLog.Error(err)
+		}
+		return nil, false
+	}
+
+	// 更新日時を最後に使われた日時として使う
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err != nil {
+		logger.AppLog.Error(err)
+	}
+	return content, true
+}
+
+func (c *Cache) Put(key string, content []byte) error {
+	if c.maxBytes < int64(len(content)) {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := atomicfile.Write(c.path(key), 0600, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+	if err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+
+	return c.evict()
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+// 合計の大きさがmaxBytes以下になるまで、古いものから削除する
+func (c *Cache) evict() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+
+	entries := make([]os.FileInfo, 0, len(files))
+	var total int64
+	for _, f := range files {
+		// 書き込み途中の一時ファイルは数えない
+		if f.IsDir() || strings.HasPrefix(f.Name(), atomicfile.TempPrefix) {
+			continue
+		}
+		entries = append(entries, f)
+		total += f.Size()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for _, f := range entries {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(c.path(f.Name())); err != nil && !os.IsNotExist(err) {
+			logger.AppLog.Error(err)
+			return err
+		}
+		total -= f.Size()
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package artifacts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/labstack/gommon/log"
+)
+
+func TestMain(m *testing.M) {
+	logger.AppLog = log.New("")
+
+	os.Exit(m.Run())
+}
+
+func TestKey(t *testing.T) {
+	inputs := [][2][]string{
+		{{"a", "b"}, {"a", "b"}},
+		{{"ab", ""}, {"a", "b"}},
+		{{"a\x00", "b"}, {"a", "\x00b"}},
+	}
+	outputs := []bool{
+		true,
+		false,
+		false,
+	}
+
+	for i, in := range inputs {
+		if (Key(in[0]...) == Key(in[1]...)) != outputs[i] {
+			t.Errorf("error on test case #%v", i)
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Now().Add(-time.Hour)
+	for i, k := range []string{"a", "b"} {
+		if err := c.Put(k, []byte("1234")); err != nil {
+			t.Fatal(err)
+		}
+		mod := base.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(filepath.Join(dir, k), mod, mod)
+	}
+
+	// 使われたものは新しくなるので、bが先に削除される
+	if _, ok := c.Get("a"); !ok {
+		t.Errorf("a is not cached")
+	}
+	if err := c.Put("c", []byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("b is not evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("%v is not cached", k)
+		}
+	}
+
+	if err := c.Put("d", []byte("12345678901")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("d"); ok {
+		t.Errorf("content larger than the limit is cached")
+	}
+}
@@ -0,0 +1,44 @@
+package atomicfile
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+)
+
+// 書き込み途中の一時ファイルの名前の接頭辞。ディレクトリを走査するときはこれで始まるものを飛ばすこと
+const TempPrefix = ".tmp"
+
+// 書き込み途中のファイルを読まないように、同じディレクトリの一時ファイルに書いてからpathに置き換える。
+// writeがエラーを返したときは一時ファイルを削除して、pathは変更しない
+func Write(path string, mode os.FileMode, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), TempPrefix)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+	// 置き換えた後は一時ファイルがないので、何もしない
+	defer os.Remove(f.Name())
+
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// TempFileは0600で作るので、umaskの影響を受けずにmodeにする
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/labstack/gommon/log"
+)
+
+func TestMain(m *testing.M) {
+	logger.AppLog = log.New("")
+
+	os.Exit(m.Run())
+}
+
+func TestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomicfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "a")
+	err = Write(p, 0444, func(w io.Writer) error {
+		_, err := w.Write([]byte("before"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 書き込みに失敗したときは、元のファイルが残って一時ファイルは消える
+	errWrite := errors.New("write error")
+	err = Write(p, 0444, func(w io.Writer) error {
+		w.Write([]byte("after"))
+		return errWrite
+	})
+	if err != errWrite {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "before" {
+		t.Errorf("content is overwritten: %v", string(content))
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0444 {
+		t.Errorf("unexpected mode: %v", info.Mode())
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("temporary file is left: %v", len(files))
+	}
+}
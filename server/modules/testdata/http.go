@@ -0,0 +1,98 @@
+package testdata
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/pkg/errors"
+)
+
+var errReadOnlyStore = errors.New("test data store is read only")
+
+// ジャッジノード用の、APIサーバーから baseURL/<hash> でテストケースを取得するストア。
+// 取得したものはローカルにキャッシュする。保存と削除はできない
+type httpStore struct {
+	baseURL string
+	header  http.Header
+	client  *http.Client
+	cache   *localStore
+}
+
+func NewHTTPStore(baseURL string, header http.Header, cacheDir string) (Store, error) {
+	cache, err := newLocalStore(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &httpStore{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		header:  header,
+		client:  &http.Client{Timeout: s3Timeout},
+		cache:   cache,
+	}
+	return s, nil
+}
+
+// Initの代わりに、作成したストアを使うようにする
+func SetStore(s Store) {
+	store = s
+}
+
+func (s *httpStore) fetch(hash string) error {
+	if s.cache.has(hash) {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.baseURL+"/"+hash, nil)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+	for k, v := range s.header {
+		req.Header[k] = v
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		logger.AppLog.Errorf("test data: GET %v: %+v", hash, err)
+		return err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return os.ErrNotExist
+	case res.StatusCode != http.StatusOK:
+		err := fmt.Errorf("test data: GET %v: %v", hash, res.Status)
+		logger.AppLog.Error(err)
+		return err
+	}
+	// ハッシュを確かめながらキャッシュに書き込む
+	return s.cache.Put(hash, res.Body, res.ContentLength)
+}
+
+func (s *httpStore) Put(hash string, src io.Reader, size int64) error {
+	return errReadOnlyStore
+}
+
+func (s *httpStore) Open(hash string) (io.ReadCloser, error) {
+	if err := s.fetch(hash); err != nil {
+		return nil, err
+	}
+	return s.cache.Open(hash)
+}
+
+func (s *httpStore) Copy(hash, dst string) error {
+	if err := s.fetch(hash); err != nil {
+		return err
+	}
+	return s.cache.Copy(hash, dst)
+}
+
+func (s *httpStore) Delete(hash string) error {
+	return errReadOnlyStore
+}
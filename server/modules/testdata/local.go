@@ -0,0 +1,105 @@
+package testdata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/atomicfile"
+)
+
+// dir/<hashの先頭2文字>/<hash> に読み込み専用のファイルとして保存する
+type localStore struct {
+	dir string
+}
+
+func NewLocalStore(dir string) (Store, error) {
+	return newLocalStore(dir)
+}
+
+func newLocalStore(dir string) (*localStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &localStore{dir}, nil
+}
+
+func (s *localStore) path(hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(s.dir, hash)
+	}
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+func (s *localStore) has(hash string) bool {
+	_, err := os.Stat(s.path(hash))
+	return err == nil
+}
+
+func (s *localStore) Put(hash string, src io.Reader, size int64) error {
+	if s.has(hash) {
+		return nil
+	}
+
+	p := s.path(hash)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+
+	// 保存したファイルは書き換えないので、読み込み専用にしておく
+	return atomicfile.Write(p, 0444, func(w io.Writer) error {
+		h := sha256.New()
+		var err error
+		if size < 0 {
+			// 大きさがわからないときは最後まで読む
+			_, err = io.Copy(io.MultiWriter(w, h), src)
+		} else {
+			_, err = io.CopyN(io.MultiWriter(w, h), src, size)
+		}
+		if err != nil {
+			logger.AppLog.Error(err)
+			return err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != hash {
+			logger.AppLog.Errorf("%v: %v", ErrChecksumMismatch, hash)
+			return ErrChecksumMismatch
+		}
+		return nil
+	})
+}
+
+func (s *localStore) Open(hash string) (io.ReadCloser, error) {
+	return os.Open(s.path(hash))
+}
+
+func (s *localStore) Copy(hash, dst string) error {
+	in, err := os.Open(s.path(hash))
+	if err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0444)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *localStore) Delete(hash string) error {
+	err := os.Remove(s.path(hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
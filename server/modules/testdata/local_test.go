@@ -0,0 +1,76 @@
+package testdata
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/labstack/gommon/log"
+)
+
+func TestMain(m *testing.M) {
+	logger.AppLog = log.New("")
+
+	os.Exit(m.Run())
+}
+
+func TestLocalStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewLocalStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("1 2\n3 4\n")
+	hash := Hash(content)
+	if err := s.Put(hash, bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	// 同じ内容を2回保存してもエラーにならない
+	if err := s.Put(hash, bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "input")
+	if err := s.Copy(hash, dst); err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := ioutil.ReadFile(dst); err != nil || !bytes.Equal(actual, content) {
+		t.Errorf("expected %q, but got %q (%v)", content, actual, err)
+	}
+
+	// コピーしたファイルを書き換えても、保存したファイルは変わらない
+	os.Chmod(dst, 0644)
+	if err := ioutil.WriteFile(dst, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Open(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(actual, content) {
+		t.Errorf("expected %q, but got %q (%v)", content, actual, err)
+	}
+
+	other := []byte("5 6\n")
+	if err := s.Put(hash[:63]+"0", bytes.NewReader(other), int64(len(other))); err != ErrChecksumMismatch {
+		t.Errorf("expected %v, but got %v", ErrChecksumMismatch, err)
+	}
+
+	if err := s.Delete(hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open(hash); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, but got %v", err)
+	}
+}
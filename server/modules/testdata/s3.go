@@ -0,0 +1,248 @@
+package testdata
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/pkg/errors"
+)
+
+const (
+	s3Service       = "s3"
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3AmzDateFormat = "20060102T150405Z"
+	s3DateFormat    = "20060102"
+	s3Timeout       = 5 * time.Minute
+	// 空のリクエストボディのSHA-256
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type S3Config struct {
+	// http://minio:9000 のようにスキームを含める
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3互換のオブジェクトストレージに保存する。
+// ジャッジデータにはファイルとして置く必要があるので、ダウンロードしたものはローカルにキャッシュする。
+type s3Store struct {
+	cfg    S3Config
+	client *http.Client
+	cache  *localStore
+}
+
+func NewS3Store(cfg S3Config, cacheDir string) (Store, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("endpoint and bucket are required for the s3 test data store")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+
+	cache, err := newLocalStore(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &s3Store{
+		cfg:    cfg,
+		client: &http.Client{Timeout: s3Timeout},
+		cache:  cache,
+	}
+	return s, nil
+}
+
+func (s *s3Store) Put(hash string, src io.Reader, size int64) error {
+	// 内容を確かめながらキャッシュに書いて、そこからアップロードする
+	if err := s.cache.Put(hash, src, size); err != nil {
+		return err
+	}
+
+	f, err := s.cache.Open(hash)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+	defer f.Close()
+
+	res, err := s.do(http.MethodPut, hash, f, size, hash)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// キャッシュになければダウンロードする
+func (s *s3Store) fetch(hash string) error {
+	if s.cache.has(hash) {
+		return nil
+	}
+
+	res, err := s.do(http.MethodGet, hash, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return s.cache.Put(hash, res.Body, res.ContentLength)
+}
+
+func (s *s3Store) Open(hash string) (io.ReadCloser, error) {
+	if err := s.fetch(hash); err != nil {
+		return nil, err
+	}
+	return s.cache.Open(hash)
+}
+
+func (s *s3Store) Copy(hash, dst string) error {
+	if err := s.fetch(hash); err != nil {
+		return err
+	}
+	return s.cache.Copy(hash, dst)
+}
+
+func (s *s3Store) Delete(hash string) error {
+	res, err := s.do(http.MethodDelete, hash, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return s.cache.Delete(hash)
+}
+
+// MinIOでも使えるように、バケットはパスで指定する
+func (s *s3Store) do(method, hash string, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.cfg.Endpoint+"/"+s.cfg.Bucket+"/"+hash, body)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	signV4(req, payloadHash, s.cfg.Region, s.cfg.AccessKey, s.cfg.SecretKey, time.Now().UTC())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		logger.AppLog.Errorf("s3: %v %v: %+v", method, hash, err)
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		res.Body.Close()
+		err = fmt.Errorf("s3: %v %v: %v", method, hash, res.Status)
+		logger.AppLog.Error(err)
+		if res.StatusCode == http.StatusNotFound {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// AWS Signature Version 4でreqに署名する。reqに設定済みのヘッダーはすべて署名に含める
+func signV4(req *http.Request, payloadHash, region, accessKey, secretKey string, t time.Time) {
+	amzDate := t.Format(s3AmzDateFormat)
+	date := t.Format(s3DateFormat)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, s3Service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%v Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s3Algorithm, accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(req *http.Request) string {
+	q := req.URL.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string{}, q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, awsURIEncode(k)+"="+awsURIEncode(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// url.QueryEscapeと違い、スペースは%20にして~はそのままにする
+func awsURIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,95 @@
+package testdata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/pkg/errors"
+)
+
+// Initで指定できるストアの種類
+const (
+	StoreLocal = "local"
+	// S3互換のオブジェクトストレージ。MinIOでも使える
+	StoreS3 = "s3"
+
+	defaultDir = "test_data"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("checksum of the test data does not match")
+	errUnknownStore     = errors.New("unknown test data store")
+	errStoreNotReady    = errors.New("test data store is not initialized")
+)
+
+// テストケースの入力や出力を、内容のSHA-256をキーにして保存する。
+// 同じ内容は1つだけ保存されるので、削除するときは他から参照されていないことを確かめること。
+type Store interface {
+	// srcからsizeバイトを読んで保存する。sizeが負のときは最後まで読む。
+	// 内容のSHA-256がhashと違えばErrChecksumMismatchを返す
+	Put(hash string, src io.Reader, size int64) error
+	Open(hash string) (io.ReadCloser, error)
+	// ジャッジデータのディレクトリのdstにコピーする。
+	// ジャッジデータはサンドボックスから書き込めるので、保存したファイルをハードリンクしてはいけない
+	Copy(hash, dst string) error
+	Delete(hash string) error
+}
+
+var store Store
+
+// kindが空文字列のときはdirにファイルとして保存する。dirが空のときはtest_dataを使う。
+// s3のときもdirはダウンロードしたファイルのキャッシュとして使う
+func Init(kind, dir string, s3 S3Config) error {
+	if dir == "" {
+		dir = defaultDir
+	}
+
+	var err error
+	switch kind {
+	case "", StoreLocal:
+		store, err = NewLocalStore(dir)
+	case StoreS3:
+		store, err = NewS3Store(s3, dir)
+	default:
+		err = errUnknownStore
+	}
+	if err != nil {
+		logger.AppLog.Errorf("test data store(%v) error: %+v", kind, err)
+	}
+	return err
+}
+
+func Hash(content []byte) string {
+	h := sha256.Sum256(content)
+	return hex.EncodeToString(h[:])
+}
+
+func Put(hash string, src io.Reader, size int64) error {
+	if store == nil {
+		return errStoreNotReady
+	}
+	return store.Put(hash, src, size)
+}
+
+func Open(hash string) (io.ReadCloser, error) {
+	if store == nil {
+		return nil, errStoreNotReady
+	}
+	return store.Open(hash)
+}
+
+func Copy(hash, dst string) error {
+	if store == nil {
+		return errStoreNotReady
+	}
+	return store.Copy(hash, dst)
+}
+
+func Delete(hash string) error {
+	if store == nil {
+		return errStoreNotReady
+	}
+	return store.Delete(hash)
+}
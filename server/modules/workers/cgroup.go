@@ -0,0 +1,122 @@
+package workers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/unique"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ホストでcgroup v2がマウントされている場所
+	hostCgroupMountPoint = "/sys/fs/cgroup"
+	sandboxCgroupPrefix  = "koj-"
+	// runner自身が使うメモリとプロセス (スレッド) 数
+	runnerMemoryMargin = 10 * 1024 * 1024
+	runnerPidsMargin   = 10
+)
+
+var (
+	errCgroupParentRequired = errors.New("cgroupParent is required to measure and limit test cases")
+	// サンドボックスごとのcgroupを作成するディレクトリ
+	cgroupParent string
+)
+
+// runnerはサンドボックスに渡されたcgroupの下にテストケースごとのcgroupを作るので、
+// どのサンドボックスでもcgroupParentは必須
+func initCgroupParent(dir string) error {
+	if dir == "" {
+		return errCgroupParentRequired
+	}
+	dir = filepath.Clean(dir)
+	if !strings.HasPrefix(dir, hostCgroupMountPoint+"/") {
+		return errors.Errorf("cgroupParent must be under %v: %v", hostCgroupMountPoint, dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cgroup.controllers")); err != nil {
+		return errors.Wrap(err, "cgroupParent is not a cgroup v2 directory")
+	}
+
+	// サンドボックスごとのcgroupでメモリとプロセス数を制限できるようにする
+	err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+memory +pids"), 0644)
+	if err != nil {
+		return err
+	}
+	cgroupParent = dir
+	return nil
+}
+
+// テストケースはCPUごとに並列に実行されるので、サンドボックス全体ではCPUの数だけメモリとプロセス数を確保する。
+// テストケースごとの制限はrunnerがテストケースごとのcgroupにかけるので、同時に実行しているテストケースが互いの分を使うことはない
+func sandboxLimits(memoryLimit int64, cpus []int) (memory, pids int64) {
+	n := int64(len(cpus))
+	if n == 0 {
+		n = 1
+	}
+	return memoryLimit*n + runnerMemoryMargin, CasePidsLimit*n + runnerPidsMargin
+}
+
+// サンドボックス1つ分のcgroupを作成する。memoryLimitとpidsLimitが0以下のときは、それぞれ制限しない
+func createSandboxCgroup(memoryLimit, pidsLimit int64) (string, error) {
+	id, err := unique.GenerateRandomBase62String(24)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cgroupParent, sandboxCgroupPrefix+id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+
+	// runnerがテストケースごとに子のcgroupを作れるようにする
+	err = ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+memory +pids"), 0644)
+	if err == nil && 0 < memoryLimit {
+		err = ioutil.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatInt(memoryLimit, 10)), 0644)
+		// swapが無効な環境ではファイル自体がない
+		_ = ioutil.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0644)
+	}
+	if err == nil && 0 < pidsLimit {
+		err = ioutil.WriteFile(filepath.Join(dir, "pids.max"), []byte(strconv.FormatInt(pidsLimit, 10)), 0644)
+	}
+	if err != nil {
+		removeCgroupTree(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// Dockerに渡す、cgroupのルートから見たパス
+func dockerCgroupParent(dir string) string {
+	return strings.TrimPrefix(dir, hostCgroupMountPoint)
+}
+
+// runnerやDockerが作った子のcgroupも含めて、深いものから順に削除する
+func removeCgroupTree(dir string) error {
+	dirs := make([]string, 0)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.AppLog.Errorf("worker: cgroup remove error %+v", err)
+		return err
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		if err := os.Remove(d); err != nil {
+			logger.AppLog.Errorf("worker: cgroup remove error %+v", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package workers
+
+import (
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ジャッジに使うCPUを、同時に2つのサンドボックスで共有しないように貸し出す
+type cpuAllocator struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	free []int
+}
+
+var cpuPool = newCPUAllocator(nil)
+
+func newCPUAllocator(cpus []int) *cpuAllocator {
+	if len(cpus) == 0 {
+		cpus = make([]int, runtime.NumCPU())
+		for i := range cpus {
+			cpus[i] = i
+		}
+	}
+
+	a := &cpuAllocator{
+		free: append([]int{}, cpus...),
+	}
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+// cpusが空のときはすべてのCPUを使う
+func InitCPUs(cpus []int) {
+	cpuPool = newCPUAllocator(cpus)
+}
+
+// 空いているCPUを1つ以上、最大でn個借りる。1つも空いていなければ空くまで待つ
+func (a *cpuAllocator) acquire(n int) []int {
+	if n < 1 {
+		n = 1
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for len(a.free) == 0 {
+		a.cond.Wait()
+	}
+
+	if len(a.free) < n {
+		n = len(a.free)
+	}
+	res := append([]int{}, a.free[:n]...)
+	a.free = a.free[n:]
+	return res
+}
+
+func (a *cpuAllocator) release(cpus []int) {
+	if len(cpus) == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.free = append(a.free, cpus...)
+	sort.Ints(a.free)
+	a.cond.Broadcast()
+}
+
+// Dockerのcpusetやrunnerに渡す、"0,2,3" のような形式にする
+func formatCPUList(cpus []int) string {
+	s := make([]string, len(cpus))
+	for i, c := range cpus {
+		s[i] = strconv.Itoa(c)
+	}
+	return strings.Join(s, ",")
+}
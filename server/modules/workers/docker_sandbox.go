@@ -0,0 +1,381 @@
+package workers
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"golang.org/x/net/context"
+)
+
+// コマンドごとにDockerのコンテナを作成して実行するサンドボックス
+type dockerSandbox struct {
+	id        string
+	cli       *client.Client
+	judgeData string
+	cgroupDir string
+	// プールから借りたコンテナのときだけ設定される。コマンドはexecで実行する
+	pooled *pooledContainer
+	cmd    []string
+	// キャンセルされて強制終了したコンテナは、プールに戻さずに捨てる
+	killed bool
+}
+
+func newDockerSandbox(img string, memoryLimit int64, cpus []int, cmd []string, judgeData bool, interaction string) (Sandbox, error) {
+	ctx := context.Background()
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &dockerSandbox{
+		cli: cli,
+		cmd: cmd,
+	}
+
+	var mounts []mount.Mount
+	if judgeData {
+		s.judgeData, err = createJudgeDataDir()
+		if err != nil {
+			logger.AppLog.Error(err)
+			return nil, err
+		}
+		// プールのコンテナと同じく、制限はジョブごとにDockerで変更する
+		s.cgroupDir, err = createSandboxCgroup(0, 0)
+		if err != nil {
+			logger.AppLog.Error(err)
+			os.RemoveAll(s.judgeData)
+			return nil, err
+		}
+		mounts = runnerMounts(s.judgeData, s.cgroupDir)
+	}
+	if interaction != "" {
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   interaction,
+			Target:   InteractionDir,
+			ReadOnly: false,
+		})
+	}
+
+	cfg := &container.Config{
+		Image:        img,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		OpenStdin:    true,
+		StdinOnce:    true,
+		Tty:          false,
+		WorkingDir:   Workspace,
+		Cmd:          cmd,
+	}
+	hcfg := &container.HostConfig{
+		Resources:    newResources(memoryLimit, cpus),
+		NetworkMode:  "none",
+		Mounts:       mounts,
+		CgroupParent: dockerCgroupParent(s.cgroupDir),
+	}
+
+	res, err := cli.ContainerCreate(ctx, cfg, hcfg, &network.NetworkingConfig{}, "")
+	if err != nil {
+		logger.AppLog.Errorf("error %v %+v", img, err)
+		if s.judgeData != "" {
+			os.RemoveAll(s.judgeData)
+			removeCgroupTree(s.cgroupDir)
+		}
+		return nil, err
+	}
+	s.id = res.ID
+
+	return s, nil
+}
+
+func dockerImageID(img string) (string, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+
+	info, _, err := cli.ImageInspectWithRaw(context.Background(), img)
+	if err != nil {
+		return "", err
+	}
+	return info.ID, nil
+}
+
+// プールに空きがあれば、待機中のコンテナを使うサンドボックスを返す。
+// プールを使わない設定のときや空きがないときはnilを返すので、newDockerSandboxで作成すること。
+func acquireDockerSandbox(img string, memoryLimit int64, cpus []int, cmd []string) (*dockerSandbox, error) {
+	if pool == nil {
+		return nil, nil
+	}
+
+	c, err := pool.acquire(img)
+	if err != nil || c == nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	_, err = pool.cli.ContainerUpdate(ctx, c.id, container.UpdateConfig{
+		Resources: newResources(memoryLimit, cpus),
+	})
+	if err != nil {
+		logger.AppLog.Errorf("pool: update error %+v", err)
+		pool.discard(c)
+		return nil, err
+	}
+
+	s := &dockerSandbox{
+		id:        c.id,
+		cli:       pool.cli,
+		judgeData: c.judgeData,
+		cgroupDir: c.cgroupDir,
+		pooled:    c,
+		cmd:       cmd,
+	}
+	return s, nil
+}
+
+// judge_dataと、runnerがテストケースごとのcgroupを作るためのサンドボックスのcgroupをマウントする。
+// コンテナはCgroupParentでサンドボックスのcgroupの下に作らせるので、runnerはマウントしたcgroupの中に自分を見つけられる。
+// DockerのcgroupドライバーはcgroupParentのパスをそのまま使うcgroupfsにしておくこと
+func runnerMounts(judgeData, cgroupDir string) []mount.Mount {
+	return []mount.Mount{
+		{
+			Type:     mount.TypeBind,
+			Source:   judgeData,
+			Target:   JudgeDataDir,
+			ReadOnly: false,
+		},
+		{
+			Type:     mount.TypeBind,
+			Source:   cgroupDir,
+			Target:   hostCgroupMountPoint,
+			ReadOnly: false,
+		},
+	}
+}
+
+// cpusが空のときはCPUを制限しない
+func newResources(memoryLimit int64, cpus []int) container.Resources {
+	memory, pids := sandboxLimits(memoryLimit, cpus)
+	return container.Resources{
+		CpusetCpus: formatCPUList(cpus),
+		PidsLimit:  pids,
+		Memory:     memory,
+		MemorySwap: memory,
+	}
+}
+
+func (s *dockerSandbox) ID() string {
+	return s.id
+}
+
+func (s *dockerSandbox) HostJudgeDataDir() string {
+	return s.judgeData
+}
+
+func (s *dockerSandbox) Run(ctx context.Context, input io.Reader, stdout, stderr io.Writer) error {
+	hijacked, start, err := s.attach(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	defer hijacked.Close()
+
+	// ctxをキャンセルしてもコンテナの中のプロセスは止まらないので、コンテナごと止める
+	stopped := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			s.kill()
+			hijacked.Close()
+		case <-stopped:
+		}
+	}()
+	defer func() {
+		close(stopped)
+		<-watched
+	}()
+
+	startErrChan := make(chan error)
+	go func() {
+		startErrChan <- start()
+	}()
+
+	streamErrChan := make(chan error)
+	go func() {
+		_, err := io.Copy(hijacked.Conn, input)
+		if err != nil {
+			streamErrChan <- err
+			return
+		}
+
+		hijacked.CloseWrite()
+
+		_, err = stdcopy.StdCopy(stdout, stderr, hijacked.Reader)
+		streamErrChan <- err
+	}()
+
+	err = <-startErrChan
+	if err == nil {
+		err = <-streamErrChan
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (s *dockerSandbox) kill() {
+	s.killed = true
+	ctx, cancel := context.WithTimeout(context.Background(), removeTimeout)
+	defer cancel()
+
+	if err := s.cli.ContainerKill(ctx, s.id, "SIGKILL"); err != nil {
+		logger.AppLog.Errorf("worker: kill error %v %+v", s.id, err)
+	}
+}
+
+// コンテナの標準入出力につないで、実行を始める関数を返す
+func (s *dockerSandbox) attach(ctx context.Context) (types.HijackedResponse, func() error, error) {
+	if s.pooled == nil {
+		opt := types.ContainerAttachOptions{
+			Stream: true,
+			Stdin:  true,
+			Stdout: true,
+			Stderr: true,
+		}
+		hijacked, err := s.cli.ContainerAttach(ctx, s.id, opt)
+		start := func() error {
+			return s.cli.ContainerStart(ctx, s.id, types.ContainerStartOptions{})
+		}
+		return hijacked, start, err
+	}
+
+	// execではWorkingDirを指定できないので、シェルで移動してから実行する
+	cmd := append([]string{"/bin/sh", "-c", "cd " + Workspace + ` && exec "$@"`, "sh"}, s.cmd...)
+	cfg := types.ExecConfig{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd,
+	}
+	e, err := s.cli.ContainerExecCreate(ctx, s.id, cfg)
+	if err != nil {
+		return types.HijackedResponse{}, nil, err
+	}
+	// ContainerExecAttachを呼んだ時点で実行が始まる
+	hijacked, err := s.cli.ContainerExecAttach(ctx, e.ID, cfg)
+	start := func() error {
+		return nil
+	}
+	return hijacked, start, err
+}
+
+func (s *dockerSandbox) WriteFile(src io.Reader, size int64, mode os.FileMode, dst string) (FileDigest, error) {
+	if fileSizeLimit < size {
+		return FileDigest{}, ErrFileTooLarge
+	}
+
+	ctx := context.Background()
+	r, ch := newTarStream(src, size, mode, dst)
+	err := s.cli.CopyToContainer(ctx, s.id, path.Dir(dst), r, types.CopyToContainerOptions{})
+	// CopyToContainerが途中で失敗したときに、書き込み側が止まらないようにする
+	r.Close()
+	res := <-ch
+	if res.err != nil && res.err != io.ErrClosedPipe {
+		logger.AppLog.Error(res.err)
+		return FileDigest{}, res.err
+	}
+	if err != nil {
+		logger.AppLog.Error(err)
+		return FileDigest{}, err
+	}
+
+	// コンテナの中で途中までしか書き込まれていないことがないか確かめる
+	written, err := s.Stat(dst)
+	if err != nil {
+		return FileDigest{}, err
+	}
+	if written != res.digest.Size {
+		logger.AppLog.Errorf("%v: %v %v != %v", ErrTruncatedTransfer, dst, written, res.digest.Size)
+		return FileDigest{}, ErrTruncatedTransfer
+	}
+
+	return res.digest, nil
+}
+
+func (s *dockerSandbox) ReadFile(p string, dst io.Writer, limit int64) (FileDigest, error) {
+	ctx := context.Background()
+	r, stat, err := s.cli.CopyFromContainer(ctx, s.id, p)
+	if err != nil {
+		logger.AppLog.Errorf("%+v", err)
+		return FileDigest{}, err
+	}
+	defer r.Close()
+
+	if limit < stat.Size {
+		return FileDigest{}, ErrFileTooLarge
+	}
+
+	d, err := copyFromTar(dst, r, limit)
+	if err != nil {
+		logger.AppLog.Errorf("%v: %+v", p, err)
+		return FileDigest{}, err
+	}
+	return d, nil
+}
+
+func (s *dockerSandbox) Stat(p string) (int64, error) {
+	ctx := context.Background()
+	stat, err := s.cli.ContainerStatPath(ctx, s.id, p)
+	if err != nil {
+		logger.AppLog.Errorf("%+v", err)
+		return 0, err
+	}
+	return stat.Size, nil
+}
+
+func (s *dockerSandbox) Remove() error {
+	if s.pooled != nil {
+		// コンテナは削除せずにプールに戻す
+		if s.killed {
+			pool.discard(s.pooled)
+		} else {
+			pool.release(s.pooled)
+		}
+		s.pooled = nil
+		return nil
+	}
+
+	ctx, _ := context.WithTimeout(context.Background(), removeTimeout)
+	err := s.cli.ContainerRemove(ctx, s.id, types.ContainerRemoveOptions{
+		Force: true,
+	})
+	if err != nil {
+		logger.AppLog.Errorf("worker: remove error %+v", err)
+	}
+	s.cli.Close()
+
+	if s.judgeData != "" {
+		os.RemoveAll(s.judgeData)
+	}
+	if s.cgroupDir != "" {
+		removeCgroupTree(s.cgroupDir)
+	}
+
+	return err
+}
@@ -0,0 +1,125 @@
+package workers
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/unique"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// インタラクティブな問題で、提出されたプログラムとインタラクタの両方のサンドボックスにマウントするディレクトリ。
+// テストケースごとの名前付きパイプを置いて、別々のイメージで動く2つのプログラムの標準入出力を交差させてつなぐ
+const InteractionDir = Workspace + "interaction"
+
+// テストケースの名前に付けるパイプの拡張子
+const (
+	// インタラクタが書き込んで、提出されたプログラムが標準入力から読む
+	InteractionInputExt = ".in"
+	// 提出されたプログラムが標準出力に書き込んで、インタラクタが読む
+	InteractionOutputExt = ".out"
+)
+
+var (
+	errNotInteractive = errors.New("the worker is not created for an interactive problem")
+	// 片方のrunnerが終了したあと、もう片方が時間内に終了しなかった
+	ErrInteractionTimeout = errors.New("interaction timed out")
+)
+
+// インタラクタを1つのコンテナの中でテストケースごとに実行する。
+// 入力はjudge_data/input、想定解はjudge_data/answer、インタラクタの実行ファイルはjudge_data/interactorに置いておくこと。
+// インタラクタは`cmd... 入力 想定解 結果`のように起動されて、結果に書き込んだ内容がExecResultのStdoutになる。
+// サンドボックスはpeerと同じCPUを使い、peerのCreateInteractionPipesで作ったパイプで提出されたプログラムとつながる
+func NewInteractorWorker(img string, timeLimit, wallTimeLimit time.Duration, memoryLimit int64, peer *Worker, cmd []string) (*Worker, error) {
+	if peer.interaction == "" {
+		return nil, errNotInteractive
+	}
+
+	sp, err := newSeparator()
+	if err != nil {
+		return nil, err
+	}
+
+	runCmd := []string{
+		"./runner",
+		strconv.FormatInt(int64(timeLimit), 10),
+		strconv.FormatInt(int64(wallTimeLimit), 10),
+		strconv.FormatInt(memoryLimit, 10),
+		seccompProfileNone,
+		interactorArg,
+	}
+	runCmd = append(runCmd, cmd...)
+
+	w, err := newWorkerWithCPUs(img, timeLimit, memoryLimit, peer.cpus, runCmd, true, peer.interaction)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
+	return setupRunnerWorker(w, sp)
+}
+
+// 0からn-1までのテストケースごとに、インタラクタとつなぐ名前付きパイプを作る。
+// パイプを開くのはどちらもrootで動くrunnerなので、ほかのユーザーからは開けないようにしておく
+func (w *Worker) CreateInteractionPipes(n int) error {
+	if w.interaction == "" {
+		return errNotInteractive
+	}
+	for i := 0; i < n; i++ {
+		for _, ext := range []string{InteractionInputExt, InteractionOutputExt} {
+			p := filepath.Join(w.interaction, strconv.Itoa(i)+ext)
+			if err := syscall.Mkfifo(p, 0600); err != nil {
+				logger.AppLog.Error(err)
+				return &os.PathError{Op: "mkfifo", Path: p, Err: err}
+			}
+		}
+	}
+	return nil
+}
+
+// 提出されたプログラムのWorkerとインタラクタのWorkerを同時に実行する。
+// runnerはパイプの相手が開くまで待つので、片方が先に終了したときは、もう片方がtimeout以内に終了しなければ止める
+func RunInteraction(ctx context.Context, w, interactor *Worker, timeout time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error, 2)
+	for _, x := range []*Worker{w, interactor} {
+		go func(x *Worker) {
+			_, err := x.RunContext(ctx, "", false)
+			errCh <- err
+		}(x)
+	}
+
+	if err := <-errCh; err != nil {
+		cancel()
+		<-errCh
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+		cancel()
+		<-errCh
+		logger.AppLog.Errorf("%v: %v %v", ErrInteractionTimeout, w.ID, interactor.ID)
+		return ErrInteractionTimeout
+	}
+}
+
+func createInteractionDir() (string, error) {
+	id, err := unique.GenerateRandomBase62String(12)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return "", err
+	}
+	dir := "/tmp/judge_data/interaction" + id
+	return dir, os.MkdirAll(dir, 0700)
+}
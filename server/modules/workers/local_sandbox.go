@@ -0,0 +1,318 @@
+package workers
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/unique"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// runnerに名前空間の中でchrootさせるときの第1引数
+	localSandboxArg = "--sandbox"
+	// runnerがサンドボックスの準備に失敗したときの終了コード
+	localSandboxErrorExitCode = 125
+	localSandboxDir           = "/tmp/koj-local/"
+	// rootfsを展開したときに、元のイメージのIDを書いておくファイルの拡張子
+	localImageIDExt = ".id"
+)
+
+var (
+	errOutsideWorkspace   = errors.New("path is outside of the workspace")
+	errLocalSandboxSetup  = errors.New("local sandbox setup failed")
+	errNotRegularFile     = errors.New("not a regular file")
+	localSandboxRootfsDir string
+)
+
+// Dockerデーモンを使わずに、runnerをホストで名前空間を分けて実行するサンドボックス。
+// rootfsはイメージごとに共有して、/tmpとワークスペースだけをサンドボックスごとに用意する。
+type localSandbox struct {
+	id        string
+	rootfs    string
+	workspace string
+	judgeData string
+	// InteractionDirにマウントするホストのディレクトリ。インタラクティブな問題でなければ空文字列
+	interaction string
+	cgroupDir   string
+	cpus        []int
+	cmd         []string
+}
+
+func initLocalSandbox(rootfsDir string) error {
+	if rootfsDir == "" {
+		return errors.New("rootfsDir is required for the local sandbox")
+	}
+	// ワークスペースの親はrootだけが入れるようにする。/tmpの下なので、ほかのユーザーが先に作っていないか確かめる
+	if err := os.MkdirAll(localSandboxDir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(localSandboxDir)
+	if err != nil {
+		return err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); !info.IsDir() || !ok || int(st.Uid) != os.Getuid() {
+		return errors.Errorf("%v is not a directory owned by the server", localSandboxDir)
+	}
+	if err := os.Chmod(localSandboxDir, 0700); err != nil {
+		return err
+	}
+
+	localSandboxRootfsDir = rootfsDir
+	return nil
+}
+
+func localRootfs(img string) string {
+	return filepath.Join(localSandboxRootfsDir, strings.NewReplacer("/", "_", ":", "_").Replace(img))
+}
+
+// rootfsの隣の<イメージ名>.idに書いておいたIDを返す
+func localImageID(img string) (string, error) {
+	b, err := ioutil.ReadFile(localRootfs(img) + localImageIDExt)
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(string(b))
+	if id == "" {
+		return "", errors.Errorf("image id of %v is empty", img)
+	}
+	return id, nil
+}
+
+func newLocalSandbox(img string, memoryLimit int64, cpus []int, cmd []string, judgeData bool, interaction string) (Sandbox, error) {
+	rootfs := localRootfs(img)
+	if _, err := os.Stat(rootfs); err != nil {
+		logger.AppLog.Errorf("rootfs of %v is not found: %+v", img, err)
+		return nil, err
+	}
+
+	id, err := unique.GenerateRandomBase62String(24)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
+
+	s := &localSandbox{
+		id:          id,
+		rootfs:      rootfs,
+		workspace:   filepath.Join(localSandboxDir, id),
+		interaction: interaction,
+		cpus:        cpus,
+		cmd:         cmd,
+	}
+	// 提出されたプログラムはnobodyでワークスペースに書き込む
+	if err := os.Mkdir(s.workspace, 0777); err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
+	if err := os.Chmod(s.workspace, 0777); err != nil {
+		logger.AppLog.Error(err)
+		s.Remove()
+		return nil, err
+	}
+
+	if judgeData {
+		s.judgeData = filepath.Join(s.workspace, "judge_data")
+		if err := os.Mkdir(s.judgeData, 0700); err != nil {
+			logger.AppLog.Error(err)
+			s.Remove()
+			return nil, err
+		}
+	}
+
+	s.cgroupDir, err = createSandboxCgroup(sandboxLimits(memoryLimit, cpus))
+	if err != nil {
+		logger.AppLog.Error(err)
+		s.Remove()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *localSandbox) ID() string {
+	return s.id
+}
+
+func (s *localSandbox) HostJudgeDataDir() string {
+	return s.judgeData
+}
+
+func (s *localSandbox) Run(ctx context.Context, input io.Reader, stdout, stderr io.Writer) error {
+	runner, err := filepath.Abs("../runner/runner")
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{localSandboxArg, s.cgroupDir, formatCPUList(s.cpus), s.rootfs, s.workspace, s.interaction}, s.cmd...)
+	cmd := exec.CommandContext(ctx, runner, args...)
+	cmd.Stdin = input
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | syscall.CLONE_NEWNET,
+		Pdeathsig:  syscall.SIGKILL,
+	}
+
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		// runnerが殺されると、PID名前空間の中のプロセスもすべて終了する
+		return ctx.Err()
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// コマンドが0以外で終了するのはDockerのときと同じく正常な結果として扱う
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == localSandboxErrorExitCode {
+			return errLocalSandboxSetup
+		}
+		return nil
+	}
+	return err
+}
+
+// サンドボックスの中のパスを、ワークスペースからの相対パスに変換する
+func (s *localSandbox) relPath(p string) (string, error) {
+	if !strings.HasPrefix(p, Workspace) {
+		return "", errOutsideWorkspace
+	}
+	rel := strings.TrimPrefix(filepath.Clean("/"+strings.TrimPrefix(p, Workspace)), "/")
+	if rel == "" {
+		return "", errOutsideWorkspace
+	}
+	return rel, nil
+}
+
+// ワークスペースはサンドボックスの中から書き換えられるので、ホストのファイルを指すシンボリックリンクや
+// ハードリンクを置かれても、ワークスペースの外のファイルを読み書きしないように開く。
+// パスのすべての要素をO_NOFOLLOWでたどって、1つしかリンクのない通常のファイルだけを返す
+func (s *localSandbox) openFile(p string, flag int, perm os.FileMode) (*os.File, error) {
+	rel, err := s.relPath(p)
+	if err != nil {
+		return nil, err
+	}
+
+	const dirFlags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	dir, err := syscall.Open(s.workspace, dirFlags, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: s.workspace, Err: err}
+	}
+	names := strings.Split(rel, "/")
+	for _, name := range names[:len(names)-1] {
+		next, err := syscall.Openat(dir, name, dirFlags, 0)
+		syscall.Close(dir)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: p, Err: err}
+		}
+		dir = next
+	}
+	// FIFOを開いて止まらないように、O_NONBLOCKで開く
+	fd, err := syscall.Openat(dir, names[len(names)-1], flag|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, uint32(perm))
+	syscall.Close(dir)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+
+	f := os.NewFile(uintptr(fd), filepath.Join(s.workspace, rel))
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); !info.Mode().IsRegular() || !ok || st.Nlink != 1 {
+		f.Close()
+		return nil, errNotRegularFile
+	}
+	return f, nil
+}
+
+func (s *localSandbox) WriteFile(src io.Reader, size int64, mode os.FileMode, dst string) (FileDigest, error) {
+	if fileSizeLimit < size {
+		return FileDigest{}, ErrFileTooLarge
+	}
+
+	// 開いてから確かめるので、ほかのファイルへのハードリンクを切り詰めないようにO_TRUNCは使わない
+	f, err := s.openFile(dst, syscall.O_WRONLY|syscall.O_CREAT, mode)
+	if err != nil {
+		logger.AppLog.Errorf("%v: %+v", dst, err)
+		return FileDigest{}, err
+	}
+	var d FileDigest
+	err = f.Truncate(0)
+	if err == nil {
+		d, err = copyExact(f, src, size)
+	}
+	if err == nil {
+		// umaskの影響を受けないようにする
+		err = f.Chmod(mode)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		logger.AppLog.Errorf("%v: %+v", dst, err)
+		return FileDigest{}, err
+	}
+	return d, nil
+}
+
+func (s *localSandbox) ReadFile(path string, dst io.Writer, limit int64) (FileDigest, error) {
+	f, err := s.openFile(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		logger.AppLog.Errorf("%v: %+v", path, err)
+		return FileDigest{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		logger.AppLog.Error(err)
+		return FileDigest{}, err
+	}
+	if limit < info.Size() {
+		return FileDigest{}, ErrFileTooLarge
+	}
+
+	d, err := copyExact(dst, f, info.Size())
+	if err != nil {
+		logger.AppLog.Errorf("%v: %+v", path, err)
+		return FileDigest{}, err
+	}
+	return d, nil
+}
+
+func (s *localSandbox) Stat(path string) (int64, error) {
+	f, err := s.openFile(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *localSandbox) Remove() error {
+	err := os.RemoveAll(s.workspace)
+	if err != nil {
+		logger.AppLog.Errorf("worker: remove error %+v", err)
+	}
+
+	if s.cgroupDir != "" {
+		if cgErr := removeCgroupTree(s.cgroupDir); cgErr != nil {
+			if err == nil {
+				err = cgErr
+			}
+		}
+	}
+
+	return err
+}
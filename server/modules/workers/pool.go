@@ -0,0 +1,386 @@
+package workers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/ProgrammingLab/koneko-online-judge/server/modules/unique"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	poolHealthCheckInterval = time.Minute
+	poolResetTimeout        = 10 * time.Second
+	// 実行するときにジョブごとの制限とCPUに変更する
+	poolInitialMemoryLimit = 512 * 1024 * 1024
+)
+
+var errUnhealthyContainer = errors.New("pooled container is not running")
+
+// 待機させておくコンテナ。ジャッジデータのディレクトリは作成時にマウントしたものを使い回す。
+type pooledContainer struct {
+	id        string
+	image     string
+	judgeData string
+	// Workspaceにマウントするホストのディレクトリ。ジョブが終わるたびにホストから空にする
+	workspace string
+	cgroupDir string
+}
+
+// プールのコンテナはrootfsを読み込み専用にして、提出されたプログラムが書き込める場所をこのtmpfsとWorkspace、
+// Dockerが用意する/dev/shmと/dev/mqueueだけにする。resetでそれらを空にすれば、前のジョブの痕跡は残らない
+var poolTmpfs = map[string]string{
+	"/tmp":     "rw,nosuid,nodev,mode=1777",
+	"/var/tmp": "rw,nosuid,nodev,mode=1777",
+}
+
+// イメージごとに作成済みのコンテナを使い回すためのプール。
+// コンテナは`sleep infinity`で待機させておいて、コマンドはexecで実行する。
+type containerPool struct {
+	mu          sync.Mutex
+	cli         *client.Client
+	maxPerImage int
+	idle        map[string][]*pooledContainer
+	// 貸し出し中も含めた、イメージごとのコンテナの数
+	sizes map[string]int
+	stop  chan struct{}
+}
+
+var pool *containerPool
+
+// maxPerImageが0のときはプールを使わずに、毎回コンテナを作成して削除する。
+// Dockerを使わないサンドボックスのときは何もしない。
+func InitPool(maxPerImage int) error {
+	if maxPerImage <= 0 || sandboxType != SandboxDocker {
+		return nil
+	}
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		logger.AppLog.Error(err)
+		return err
+	}
+
+	pool = &containerPool{
+		cli:         cli,
+		maxPerImage: maxPerImage,
+		idle:        map[string][]*pooledContainer{},
+		sizes:       map[string]int{},
+		stop:        make(chan struct{}),
+	}
+	go pool.checkHealthPeriodically()
+	return nil
+}
+
+func StopPool() {
+	if pool == nil {
+		return
+	}
+	close(pool.stop)
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for img, cs := range pool.idle {
+		for _, c := range cs {
+			pool.destroy(c)
+		}
+		delete(pool.idle, img)
+	}
+}
+
+// 待機中のコンテナを取り出す。上限まで作成済みで待機中のものがなければnilを返す。
+func (p *containerPool) acquire(img string) (*pooledContainer, error) {
+	for {
+		p.mu.Lock()
+		cs := p.idle[img]
+		if len(cs) == 0 {
+			if p.maxPerImage <= p.sizes[img] {
+				p.mu.Unlock()
+				return nil, nil
+			}
+			p.sizes[img]++
+			p.mu.Unlock()
+
+			c, err := p.create(img)
+			if err != nil {
+				p.mu.Lock()
+				p.sizes[img]--
+				p.mu.Unlock()
+				return nil, err
+			}
+			return c, nil
+		}
+
+		c := cs[len(cs)-1]
+		p.idle[img] = cs[:len(cs)-1]
+		p.mu.Unlock()
+
+		if err := p.checkHealth(c); err != nil {
+			logger.AppLog.Errorf("pool: %v %+v", c.id, err)
+			p.discard(c)
+			continue
+		}
+		return c, nil
+	}
+}
+
+// 使い終わったコンテナを掃除してプールに戻す。掃除に失敗したら捨てる。
+func (p *containerPool) release(c *pooledContainer) {
+	if err := p.reset(c); err != nil {
+		logger.AppLog.Errorf("pool: reset error %v %+v", c.id, err)
+		p.discard(c)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idle[c.image] = append(p.idle[c.image], c)
+}
+
+func (p *containerPool) create(img string) (*pooledContainer, error) {
+	judgeData, err := createJudgeDataDir()
+	if err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
+	workspace, err := createPoolWorkspaceDir()
+	if err != nil {
+		logger.AppLog.Error(err)
+		os.RemoveAll(judgeData)
+		return nil, err
+	}
+	cgroupDir, err := createSandboxCgroup(0, 0)
+	if err != nil {
+		logger.AppLog.Error(err)
+		os.RemoveAll(judgeData)
+		os.RemoveAll(workspace)
+		return nil, err
+	}
+
+	cfg := &container.Config{
+		Image:      img,
+		Tty:        false,
+		WorkingDir: Workspace,
+		Cmd:        []string{"sleep", "infinity"},
+	}
+	// docker cpは読み込み専用のrootfsには書き込めないので、Workspaceはホストのディレクトリをマウントする
+	mounts := append(runnerMounts(judgeData, cgroupDir), mount.Mount{
+		Type:     mount.TypeBind,
+		Source:   workspace,
+		Target:   strings.TrimSuffix(Workspace, "/"),
+		ReadOnly: false,
+	})
+	hcfg := &container.HostConfig{
+		Resources:      newResources(poolInitialMemoryLimit, nil),
+		NetworkMode:    "none",
+		Mounts:         mounts,
+		CgroupParent:   dockerCgroupParent(cgroupDir),
+		ReadonlyRootfs: true,
+		Tmpfs:          poolTmpfs,
+	}
+
+	ctx := context.Background()
+	res, err := p.cli.ContainerCreate(ctx, cfg, hcfg, &network.NetworkingConfig{}, "")
+	if err != nil {
+		logger.AppLog.Errorf("pool: create error %v %+v", img, err)
+		os.RemoveAll(judgeData)
+		os.RemoveAll(workspace)
+		removeCgroupTree(cgroupDir)
+		return nil, err
+	}
+
+	c := &pooledContainer{
+		id:        res.ID,
+		image:     img,
+		judgeData: judgeData,
+		workspace: workspace,
+		cgroupDir: cgroupDir,
+	}
+	if err := p.cli.ContainerStart(ctx, c.id, types.ContainerStartOptions{}); err != nil {
+		logger.AppLog.Errorf("pool: start error %v %+v", img, err)
+		p.destroy(c)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (p *containerPool) checkHealth(c *pooledContainer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), poolResetTimeout)
+	defer cancel()
+
+	info, err := p.cli.ContainerInspect(ctx, c.id)
+	if err != nil {
+		return err
+	}
+	if info.State == nil || !info.State.Running {
+		return errUnhealthyContainer
+	}
+	return nil
+}
+
+// 前のジョブのプロセスとファイルを残さないようにする。
+// rootfsは読み込み専用なので、書き込める場所をすべて空にすれば元の状態に戻る
+func (p *containerPool) reset(c *pooledContainer) error {
+	if err := p.checkHealth(c); err != nil {
+		return err
+	}
+
+	// kill -9 -1 は自分とPID 1以外のすべてのプロセスを殺す。
+	// 提出されたプログラム同士で情報をやり取りできないように、一時ファイルとSystem VのIPCも消しておく。
+	// 消しきれなかったときは0以外で終了させて、コンテナごと捨てる
+	cmd := []string{
+		"/bin/sh", "-c",
+		"kill -9 -1; " +
+			"for d in " + strings.Join(poolWritableDirs, " ") + "; do " +
+			`if [ -d "$d" ]; then find "$d" -mindepth 1 -maxdepth 1 ! -path ` + strings.TrimSuffix(Workspace, "/") + " -exec rm -rf {} + || exit 1; fi; " +
+			"done; " +
+			"ipcrm -a 2>/dev/null; " +
+			"for f in shm msg sem; do " +
+			`[ ! -f /proc/sysvipc/$f ] || [ "$(wc -l < /proc/sysvipc/$f)" -le 1 ] || exit 1; ` +
+			"done",
+	}
+	code, err := p.exec(c.id, cmd)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return errors.Errorf("reset command exited with %v", code)
+	}
+
+	// judge_dataはマウント先なので、ディレクトリは残して中身だけを消す
+	if err := removeDirContents(c.workspace, "judge_data"); err != nil {
+		return err
+	}
+	return removeDirContents(c.judgeData, "")
+}
+
+// Workspaceのほかに、コンテナの中で提出されたプログラムが書き込める場所
+var poolWritableDirs = []string{"/tmp", "/var/tmp", "/dev/shm", "/dev/mqueue"}
+
+// dirの中をkeep以外すべて削除する。シンボリックリンクはたどらない
+func removeDirContents(dir, keep string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Name() == keep {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createPoolWorkspaceDir() (string, error) {
+	id, err := unique.GenerateRandomBase62String(12)
+	if err != nil {
+		logger.AppLog.Error(err)
+		return "", err
+	}
+	dir := "/tmp/judge_data/workspace" + id
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// イメージのWorkspaceと同じく、提出されたプログラムがnobodyで書き込めるようにする
+	return dir, os.Chmod(dir, 0777)
+}
+
+func (p *containerPool) exec(id string, cmd []string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), poolResetTimeout)
+	defer cancel()
+
+	e, err := p.cli.ContainerExecCreate(ctx, id, types.ExecConfig{Cmd: cmd})
+	if err != nil {
+		return 0, err
+	}
+	if err := p.cli.ContainerExecStart(ctx, e.ID, types.ExecStartCheck{}); err != nil {
+		return 0, err
+	}
+
+	for {
+		info, err := p.cli.ContainerExecInspect(ctx, e.ID)
+		if err != nil {
+			return 0, err
+		}
+		if !info.Running {
+			return info.ExitCode, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (p *containerPool) discard(c *pooledContainer) {
+	p.destroy(c)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sizes[c.image]--
+}
+
+func (p *containerPool) destroy(c *pooledContainer) {
+	ctx, cancel := context.WithTimeout(context.Background(), removeTimeout)
+	defer cancel()
+
+	err := p.cli.ContainerRemove(ctx, c.id, types.ContainerRemoveOptions{
+		Force: true,
+	})
+	if err != nil {
+		logger.AppLog.Errorf("pool: remove error %+v", err)
+	}
+	os.RemoveAll(c.judgeData)
+	os.RemoveAll(c.workspace)
+	removeCgroupTree(c.cgroupDir)
+}
+
+// 待機中のコンテナが止まっていたら捨てる
+func (p *containerPool) checkHealthPeriodically() {
+	t := time.NewTicker(poolHealthCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+		}
+
+		p.mu.Lock()
+		idle := p.idle
+		p.idle = map[string][]*pooledContainer{}
+		p.mu.Unlock()
+
+		for _, cs := range idle {
+			for _, c := range cs {
+				if err := p.checkHealth(c); err != nil {
+					logger.AppLog.Errorf("pool: %v %+v", c.id, err)
+					p.discard(c)
+					continue
+				}
+
+				p.mu.Lock()
+				p.idle[c.image] = append(p.idle[c.image], c)
+				p.mu.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package workers
+
+import (
+	"io"
+	"os"
+
+	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// InitSandboxで指定できるサンドボックスの種類
+const (
+	SandboxDocker = "docker"
+	// Dockerを使わずに、ホストでnamespace, cgroup, chrootを使って実行する
+	SandboxLocal = "local"
+)
+
+var errUnknownSandbox = errors.New("unknown sandbox")
+
+// Workerがコマンドを実行する隔離された環境。
+// 中から見えるパスはWorkspace以下で、judge_dataはホストのディレクトリと共有される。
+type Sandbox interface {
+	ID() string
+	// inputを標準入力に渡してコマンドを実行し、終了するまで待つ。
+	// ctxがキャンセルされたら、コマンドを強制終了してctx.Err()を返す
+	Run(ctx context.Context, input io.Reader, stdout, stderr io.Writer) error
+	// srcからsizeバイトを読んで、サンドボックスの中のdstに書き込む
+	WriteFile(src io.Reader, size int64, mode os.FileMode, dst string) (FileDigest, error)
+	// サンドボックスの中のファイルをdstに書き込む。limitバイトより大きければErrFileTooLargeを返す
+	ReadFile(path string, dst io.Writer, limit int64) (FileDigest, error)
+	// サンドボックスの中のファイルの大きさ
+	Stat(path string) (int64, error)
+	// judge_dataをマウントしていないときは空文字列を返す
+	HostJudgeDataDir() string
+	Remove() error
+}
+
+var sandboxType = SandboxDocker
+
+// typ が空文字列のときはDockerを使う。
+// localのときはrootfsDirに、イメージ名のディレクトリでそれぞれのイメージの中身を置いておくこと。
+// cgroupParentはサンドボックスごとのcgroupを作成するcgroup v2のディレクトリで、どちらのサンドボックスでも必須。
+// エラーを返したときは、サンドボックスの種類を変更しない
+func InitSandbox(typ, rootfsDir, cgroupParent string) error {
+	switch typ {
+	case "":
+		typ = SandboxDocker
+	case SandboxDocker:
+	case SandboxLocal:
+		if err := initLocalSandbox(rootfsDir); err != nil {
+			return err
+		}
+	default:
+		logger.AppLog.Errorf("%v: %v", errUnknownSandbox, typ)
+		return errUnknownSandbox
+	}
+
+	if err := initCgroupParent(cgroupParent); err != nil {
+		return err
+	}
+	sandboxType = typ
+	return nil
+}
+
+// イメージの中身が変わると変わるID。イメージ名と違って、同じタグで作り直したイメージを区別できる
+func ImageID(img string) (string, error) {
+	if sandboxType == SandboxLocal {
+		return localImageID(img)
+	}
+	return dockerImageID(img)
+}
+
+// cpusはサンドボックスが使えるCPUで、runnerはCPUごとに1つずつテストケースを並列に実行する。
+// judgeDataがtrueのときは、ホストと共有するjudge_dataのディレクトリを用意する。
+// interactionが空でなければ、そのホストのディレクトリをInteractionDirにマウントする
+func newSandbox(img string, memoryLimit int64, cpus []int, cmd []string, judgeData bool, interaction string) (Sandbox, error) {
+	if sandboxType == SandboxLocal {
+		return newLocalSandbox(img, memoryLimit, cpus, cmd, judgeData, interaction)
+	}
+
+	// プールのコンテナには後からマウントを追加できないので、インタラクティブな問題では毎回作成する
+	if interaction == "" {
+		s, err := acquireDockerSandbox(img, memoryLimit, cpus, cmd)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			return s, nil
+		}
+	}
+	return newDockerSandbox(img, memoryLimit, cpus, cmd, judgeData, interaction)
+}
@@ -0,0 +1,117 @@
+package workers
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ホストとサンドボックスの間でやり取りするファイルの大きさの上限
+const fileSizeLimit = 256 * 1024 * 1024
+
+var (
+	ErrFileTooLarge     = errors.New("file is larger than the limit")
+	ErrChecksumMismatch = errors.New("checksum of the transferred file does not match")
+	// 読み込めたバイト数がファイルの大きさより少ない
+	ErrTruncatedTransfer = errors.New("transferred file is truncated")
+)
+
+// 転送したファイルの大きさとSHA-256
+type FileDigest struct {
+	Size   int64
+	SHA256 string
+}
+
+// 書き込んだ内容の大きさとSHA-256を数えながら、wに書き込む
+type digestWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func newDigestWriter(w io.Writer) *digestWriter {
+	return &digestWriter{
+		w:    w,
+		hash: sha256.New(),
+	}
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	d.hash.Write(p[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+func (d *digestWriter) digest() FileDigest {
+	return FileDigest{
+		Size:   d.size,
+		SHA256: hex.EncodeToString(d.hash.Sum(nil)),
+	}
+}
+
+// srcからちょうどsizeバイトをdstに書き込む。足りなければErrTruncatedTransferを返す
+func copyExact(dst io.Writer, src io.Reader, size int64) (FileDigest, error) {
+	d := newDigestWriter(dst)
+	_, err := io.CopyN(d, src, size)
+	if err == io.EOF {
+		return d.digest(), ErrTruncatedTransfer
+	}
+	return d.digest(), err
+}
+
+type transferResult struct {
+	digest FileDigest
+	err    error
+}
+
+// srcの内容をdstという名前の1つのファイルだけを含むtarにして、一時ファイルを作らずに流す。
+// 流し終わったら、書き込んだ内容の大きさとSHA-256がチャネルに送られる
+func newTarStream(src io.Reader, size int64, mode os.FileMode, dst string) (io.ReadCloser, <-chan transferResult) {
+	pr, pw := io.Pipe()
+	ch := make(chan transferResult, 1)
+
+	go func() {
+		tw := tar.NewWriter(pw)
+		hdr := &tar.Header{
+			Name:     path.Base(dst),
+			Mode:     int64(mode.Perm()),
+			Size:     size,
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		}
+
+		d, err := FileDigest{}, tw.WriteHeader(hdr)
+		if err == nil {
+			d, err = copyExact(tw, src, size)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+		ch <- transferResult{d, err}
+	}()
+
+	return pr, ch
+}
+
+// tarの先頭のファイルを、大きさを確かめながらdstに書き込む
+func copyFromTar(dst io.Writer, src io.Reader, limit int64) (FileDigest, error) {
+	r := tar.NewReader(src)
+	hdr, err := r.Next()
+	if err != nil {
+		return FileDigest{}, err
+	}
+	if limit < hdr.Size {
+		return FileDigest{}, ErrFileTooLarge
+	}
+
+	return copyExact(dst, r, hdr.Size)
+}
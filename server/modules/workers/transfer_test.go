@@ -0,0 +1,51 @@
+package workers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestTarStream(t *testing.T) {
+	inputs := []struct {
+		Content string
+		Size    int64
+		Limit   int64
+	}{
+		{"hello", 5, 10},
+		{"", 0, 10},
+		{strings.Repeat("a", 100000), 100000, 100000},
+		{"hello", 10, 10},
+		{"hello", 5, 4},
+	}
+	outputs := []error{
+		nil,
+		nil,
+		nil,
+		ErrTruncatedTransfer,
+		ErrFileTooLarge,
+	}
+
+	for i, in := range inputs {
+		r, ch := newTarStream(strings.NewReader(in.Content), in.Size, 0755, "/tmp/koj-workspace/a.out")
+		var buf bytes.Buffer
+		read, err := copyFromTar(&buf, r, in.Limit)
+		ioutil.ReadAll(r)
+		written := <-ch
+
+		if outputs[i] != nil {
+			if err != outputs[i] && written.err != outputs[i] {
+				t.Errorf("error on test case #%v: %v %v", i, err, written.err)
+			}
+			continue
+		}
+		if err != nil || written.err != nil {
+			t.Errorf("error on test case #%v: %v %v", i, err, written.err)
+			continue
+		}
+		if buf.String() != in.Content || read != written.digest {
+			t.Errorf("error on test case #%v", i)
+		}
+	}
+}
@@ -1,13 +1,12 @@
 package workers
 
 import (
-	"archive/tar"
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"io"
 	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -15,26 +14,23 @@ import (
 
 	"github.com/ProgrammingLab/koneko-online-judge/server/logger"
 	"github.com/ProgrammingLab/koneko-online-judge/server/modules/unique"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/mount"
-	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/archive"
-	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
 type Worker struct {
 	ID               string
-	cli              *client.Client
+	sandbox          Sandbox
 	TimeLimit        time.Duration
 	MemoryLimit      int64
 	HostJudgeDataDir string
 	separator        string
 	stdout           *os.File
 	stderr           *os.File
+	// 実行が終わるまで借りているCPU
+	cpus []int
+	// インタラクタのサンドボックスと共有するホストのディレクトリ。Removeで削除する
+	interaction string
 }
 
 type ExecStatus int
@@ -46,6 +42,7 @@ const (
 	StatusRuntimeError        ExecStatus = 3
 	StatusUnknownError        ExecStatus = 4
 	StatusOutputLimitExceeded ExecStatus = 5
+	StatusRestrictedFunction  ExecStatus = 6
 	outputLimit                          = 10 * 1024 * 1024
 	errorOutputLimit                     = 512
 	Workspace                            = "/tmp/koj-workspace/"
@@ -53,20 +50,43 @@ const (
 	errorString                          = "runtime_error"
 	exitCodeFile                         = "exit.txt"
 	removeTimeout                        = 10 * time.Second
+	interactorArg                        = "--interactor"
+	interactionArg                       = "--interaction"
+	checkerArg                           = "--checker"
+	seccompProfileNone                   = "none"
 )
 
+// チェッカーのコマンドの中でテストケースごとのファイルのパスに置き換えられる文字列
+const (
+	CheckerInputPlaceholder  = "{input}"
+	CheckerAnswerPlaceholder = "{answer}"
+	// 提出されたプログラムの出力
+	CheckerOutputPlaceholder = "{output}"
+)
+
+// テストケース1つで使えるプロセス (スレッド) 数。runnerがテストケースごとのcgroupに設定する
+const CasePidsLimit = 40
+
+// runnerが返すテストケースごとの標準エラー出力の長さ。テストケースの結果とチェッカーのフィードバックもここまで保存する
+const CaseStderrLimit = 1024
+
 var (
 	ErrTimeTextParse = errors.New("time.txtの内容がパースできません。")
-	errRuntime       = errors.New("runtime error")
+	// サンドボックスの出力がoutputLimitを超えた。切り詰めると結果を読み違えるので、失敗として扱う
+	ErrOutputTooLarge = errors.New("output of the sandbox is larger than the limit")
+	errRuntime        = errors.New("runtime error")
 )
 
 type ExecResult struct {
 	Status      ExecStatus    `json:"status"`
 	ExecTime    time.Duration `json:"execTime"`
+	WallTime    time.Duration `json:"wallTime"`
 	MemoryUsage int64         `json:"memoryUsage"`
 	Stdout      string        `json:"stdout"`
 	Stderr      string        `json:"stderr"`
 	ExitStatus  int           `json:"exitStatus"`
+	// インタラクティブな問題でのインタラクタの実行結果
+	Interactor *ExecResult `json:"interactor,omitempty"`
 }
 
 func NewTimeoutWorker(img string, timeLimit time.Duration, memoryLimit int64, cmd []string) (*Worker, error) {
@@ -83,7 +103,7 @@ func NewTimeoutWorker(img string, timeLimit time.Duration, memoryLimit int64, cm
 		"/bin/bash", "-c", strings.Join(cmd, " ") + ";" + outputCmd,
 	}
 
-	w, err := newWorker(img, timeLimit, memoryLimit, runCmd, nil)
+	w, err := newWorker(img, timeLimit, memoryLimit, 1, runCmd, false, "")
 	if err != nil {
 		logger.AppLog.Error(err)
 		return nil, err
@@ -93,7 +113,12 @@ func NewTimeoutWorker(img string, timeLimit time.Duration, memoryLimit int64, cm
 	return w, err
 }
 
-func NewJudgementWorker(img string, timeLimit time.Duration, memoryLimit int64, cmd []string) (*Worker, error) {
+// timeLimitはCPU時間、wallTimeLimitは実時間の制限。
+// parallelismは同時に実行するテストケースの数の上限で、テストケースはそれぞれ別のCPUに固定される。
+// seccompProfileはrunnerで使うシステムコールの許可リストの名前。"none"のときは制限しない。
+// interactiveはインタラクティブな問題のときだけtrueにする。
+// 標準入出力はCreateInteractionPipesで作るパイプで、NewInteractorWorkerのインタラクタにつながる。
+func NewJudgementWorker(img string, timeLimit, wallTimeLimit time.Duration, memoryLimit int64, parallelism int, seccompProfile string, interactive bool, cmd []string) (*Worker, error) {
 	sp, err := newSeparator()
 	if err != nil {
 		return nil, err
@@ -102,32 +127,68 @@ func NewJudgementWorker(img string, timeLimit time.Duration, memoryLimit int64,
 	runCmd := []string{
 		"./runner",
 		strconv.FormatInt(int64(timeLimit), 10),
+		strconv.FormatInt(int64(wallTimeLimit), 10),
 		strconv.FormatInt(int64(memoryLimit), 10),
+		seccompProfile,
+	}
+	if !interactive {
+		runCmd = append(runCmd, cmd...)
+		return newRunnerWorker(img, timeLimit, memoryLimit, parallelism, sp, runCmd)
 	}
+	runCmd = append(runCmd, interactionArg)
 	runCmd = append(runCmd, cmd...)
 
-	judgeData, err := createJudgeDataDir()
+	interaction, err := createInteractionDir()
+	if err != nil {
+		logger.AppLog.Error(err)
+		return nil, err
+	}
+	w, err := newWorker(img, timeLimit, memoryLimit, parallelism, runCmd, true, interaction)
 	if err != nil {
 		logger.AppLog.Error(err)
+		os.RemoveAll(interaction)
+		return nil, err
+	}
+	w.interaction = interaction
+
+	return setupRunnerWorker(w, sp)
+}
+
+// 1つのコンテナの中で、テストケースごとにチェッカーを実行する。
+// 入力はjudge_data/input、想定解はjudge_data/answer、提出の出力はjudge_data/submissionに、
+// チェッカーの実行ファイルはjudge_data/checkerに置いておくこと。
+// cmdの中のプレースホルダーはそれぞれのファイルのパスに置き換えられる。
+func NewCheckerWorker(img string, timeLimit time.Duration, memoryLimit int64, parallelism int, cmd []string) (*Worker, error) {
+	sp, err := newSeparator()
+	if err != nil {
 		return nil, err
 	}
 
-	mounts := []mount.Mount{
-		{
-			Type:     mount.TypeBind,
-			Source:   judgeData,
-			Target:   JudgeDataDir,
-			ReadOnly: false,
-		},
+	runCmd := []string{
+		"./runner",
+		strconv.FormatInt(int64(timeLimit), 10),
+		strconv.FormatInt(int64(timeLimit), 10),
+		strconv.FormatInt(memoryLimit, 10),
+		seccompProfileNone,
+		checkerArg,
 	}
+	runCmd = append(runCmd, cmd...)
+
+	return newRunnerWorker(img, timeLimit, memoryLimit, parallelism, sp, runCmd)
+}
 
-	w, err := newWorker(img, timeLimit, memoryLimit, runCmd, mounts)
+func newRunnerWorker(img string, timeLimit time.Duration, memoryLimit int64, parallelism int, separator string, runCmd []string) (*Worker, error) {
+	w, err := newWorker(img, timeLimit, memoryLimit, parallelism, runCmd, true, "")
 	if err != nil {
 		logger.AppLog.Error(err)
 		return nil, err
 	}
-	w.separator = sp
-	w.HostJudgeDataDir = judgeData
+	return setupRunnerWorker(w, separator)
+}
+
+// ワークスペースにrunnerを置く。失敗したときはwを削除する
+func setupRunnerWorker(w *Worker, separator string) (*Worker, error) {
+	w.separator = separator
 
 	runnerAbs, err := filepath.Abs("../runner/runner")
 	if err != nil {
@@ -137,51 +198,38 @@ func NewJudgementWorker(img string, timeLimit time.Duration, memoryLimit int64,
 	}
 	if err := w.CopyFileToContainer(runnerAbs, Workspace+"runner"); err != nil {
 		logger.AppLog.Error(err)
+		w.Remove()
 		return nil, err
 	}
 
-	return w, err
+	return w, nil
 }
 
-func newWorker(img string, timeLimit time.Duration, memoryLimit int64, cmd []string, mounts []mount.Mount) (*Worker, error) {
-	ctx := context.Background()
-	cli, err := client.NewEnvClient()
+// 空いているCPUをparallelism個まで借りて、それだけを使うサンドボックスを作成する
+func newWorker(img string, timeLimit time.Duration, memoryLimit int64, parallelism int, cmd []string, judgeData bool, interaction string) (*Worker, error) {
+	cpus := cpuPool.acquire(parallelism)
+	w, err := newWorkerWithCPUs(img, timeLimit, memoryLimit, cpus, cmd, judgeData, interaction)
 	if err != nil {
+		cpuPool.release(cpus)
 		return nil, err
 	}
+	w.cpus = cpus
+	return w, nil
+}
 
-	cfg := &container.Config{
-		Image:        img,
-		AttachStdin:  true,
-		AttachStdout: true,
-		AttachStderr: true,
-		OpenStdin:    true,
-		StdinOnce:    true,
-		Tty:          false,
-		WorkingDir:   Workspace,
-		Cmd:          cmd,
-	}
-	hcfg := &container.HostConfig{
-		Resources: container.Resources{
-			CpusetCpus: "0",
-			PidsLimit:  50,
-			Memory:     memoryLimit + 10*1024*1024,
-		},
-		NetworkMode: "none",
-		Mounts:      mounts,
-	}
-
-	res, err := cli.ContainerCreate(ctx, cfg, hcfg, &network.NetworkingConfig{}, "")
+// cpusはプールから借りずにそのまま使う。Removeしてもプールには返さない
+func newWorkerWithCPUs(img string, timeLimit time.Duration, memoryLimit int64, cpus []int, cmd []string, judgeData bool, interaction string) (*Worker, error) {
+	s, err := newSandbox(img, memoryLimit, cpus, cmd, judgeData, interaction)
 	if err != nil {
-		logger.AppLog.Errorf("error %v %+v", img, err)
 		return nil, err
 	}
 
 	w := &Worker{
-		ID:          res.ID,
-		TimeLimit:   timeLimit,
-		MemoryLimit: memoryLimit,
-		cli:         cli,
+		ID:               s.ID(),
+		sandbox:          s,
+		TimeLimit:        timeLimit,
+		MemoryLimit:      memoryLimit,
+		HostJudgeDataDir: s.HostJudgeDataDir(),
 	}
 	return w, nil
 }
@@ -197,26 +245,13 @@ func newSeparator() (string, error) {
 }
 
 func (w *Worker) Run(input string, parseOutput bool) (*ExecResult, error) {
-	ctx := context.Background()
-	opt := types.ContainerAttachOptions{
-		Stream: true,
-		Stdin:  true,
-		Stdout: true,
-		Stderr: true,
-	}
-	hijacked, err := w.cli.ContainerAttach(ctx, w.ID, opt)
-	if err != nil {
-		logger.AppLog.Errorf("error  %+v", err)
-		return nil, err
-	}
-	defer hijacked.Close()
-
-	startErrChan := make(chan error)
-	go func() {
-		err = w.cli.ContainerStart(ctx, w.ID, types.ContainerStartOptions{})
-		startErrChan <- err
-	}()
+	return w.RunContext(context.Background(), input, parseOutput)
+}
 
+// ctxがキャンセルされたら、実行中のコマンドを止めてctx.Err()を返す
+func (w *Worker) RunContext(ctx context.Context, input string, parseOutput bool) (*ExecResult, error) {
+	createTempDir()
+	var err error
 	w.stdout, err = ioutil.TempFile(Workspace, "stdout"+w.ID[:16])
 	if err != nil {
 		logger.AppLog.Errorf("error %+v", err)
@@ -229,25 +264,10 @@ func (w *Worker) Run(input string, parseOutput bool) (*ExecResult, error) {
 		return nil, err
 	}
 
-	streamErrChan := make(chan error)
-	go func() {
-		_, err := hijacked.Conn.Write([]byte(input))
-		if err != nil {
-			streamErrChan <- err
-			return
-		}
-
-		hijacked.CloseWrite()
-
-		_, err = stdcopy.StdCopy(w.stdout, w.stderr, hijacked.Reader)
-		streamErrChan <- err
-	}()
-
-	if err := <-startErrChan; err != nil {
-		logger.AppLog.Errorf("error %+v", err)
-		return nil, err
-	}
-	if err := <-streamErrChan; err != nil {
+	err = w.sandbox.Run(ctx, strings.NewReader(input), w.stdout, w.stderr)
+	// 実行が終わったら、ファイルを読み出すだけなのでCPUは返す
+	w.releaseCPUs()
+	if err != nil {
 		logger.AppLog.Errorf("error %+v", err)
 		return nil, err
 	}
@@ -297,64 +317,95 @@ func (w *Worker) Run(input string, parseOutput bool) (*ExecResult, error) {
 	}
 	memoryUsage *= 1024
 
+	exitStatus, _ := strconv.Atoi(strings.TrimSpace(exitCode))
+
 	return &ExecResult{
 		Status:      checkStatus(timeMillis, memoryUsage, w.TimeLimit, w.MemoryLimit, exitCode),
 		ExecTime:    time.Duration(timeMillis) * time.Millisecond,
 		MemoryUsage: memoryUsage,
 		Stdout:      rawStdout[0],
 		Stderr:      rawStderr[0],
+		ExitStatus:  exitStatus,
 	}, nil
 }
 
+// ファイルをメモリに読み込まずに、distの同じパスにコピーする
 func (w *Worker) CopyTo(filename string, dist *Worker) error {
-	const limit = 10 * 1024 * 1024
-	content, err := w.getFromContainer(filename, limit)
-	if err != nil && err != io.EOF {
-		logger.AppLog.Errorf("%+v", err)
+	size, err := w.sandbox.Stat(filename)
+	if err != nil {
 		return err
 	}
-	return dist.CopyContentToContainer(content, filename)
-}
+	if fileSizeLimit < size {
+		return ErrFileTooLarge
+	}
 
-func (w *Worker) CopyContentToContainer(content []byte, name string) error {
-	createTempDir()
-	base := path.Base(name)
-	f, err := os.Create(Workspace + base)
-	if err != nil {
-		logger.AppLog.Errorf("could not create temp file %+v", err)
-		return err
+	r, pw := io.Pipe()
+	ch := make(chan transferResult, 1)
+	go func() {
+		d, err := w.CopyFromContainer(filename, pw, fileSizeLimit)
+		pw.CloseWithError(err)
+		ch <- transferResult{d, err}
+	}()
+
+	written, err := dist.CopyToContainer(r, size, 0777, filename)
+	r.Close()
+	read := <-ch
+	if read.err != nil && read.err != io.ErrClosedPipe {
+		return read.err
 	}
-	f.Write(content)
-	f.Close()
-	err = os.Chmod(f.Name(), 0777)
 	if err != nil {
-		logger.AppLog.Errorf("could not change temp file mode %+v", err)
 		return err
 	}
-	defer removeTempFile(f)
 
-	srcInfo, err := archive.CopyInfoSourcePath(f.Name(), false)
+	if read.digest != written {
+		logger.AppLog.Errorf("%v: %v %+v %+v", ErrChecksumMismatch, filename, read.digest, written)
+		return ErrChecksumMismatch
+	}
+
+	// 書き込んだ側で数えたSHA-256は送った内容のものなので、distに保存された内容を読み直して確かめる
+	stored, err := dist.CopyFromContainer(filename, ioutil.Discard, fileSizeLimit)
 	if err != nil {
-		logger.AppLog.Errorf("", err)
 		return err
 	}
+	if read.digest != stored {
+		logger.AppLog.Errorf("%v: %v %+v %+v", ErrChecksumMismatch, filename, read.digest, stored)
+		return ErrChecksumMismatch
+	}
+	return nil
+}
 
-	srcArchive, err := archive.TarResource(srcInfo)
+// ファイル全体をメモリに読み込む。大きなファイルはCopyFromContainerで書き出すこと
+func (w *Worker) ReadFile(filename string) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := w.CopyFromContainer(filename, &buf, fileSizeLimit); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// サンドボックスの中のファイルをdstに書き込む。limitバイトより大きければErrFileTooLargeを返す
+func (w *Worker) CopyFromContainer(filename string, dst io.Writer, limit int64) (FileDigest, error) {
+	d, err := w.sandbox.ReadFile(filename, dst, limit)
 	if err != nil {
-		logger.AppLog.Errorf("%+v", err)
-		return err
+		logger.AppLog.Errorf("%v: %+v", filename, err)
+		return FileDigest{}, err
 	}
-	defer srcArchive.Close()
+	return d, nil
+}
 
-	dstInfo := archive.CopyInfo{Path: name}
-	dstDir, preparedArchive, err := archive.PrepareArchiveCopy(srcArchive, srcInfo, dstInfo)
+// srcからsizeバイトを読んで、サンドボックスの中のdstに書き込む
+func (w *Worker) CopyToContainer(src io.Reader, size int64, mode os.FileMode, dst string) (FileDigest, error) {
+	d, err := w.sandbox.WriteFile(src, size, mode, dst)
 	if err != nil {
-		logger.AppLog.Errorf("%+v", err)
-		return err
+		logger.AppLog.Errorf("%v: %+v", dst, err)
+		return FileDigest{}, err
 	}
+	return d, nil
+}
 
-	ctx := context.Background()
-	return w.cli.CopyToContainer(ctx, w.ID, dstDir, preparedArchive, types.CopyToContainerOptions{})
+func (w *Worker) CopyContentToContainer(content []byte, name string) error {
+	_, err := w.CopyToContainer(bytes.NewReader(content), int64(len(content)), 0777, name)
+	return err
 }
 
 func (w *Worker) CopyFileToContainer(src, dst string) error {
@@ -365,31 +416,24 @@ func (w *Worker) CopyFileToContainer(src, dst string) error {
 	}
 	defer f.Close()
 
-	srcInfo, err := archive.CopyInfoSourcePath(f.Name(), false)
-	if err != nil {
-		logger.AppLog.Error(err)
-		return err
-	}
-
-	srcArchive, err := archive.TarResource(srcInfo)
+	info, err := f.Stat()
 	if err != nil {
 		logger.AppLog.Error(err)
 		return err
 	}
-	defer srcArchive.Close()
 
-	dstInfo := archive.CopyInfo{Path: dst}
-	dstDir, preparedArchive, err := archive.PrepareArchiveCopy(srcArchive, srcInfo, dstInfo)
-	if err != nil {
-		logger.AppLog.Error(err)
-		return err
-	}
+	_, err = w.CopyToContainer(f, info.Size(), info.Mode(), dst)
+	return err
+}
 
-	ctx := context.Background()
-	return w.cli.CopyToContainer(ctx, w.ID, dstDir, preparedArchive, types.CopyToContainerOptions{})
+func (w *Worker) releaseCPUs() {
+	cpuPool.release(w.cpus)
+	w.cpus = nil
 }
 
 func (w *Worker) Remove() error {
+	w.releaseCPUs()
+
 	if w.stdout != nil {
 		removeTempFile(w.stdout)
 		w.stdout = nil
@@ -399,32 +443,27 @@ func (w *Worker) Remove() error {
 		w.stderr = nil
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), removeTimeout)
-	err := w.cli.ContainerRemove(ctx, w.ID, types.ContainerRemoveOptions{
-		Force: true,
-	})
-	if err != nil {
-		logger.AppLog.Errorf("worker: remove error %+v", err)
+	err := w.sandbox.Remove()
+	if w.interaction != "" {
+		os.RemoveAll(w.interaction)
+		w.interaction = ""
 	}
-	w.cli.Close()
-
-	if w.HostJudgeDataDir != "" {
-		os.RemoveAll(w.HostJudgeDataDir)
-	}
-
 	return err
 }
 
 func (w *Worker) parseOutput(r io.Reader) ([]string, error) {
-	raw := make([]byte, outputLimit)
-	n, err := r.Read(raw)
+	// 1回のReadでは途中までしか読めないことがあるので、上限を1バイト超えるまで読み切る
+	raw, err := ioutil.ReadAll(io.LimitReader(r, outputLimit+1))
 	if err != nil {
-		if err != io.EOF {
-			return nil, err
-		}
+		return nil, err
+	}
+	if outputLimit < len(raw) {
+		return nil, ErrOutputTooLarge
+	}
+	if len(raw) == 0 {
 		return []string{""}, nil
 	}
-	out := string(raw[0:n])
+	out := string(raw)
 
 	res := make([]string, 0, 3)
 	for {
@@ -442,26 +481,6 @@ func (w *Worker) parseOutput(r io.Reader) ([]string, error) {
 	return res, nil
 }
 
-func (w *Worker) getFromContainer(path string, limit int64) ([]byte, error) {
-	ctx := context.Background()
-	f, _, err := w.cli.CopyFromContainer(ctx, w.ID, path)
-	if err != nil {
-		logger.AppLog.Errorf("%+v", err)
-		return nil, err
-	}
-
-	r := tar.NewReader(f)
-	r.Next()
-	buf := make([]byte, limit)
-	n, err := r.Read(buf)
-	if err != nil && err != io.EOF {
-		logger.AppLog.Errorf("%+v", err)
-		return nil, err
-	}
-
-	return buf[0:n], err
-}
-
 func createJudgeDataDir() (string, error) {
 	id, err := unique.GenerateRandomBase62String(12)
 	if err != nil {